@@ -0,0 +1,54 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	"github.com/alexedwards/scs/pgxstore"
+	"github.com/dunky-star/modern-webapp-golang/internal/config"
+	"github.com/dunky-star/modern-webapp-golang/internal/driver"
+	"github.com/dunky-star/modern-webapp-golang/internal/handlers"
+	"github.com/dunky-star/modern-webapp-golang/internal/helpers"
+	"github.com/dunky-star/modern-webapp-golang/internal/metrics"
+	"github.com/dunky-star/modern-webapp-golang/internal/render"
+	"github.com/dunky-star/modern-webapp-golang/internal/tracing"
+	"github.com/dunky-star/modern-webapp-golang/pkg/logging"
+)
+
+// application holds everything the server needs. Middleware, routes and shutdown are
+// methods on it, so several instances can coexist (e.g. in tests) without shared globals.
+type application struct {
+	cfg      *config.AppConfig
+	db       *driver.Driver
+	handlers *handlers.Repository
+	render   *render.Renderer
+	helpers  *helpers.Helpers
+	mailer   *mailer
+	metrics  *metrics.Metrics
+	tracing  *tracing.Provider
+
+	// sessionStore is the postgres session store, nil when sessions are kept in memory
+	sessionStore *pgxstore.PostgresStore
+
+	requestLogger     *log.Logger
+	requestLogWriter  *logging.RotatingLogWriter
+	requestLoggerOnce sync.Once
+}
+
+// newApplication wires the application's components together around a config, a connected driver,
+// the application's metrics and its tracer provider
+func newApplication(cfg *config.AppConfig, db *driver.Driver, mx *metrics.Metrics, tp *tracing.Provider) *application {
+	h := helpers.New(cfg)
+	rend := render.New(cfg, tp)
+
+	return &application{
+		cfg:      cfg,
+		db:       db,
+		handlers: handlers.NewRepo(cfg, db, rend, h, mx),
+		render:   rend,
+		helpers:  h,
+		mailer:   newMailer(cfg, mx, tp),
+		metrics:  mx,
+		tracing:  tp,
+	}
+}
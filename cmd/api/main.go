@@ -2,119 +2,155 @@ package main
 
 import (
 	"context"
-	"flag"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
-	"time"
 
+	"github.com/alexedwards/scs/pgxstore"
 	"github.com/dunky-star/modern-webapp-golang/internal/config"
 	"github.com/dunky-star/modern-webapp-golang/internal/data"
 	"github.com/dunky-star/modern-webapp-golang/internal/driver"
-	"github.com/dunky-star/modern-webapp-golang/internal/handlers"
 	"github.com/dunky-star/modern-webapp-golang/internal/helpers"
+	"github.com/dunky-star/modern-webapp-golang/internal/metrics"
 	"github.com/dunky-star/modern-webapp-golang/internal/render"
+	"github.com/dunky-star/modern-webapp-golang/internal/tracing"
 	"github.com/joho/godotenv"
 )
 
 const appVersion = "1.0.0"
 
-var app config.AppConfig
-var appStartTime = time.Now()
-
 func main() {
-	var port int
-	var env string
-	var dsn string
 	godotenv.Load(".env")
-	flag.IntVar(&port, "port", 3000, "API server port")
-	flag.StringVar(&env, "env", "dev", "Environment (dev|stage|prod)")
-	flag.StringVar(&dsn, "db-dsn", os.Getenv("DB_DSN"), "DB connection string")
-	flag.Parse()
 
-	err := run(port, env, dsn)
+	// Defaults, then config file, then environment, then flags
+	settings, printConfig, err := loadSettings(os.Args[1:])
 	if err != nil {
-		app.ErrorLog.Fatal(err)
+		log.Fatal(err)
+	}
+	if printConfig {
+		if err := settings.Print(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := settings.Validate(); err != nil {
+		log.Fatalf("invalid configuration:\n%v", err)
+	}
+	if printConfig {
+		return
+	}
+
+	app, err := run(settings)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	// Close database connection when application exits
-	defer driver.Close()
-	// Close email channel when application exits
-	defer close(app.MailChan)
 	// Listen for mail messages using goroutine to send emails
-	listenForMail()
+	app.mailer.listen()
 
-	app.InfoLog.Printf("Server is running on port %s\n", helpers.GetServerURL(port))
+	app.cfg.InfoLog.Printf("Server is running on port %s\n", helpers.GetServerURL(app.cfg.Port, app.cfg.TLSEnabled()))
 
 	// Create the HTTP Server
 	srv := &http.Server{
-		Addr:         fmt.Sprintf(":%d", port),
-		Handler:      routes(),         // Set the routes for the server
-		ReadTimeout:  10 * time.Second, // Maximum duration for reading the entire request, including the body
-		WriteTimeout: 30 * time.Second, // Maximum duration before timing out writes of the response
-		IdleTimeout:  time.Minute,      // Maximum amount of time to wait for the next request when keep-alives are enabled
+		Addr:         fmt.Sprintf(":%d", app.cfg.Port),
+		Handler:      app.routes(),                 // Set the routes for the server
+		ReadTimeout:  settings.Server.ReadTimeout,  // Maximum duration for reading the entire request, including the body
+		WriteTimeout: settings.Server.WriteTimeout, // Maximum duration before timing out writes of the response
+		IdleTimeout:  settings.Server.IdleTimeout,  // Maximum amount of time to wait for the next request when keep-alives are enabled
+		ErrorLog:     app.cfg.ErrorLog,
 	}
 
-	// Ensure request logger is closed on shutdown
-	defer closeRequestLogger()
+	// Terminate TLS natively (HTTP/2 is negotiated via ALPN) and redirect plain HTTP if requested
+	var redirectSrv *http.Server
+	if app.cfg.TLSEnabled() {
+		tlsConfig, err := app.newTLSConfig(app.cfg.TLSCertFile, app.cfg.TLSKeyFile)
+		if err != nil {
+			app.cfg.ErrorLog.Fatal(err)
+		}
+		srv.TLSConfig = tlsConfig
+		srv.Protocols = new(http.Protocols)
+		srv.Protocols.SetHTTP1(true)
+		srv.Protocols.SetHTTP2(true)
+
+		if redirectPort := settings.Server.RedirectPort; redirectPort > 0 {
+			redirectSrv = app.newRedirectServer(redirectPort, app.cfg.Port)
+			app.cfg.InfoLog.Printf("Redirecting HTTP on port %d to HTTPS\n", redirectPort)
+		}
+	}
 
-	// Start the server and log any error if it fails
-	err = srv.ListenAndServe()
-	app.ErrorLog.Fatal(err)
+	// Serve until SIGINT/SIGTERM, then shut everything down in order
+	if err := app.serve(srv, redirectSrv); err != nil {
+		app.cfg.ErrorLog.Println(err)
+		os.Exit(1)
+	}
+	app.cfg.InfoLog.Println("Server stopped")
 }
 
-func run(port int, env string, dsn string) error {
-	// Create a channel for sending emails
-	mailChan := make(chan data.MailData)
-	app.MailChan = mailChan
-
+// run builds the application config, connects to the database and wires up the application
+func run(s config.Settings) (*application, error) {
 	// Initialize application configuration
-	cfg := config.New(port, env, dsn)
+	cfg, err := config.New(s)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Version = appVersion
+
+	// Create a buffered channel for sending emails so handlers don't block on SMTP
+	cfg.MailChan = make(chan data.MailData, s.Mail.QueueSize)
 
 	// Create template cache
 	tc, err := render.CreateTemplateCache()
 	if err != nil {
-		cfg.ErrorLog.Fatal("cannot create template cache")
-		return err
+		return nil, fmt.Errorf("cannot create template cache: %w", err)
 	}
 
 	// Set template cache and use cache flag
 	cfg.TemplateCache = tc
 	cfg.UseCache = (cfg.Env != "dev")
 
-	// Preserve the mail channel that was created earlier
-	cfg.MailChan = mailChan
-
-	app = *cfg
-
-	// Validate DSN is set
-	if cfg.DSN == "" {
-		cfg.ErrorLog.Fatal("db-dsn flag or DB_DSN environment variable must be set")
+	// Set up tracing before connecting so every query is traced
+	ctx := context.Background()
+	tp, err := tracing.New(ctx, s.Tracing.Exporter, s.Tracing.File, appVersion)
+	if err != nil {
+		return nil, err
 	}
 
-	// Connect to database with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+	// Connect to database, retrying with backoff while it starts up
+	pool := poolConfig(s.Database)
+	db := driver.New(pool, retryConfig(s.Database))
+	db.InfoLog = cfg.WarningLog
+	db.Tracer = tp.Tracer()
 
-	dbPool, err := driver.Init(ctx, cfg.DSN)
-	if err != nil {
-		cfg.ErrorLog.Fatal(err)
+	if _, err := db.Connect(ctx, cfg.DSN); err != nil {
+		tp.Shutdown(ctx)
+		return nil, err
+	}
+	cfg.InfoLog.Printf("Database connection pool established successfully (max %d conns, %s)", pool.MaxConns, pool.ExecMode)
+
+	// Optional read replica for read-only queries
+	if s.Database.ReplicaDSN != "" {
+		if _, err := db.ConnectReplica(ctx, s.Database.ReplicaDSN); err != nil {
+			db.Close()
+			tp.Shutdown(ctx)
+			return nil, err
+		}
+		cfg.InfoLog.Println("Read-replica connection pool established successfully")
 	}
-	cfg.InfoLog.Println("Database connection pool established successfully")
-
-	// Initialize handlers repository
-	repo := handlers.NewRepo(&app, dbPool)
-	handlers.NewHandlers(repo)
 
-	// Initialize render package with app config
-	render.NewRender(&app)
+	// Expose pool statistics on /metrics
+	mx := metrics.New()
+	mx.RegisterPool("primary", db.Primary)
+	if db.Replica() != nil {
+		mx.RegisterPool("replica", db.Replica)
+	}
 
-	// Initialize helpers package with app config
-	helpers.NewHelpers(&app)
+	app := newApplication(cfg, db, mx, tp)
 
-	// Store appStartTime in handlers package for health check
-	handlers.SetAppStartTime(appStartTime)
-	handlers.SetAppVersion(appVersion)
+	// Keep sessions in postgres so they survive restarts and are shared between replicas
+	if s.Session.Store == "postgres" {
+		app.sessionStore = pgxstore.NewWithCleanupInterval(db.Primary(), s.Session.CleanupInterval)
+		cfg.Session.Store = app.sessionStore
+	}
 
-	return nil
+	return app, nil
 }
@@ -2,53 +2,65 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"log"
+	"net"
 	"net/http"
-	"sync"
+	"net/netip"
+	"strings"
 	"time"
 
-	"github.com/dunky-star/modern-webapp-golang/internal/helpers"
+	"github.com/dunky-star/modern-webapp-golang/internal/data"
+	"github.com/dunky-star/modern-webapp-golang/internal/handlers"
 	"github.com/dunky-star/modern-webapp-golang/internal/render"
+	"github.com/dunky-star/modern-webapp-golang/internal/tracing"
 	"github.com/dunky-star/modern-webapp-golang/pkg/csrf"
 	"github.com/dunky-star/modern-webapp-golang/pkg/logging"
-)
-
-var (
-	requestLogger     *log.Logger
-	requestLogWriter  *logging.RotatingLogWriter
-	requestLoggerOnce sync.Once
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // initRequestLogger initializes the rotating log writer for HTTP request logs
-func initRequestLogger(alsoWriteToConsole bool) error {
+func (app *application) initRequestLogger(alsoWriteToConsole bool) error {
 	var initErr error
-	requestLoggerOnce.Do(func() {
-		rotatingWriter, err := logging.NewRotatingLogWriter(alsoWriteToConsole)
+	app.requestLoggerOnce.Do(func() {
+		ls := app.cfg.Settings.Logging
+		rotatingWriter, err := logging.NewRotatingLogWriter(logging.Options{
+			Dir:     ls.Dir,
+			File:    ls.File,
+			MaxSize: ls.MaxSize,
+			MaxAge:  ls.MaxAge,
+			Console: alsoWriteToConsole,
+		})
 		if err != nil {
 			initErr = err
 			return
 		}
-		requestLogWriter = rotatingWriter
-		requestLogger = log.New(rotatingWriter, "", log.Ldate|log.Ltime)
+		app.requestLogWriter = rotatingWriter
+		app.requestLogger = log.New(rotatingWriter, "", log.Ldate|log.Ltime)
 	})
 	return initErr
 }
 
 // closeRequestLogger closes the rotating log writer (call on application shutdown)
-func closeRequestLogger() {
-	if requestLogWriter != nil {
-		requestLogWriter.Close()
+func (app *application) closeRequestLogger() {
+	if app.requestLogWriter != nil {
+		if err := app.requestLogWriter.Close(); err != nil {
+			app.cfg.ErrorLog.Printf("Failed to close request logger: %v", err)
+		}
 	}
 }
 
 // logRequest logs HTTP request details (method, path, remote address, duration)
-// Logs are written to a rotating file (output/logs/access.log) that rotates at 5MB or 2 weeks
-func logRequest(next http.Handler) http.Handler {
+// Logs are written to a rotating file (output/logs/access.log by default) that rotates at 5MB or 2 weeks unless configured otherwise
+func (app *application) logRequest(next http.Handler) http.Handler {
 	// Initialize request logger on first use (also write to console in dev mode)
-	alsoWriteToConsole := app.Env == "dev"
-	if err := initRequestLogger(alsoWriteToConsole); err != nil {
+	alsoWriteToConsole := app.cfg.Env == "dev"
+	if err := app.initRequestLogger(alsoWriteToConsole); err != nil {
 		// Fallback to app logger if rotation init fails
-		app.WarningLog.Printf("Failed to initialize request logger: %v", err)
+		app.cfg.WarningLog.Printf("Failed to initialize request logger: %v", err)
 	}
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -57,14 +69,19 @@ func logRequest(next http.Handler) http.Handler {
 		// Create a response writer wrapper to capture status code
 		rw := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
 
+		// Let recordRoute report the matched mux pattern back to us
+		route := &routeInfo{}
+		r = r.WithContext(context.WithValue(r.Context(), routeInfoKey{}, route))
+
 		// Call the next handler
 		next.ServeHTTP(rw, r)
 
 		// Log the request details to rotating file (and console in dev)
 		// Use string builder for better performance with multiple string operations
 		duration := time.Since(start)
-		if requestLogger != nil {
-			requestLogger.Printf("%s %s %s %s %d %v",
+		app.metrics.ObserveRequest(route.pattern, r.Method, rw.statusCode, duration)
+		if app.requestLogger != nil {
+			app.requestLogger.Printf("%s %s %s %s %d %v",
 				r.RemoteAddr,
 				r.Proto,
 				r.Method,
@@ -74,7 +91,7 @@ func logRequest(next http.Handler) http.Handler {
 			)
 		} else {
 			// Fallback to app logger if request logger not initialized
-			app.InfoLog.Printf("%s %s %s %s %d %v",
+			app.cfg.InfoLog.Printf("%s %s %s %s %d %v",
 				r.RemoteAddr,
 				r.Proto,
 				r.Method,
@@ -86,6 +103,59 @@ func logRequest(next http.Handler) http.Handler {
 	})
 }
 
+// traceRequest starts a server span for each request, continuing any trace propagated by the caller.
+// Must run inside logRequest: the span is named after the route pattern recorded there.
+func (app *application) traceRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := tracing.Propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := app.tracing.Tracer().Start(ctx, r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("url.path", r.URL.Path),
+				attribute.String("client.address", r.RemoteAddr),
+				attribute.String("user_agent.original", r.UserAgent()),
+			),
+		)
+		defer span.End()
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+
+		if route, ok := r.Context().Value(routeInfoKey{}).(*routeInfo); ok && route.pattern != "" {
+			span.SetName(route.pattern)
+			span.SetAttributes(attribute.String("http.route", route.pattern))
+		}
+		if rw, ok := w.(*responseWriter); ok {
+			span.SetAttributes(attribute.Int("http.response.status_code", rw.statusCode))
+			if rw.statusCode >= http.StatusInternalServerError {
+				span.SetStatus(codes.Error, http.StatusText(rw.statusCode))
+			}
+		}
+	})
+}
+
+// routeInfoKey is the context key for the routeInfo set up by logRequest
+type routeInfoKey struct{}
+
+// routeInfo carries the matched route pattern from the mux back out to logRequest.
+// Middleware between them replaces the request via WithContext, so the pattern
+// can't be read from the outer request directly.
+type routeInfo struct {
+	pattern string
+}
+
+// recordRoute wraps the mux and records the pattern it matched (e.g. "GET /choose-room/{id}")
+// so metrics are labelled by route rather than by raw path
+func recordRoute(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.ServeHTTP(w, r)
+		// ServeMux sets r.Pattern on the request it was given
+		if route, ok := r.Context().Value(routeInfoKey{}).(*routeInfo); ok {
+			route.pattern = r.Pattern
+		}
+	})
+}
+
 // responseWriter wraps http.ResponseWriter to capture status code
 type responseWriter struct {
 	http.ResponseWriter
@@ -111,14 +181,14 @@ func (rw *responseWriter) Write(b []byte) (int, error) {
 
 // csrfTokenGenerator is middleware that generates and sets CSRF tokens for GET requests
 // and stores the token in request context for use in templates
-func csrfTokenGenerator(next http.Handler) http.Handler {
+func (app *application) csrfTokenGenerator(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Generate tokens for GET requests (that render templates)
 		// Also generate for POST requests that might render templates (like PostAvailabilityHandler)
 		if r.Method == http.MethodGet || r.Method == http.MethodPost {
-			token, err := csrf.GenerateAndSetToken(w, r, app.Env)
+			token, err := csrf.GenerateAndSetToken(w, r, app.cfg.Env, app.cfg.Settings.CSRF.MaxAge)
 			if err != nil {
-				app.ErrorLog.Printf("Error generating CSRF token: %v", err)
+				app.cfg.ErrorLog.Printf("Error generating CSRF token: %v", err)
 				// Continue anyway - token generation failure shouldn't break the request
 			} else {
 				// Store token in context for handlers to access
@@ -131,12 +201,18 @@ func csrfTokenGenerator(next http.Handler) http.Handler {
 	})
 }
 
+// csrfExempt lists paths posted to by other servers rather than browsers, which authenticate
+// their requests another way (the payment webhook is signed by the provider)
+var csrfExempt = map[string]bool{
+	"/payments/webhook": true,
+}
+
 // csrfProtect is middleware that validates CSRF tokens for non-safe HTTP methods
 // Parses form data for POST/PUT/PATCH requests before validation
-func csrfProtect(next http.Handler) http.Handler {
+func (app *application) csrfProtect(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Skip CSRF validation for safe methods
-		if csrf.IsSafeMethod(r.Method) {
+		// Skip CSRF validation for safe methods and exempt paths
+		if csrf.IsSafeMethod(r.Method) || csrfExempt[r.URL.Path] {
 			next.ServeHTTP(w, r)
 			return
 		}
@@ -147,7 +223,7 @@ func csrfProtect(next http.Handler) http.Handler {
 		if contentType == "multipart/form-data" || len(contentType) > 19 && contentType[:19] == "multipart/form-data" {
 			// Parse multipart form (used by FormData in fetch)
 			if err := r.ParseMultipartForm(10 << 20); err != nil { // 10MB limit
-				app.ErrorLog.Printf("Error parsing multipart form for CSRF validation: %v - %s %s from %s", err, r.Method, r.URL.Path, r.RemoteAddr)
+				app.cfg.ErrorLog.Printf("Error parsing multipart form for CSRF validation: %v - %s %s from %s", err, r.Method, r.URL.Path, r.RemoteAddr)
 				http.Error(w, "Bad Request: Invalid form data", http.StatusBadRequest)
 				return
 			}
@@ -158,7 +234,7 @@ func csrfProtect(next http.Handler) http.Handler {
 			// 2. It's idempotent - safe to call multiple times
 			// 3. We only parse for methods that need CSRF validation
 			if err := r.ParseForm(); err != nil {
-				app.ErrorLog.Printf("Error parsing form for CSRF validation: %v - %s %s from %s", err, r.Method, r.URL.Path, r.RemoteAddr)
+				app.cfg.ErrorLog.Printf("Error parsing form for CSRF validation: %v - %s %s from %s", err, r.Method, r.URL.Path, r.RemoteAddr)
 				http.Error(w, "Bad Request: Invalid form data", http.StatusBadRequest)
 				return
 			}
@@ -166,10 +242,11 @@ func csrfProtect(next http.Handler) http.Handler {
 
 		// Validate CSRF token for non-safe methods
 		if err := csrf.ValidateToken(r); err != nil {
-			app.ErrorLog.Printf("CSRF validation failed: %v - %s %s from %s", err, r.Method, r.URL.Path, r.RemoteAddr)
+			app.cfg.ErrorLog.Printf("CSRF validation failed: %v - %s %s from %s", err, r.Method, r.URL.Path, r.RemoteAddr)
+			app.metrics.CSRFFailures.Inc()
 			// For form submissions, redirect back to the same path (as GET) with error message
 			// This provides better UX than showing a 403 error page
-			app.Session.Put(r.Context(), "error", "Your session has expired. Please fill out the form again.")
+			app.cfg.Session.Put(r.Context(), "error", "Your session has expired. Please fill out the form again.")
 			http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
 			return
 		}
@@ -180,12 +257,16 @@ func csrfProtect(next http.Handler) http.Handler {
 
 // secureHeaders adds security headers to all responses
 // Should be applied globally to protect against common web vulnerabilities
-func secureHeaders(next http.Handler) http.Handler {
+func (app *application) secureHeaders(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("X-Content-Type-Options", "nosniff")
 		w.Header().Set("X-Frame-Options", "deny")
 		w.Header().Set("X-XSS-Protection", "1; mode=block")
 		w.Header().Set("Referrer-Policy", "strict-origin-when-cross-origin")
+		// Only send HSTS when we terminate TLS ourselves, otherwise browsers could be locked out over plain HTTP
+		if app.cfg.TLSEnabled() {
+			w.Header().Set("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+		}
 		next.ServeHTTP(w, r)
 	})
 }
@@ -217,24 +298,146 @@ func htmlCacheControl(next http.Handler) http.Handler {
 	})
 }
 
-// sessionMiddleware wraps the session manager's LoadAndSave middleware
-// and injects the session manager into request context for automatic access
-func sessionMiddleware(next http.Handler) http.Handler {
-	return app.Session.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+// sessionMiddleware wraps the session manager's LoadAndSave middleware,
+// injects the session manager into request context for automatic access,
+// logs in users with a "remember me" cookie but no session
+// and records where logged-in sessions were last seen
+func (app *application) sessionMiddleware(next http.Handler) http.Handler {
+	next = app.handlers.RememberMe(app.touchSession(next))
+	return app.cfg.Session.LoadAndSave(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Inject session manager into context for automatic access by render package
-		ctx := context.WithValue(r.Context(), render.SessionManagerKey{}, app.Session)
+		ctx := context.WithValue(r.Context(), render.SessionManagerKey{}, app.cfg.Session)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	}))
 }
 
+// sessionTouchInterval is how often a session's last-seen time is updated
+const sessionTouchInterval = time.Minute
+
+// touchSession records the last-seen time, address and user agent of logged-in sessions
+func (app *application) touchSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.helpers.IsAuthenticated(r) {
+			app.helpers.TouchSession(r, sessionTouchInterval)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// metricsAccess restricts an endpoint to the configured client networks and, if set, a bearer token
+func (app *application) metricsAccess(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status := app.metricsDenied(r); status != 0 {
+			app.helpers.ClientError(w, status)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// healthDetails lets clients that pass the metrics access check see the details of health checks
+func (app *application) healthDetails(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.metricsDenied(r) == 0 {
+			r = r.WithContext(context.WithValue(r.Context(), handlers.HealthDetailsKey{}, true))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// metricsDenied returns the status refusing the request metrics access, or 0 if it's allowed
+func (app *application) metricsDenied(r *http.Request) int {
+	if !app.metricsClientAllowed(r) {
+		return http.StatusForbidden
+	}
+	if app.cfg.MetricsToken != "" {
+		want := "Bearer " + app.cfg.MetricsToken
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(want)) != 1 {
+			return http.StatusUnauthorized
+		}
+	}
+	return 0
+}
+
+// metricsClientAllowed reports whether the request's remote address is in the metrics allowlist
+func (app *application) metricsClientAllowed(r *http.Request) bool {
+	addr, ok := remoteAddr(r.RemoteAddr)
+	return ok && inPrefixes(addr, app.cfg.MetricsAllow)
+}
+
+// realIP replaces the remote address of requests from a trusted reverse proxy with the client
+// address it reports in X-Forwarded-For: the last one that isn't another trusted proxy. Requests
+// from anywhere else keep their address, so clients can't pick their own by sending the header.
+func (app *application) realIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr, ok := remoteAddr(r.RemoteAddr)
+		forwarded := r.Header.Values("X-Forwarded-For")
+		if !ok || len(forwarded) == 0 || !inPrefixes(addr, app.cfg.TrustedProxies) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		hops := strings.Split(strings.Join(forwarded, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			client, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+			if err != nil {
+				break
+			}
+			client = client.Unmap()
+			if !inPrefixes(client, app.cfg.TrustedProxies) {
+				r.RemoteAddr = netip.AddrPortFrom(client, 0).String()
+				break
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// remoteAddr parses the IP address from a request's RemoteAddr
+func remoteAddr(remote string) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		host = remote
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// inPrefixes reports whether addr is in any of the networks
+func inPrefixes(addr netip.Addr, prefixes []netip.Prefix) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
 // authMiddleware checks if the user is authenticated
-func authMiddleware(next http.Handler) http.Handler {
+func (app *application) authMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !helpers.IsAuthenticated(r) {
-			app.Session.Put(r.Context(), "error", "You must be logged in to access this page")
+		if !app.helpers.IsAuthenticated(r) {
+			app.cfg.Session.Put(r.Context(), "error", "You must be logged in to access this page")
 			http.Redirect(w, r, "/user/login", http.StatusSeeOther)
 			return
 		}
 		next.ServeHTTP(w, r)
 	})
 }
+
+// requireRole only lets through users with at least the given role. Use it inside authMiddleware.
+func (app *application) requireRole(min data.Role) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !app.helpers.UserRole(r).AtLeast(min) {
+				app.cfg.WarningLog.Printf("Denied %s %s: requires role %s", r.Method, r.URL.Path, min)
+				app.helpers.ClientError(w, http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
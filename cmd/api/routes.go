@@ -3,11 +3,14 @@ package main
 import (
 	"net/http"
 
-	"github.com/dunky-star/modern-webapp-golang/internal/handlers"
+	"github.com/dunky-star/modern-webapp-golang/internal/data"
+	"github.com/dunky-star/modern-webapp-golang/internal/payments"
 )
 
-func routes() http.Handler {
+// routes builds the router with all middleware applied
+func (app *application) routes() http.Handler {
 	mux := http.NewServeMux()
+	h := app.handlers
 
 	// Static file serving with caching headers (method-specific to avoid Go 1.22+ conflicts)
 	staticHandler := cacheControl(http.StripPrefix("/static/", http.FileServer(http.Dir("./static"))))
@@ -15,39 +18,103 @@ func routes() http.Handler {
 	mux.HandleFunc("HEAD /static/", staticHandler.ServeHTTP)
 
 	// Register application routes
-	mux.HandleFunc("GET /", handlers.Repo.HomeHandler)
-	mux.HandleFunc("GET /health", handlers.Repo.HealthCheckHandler)
-	mux.HandleFunc("GET /about", handlers.Repo.AboutUsHandler)
-	mux.HandleFunc("GET /contact", handlers.Repo.ContactHandler)
-	mux.HandleFunc("GET /user/login", handlers.Repo.ShowLoginHandler)
-	mux.HandleFunc("POST /user/login", handlers.Repo.PostLoginHandler)
-	mux.HandleFunc("GET /user/logout", handlers.Repo.LogoutHandler)
-	mux.HandleFunc("GET /search-availability", handlers.Repo.SearchAvailabilityHandler)
-	mux.HandleFunc("POST /search-availability", handlers.Repo.PostAvailabilityHandler)
-	mux.HandleFunc("POST /search-availability-json", handlers.Repo.AvialabilityJSONHandler)
-	mux.HandleFunc("GET /choose-room/{id}", handlers.Repo.ChooseRoomHandler)
-	mux.HandleFunc("GET /book-room", handlers.Repo.BookRoomHandler)
-	mux.HandleFunc("GET /generals-quarters", handlers.Repo.GeneralsQuartersHandler)
-	mux.HandleFunc("GET /majors-suite", handlers.Repo.MajorsSuiteHandler)
-	mux.HandleFunc("GET /make-reservation", handlers.Repo.MakeReservationHandler)
-	mux.HandleFunc("POST /make-reservation", handlers.Repo.PostReservationHandler)
-	mux.HandleFunc("GET /reservation-summary", handlers.Repo.ReservationSummary)
-	mux.Handle("GET /admin/dashboard", authMiddleware(http.HandlerFunc(handlers.Repo.AdminDashboardHandler)))
+	mux.HandleFunc("GET /", h.HomeHandler)
+	mux.HandleFunc("GET /health", h.HealthCheckHandler)
+	mux.HandleFunc("GET /health/live", h.LivenessHandler)
+	mux.Handle("GET /health/ready", app.healthDetails(http.HandlerFunc(h.ReadinessHandler)))
+	mux.Handle("GET /metrics", app.metricsAccess(app.metrics.Handler()))
+	mux.HandleFunc("GET /about", h.AboutUsHandler)
+	mux.HandleFunc("GET /contact", h.ContactHandler)
+	mux.HandleFunc("GET /user/login", h.ShowLoginHandler)
+	mux.HandleFunc("POST /user/login", h.PostLoginHandler)
+	mux.HandleFunc("GET /user/logout", h.LogoutHandler)
+	mux.HandleFunc("GET /user/oidc/login", h.OIDCLoginHandler)
+	mux.HandleFunc("GET /user/oidc/callback", h.OIDCCallbackHandler)
+	mux.HandleFunc("GET /user/register", h.ShowRegisterHandler)
+	mux.HandleFunc("POST /user/register", h.PostRegisterHandler)
+	mux.Handle("GET /user/bookings", app.authMiddleware(http.HandlerFunc(h.MyBookingsHandler)))
+	mux.HandleFunc("GET /user/forgot-password", h.ShowForgotPasswordHandler)
+	mux.HandleFunc("POST /user/forgot-password", h.PostForgotPasswordHandler)
+	mux.HandleFunc("GET /user/reset-password", h.ShowResetPasswordHandler)
+	mux.HandleFunc("POST /user/reset-password", h.PostResetPasswordHandler)
+	mux.Handle("GET /user/profile", app.authMiddleware(http.HandlerFunc(h.ProfileHandler)))
+	mux.Handle("POST /user/profile", app.authMiddleware(http.HandlerFunc(h.PostProfileHandler)))
+	mux.HandleFunc("GET /user/confirm-email", h.ConfirmEmailHandler)
+	mux.Handle("POST /user/profile/forget-devices", app.authMiddleware(http.HandlerFunc(h.PostForgetDevicesHandler)))
+	mux.Handle("GET /user/sessions", app.authMiddleware(http.HandlerFunc(h.SessionsHandler)))
+	mux.Handle("POST /user/sessions/{id}/revoke", app.authMiddleware(http.HandlerFunc(h.PostRevokeSessionHandler)))
+	mux.Handle("POST /user/sessions/revoke-others", app.authMiddleware(http.HandlerFunc(h.PostRevokeOtherSessionsHandler)))
+	mux.HandleFunc("GET /user/two-factor", h.ShowTwoFactorHandler)
+	mux.HandleFunc("POST /user/two-factor", h.PostTwoFactorHandler)
+	mux.Handle("GET /user/two-factor/setup", app.authMiddleware(http.HandlerFunc(h.ShowTwoFactorSetupHandler)))
+	mux.Handle("POST /user/two-factor/setup", app.authMiddleware(http.HandlerFunc(h.PostTwoFactorSetupHandler)))
+	mux.Handle("POST /user/two-factor/disable", app.authMiddleware(http.HandlerFunc(h.PostTwoFactorDisableHandler)))
+	mux.HandleFunc("GET /search-availability", h.SearchAvailabilityHandler)
+	mux.HandleFunc("POST /search-availability", h.PostAvailabilityHandler)
+	mux.HandleFunc("POST /search-availability-json", h.AvialabilityJSONHandler)
+	mux.HandleFunc("GET /choose-room/{id}", h.ChooseRoomHandler)
+	mux.HandleFunc("GET /book-room", h.BookRoomHandler)
+	mux.HandleFunc("GET /generals-quarters", h.GeneralsQuartersHandler)
+	mux.HandleFunc("GET /majors-suite", h.MajorsSuiteHandler)
+	mux.HandleFunc("GET /make-reservation", h.MakeReservationHandler)
+	mux.HandleFunc("POST /make-reservation", h.PostReservationHandler)
+	mux.HandleFunc("GET /reservation-summary", h.ReservationSummary)
+	mux.HandleFunc("GET /reservation/lookup", h.ShowReservationLookupHandler)
+	mux.HandleFunc("POST /reservation/lookup", h.PostReservationLookupHandler)
+	mux.HandleFunc("POST /reservation/cancel", h.PostCancelReservationHandler)
+	mux.HandleFunc("POST /reservation/change-dates", h.PostChangeReservationDatesHandler)
+	mux.HandleFunc("GET /reservation/payment/return", h.PaymentReturnHandler)
+	mux.HandleFunc("GET /reservation/payment", h.PaymentCompleteHandler)
+	mux.HandleFunc("POST /payments/webhook", h.PaymentWebhookHandler)
+	mux.HandleFunc("GET "+payments.FakeCheckoutPath+"{id}", h.FakeCheckoutHandler)
+	mux.HandleFunc("POST "+payments.FakeCheckoutPath+"{id}", h.PostFakeCheckoutHandler)
+
+	// Admin routes: login required, then a minimum role, then two-factor if managers require it
+	adminRole := func(role data.Role) func(http.HandlerFunc) http.Handler {
+		return func(fn http.HandlerFunc) http.Handler {
+			return app.authMiddleware(app.requireRole(role)(h.RequireTwoFactor(fn)))
+		}
+	}
+	staff, manager := adminRole(data.RoleStaff), adminRole(data.RoleManager)
+	mux.Handle("GET /admin/dashboard", staff(h.AdminDashboardHandler))
+	mux.Handle("GET /admin/users", manager(h.AdminUsersHandler))
+	mux.Handle("GET /admin/users/new", manager(h.AdminNewUserHandler))
+	mux.Handle("POST /admin/users/new", manager(h.PostAdminNewUserHandler))
+	mux.Handle("GET /admin/users/{id}", manager(h.AdminUserHandler))
+	mux.Handle("POST /admin/users/{id}", manager(h.PostAdminUserHandler))
+	mux.Handle("POST /admin/users/{id}/deactivate", manager(h.PostAdminDeactivateUserHandler))
+	mux.Handle("POST /admin/users/{id}/activate", manager(h.PostAdminActivateUserHandler))
+	mux.Handle("POST /admin/users/{id}/logout", manager(h.PostAdminLogoutUserHandler))
+	mux.Handle("GET /admin/promo-codes", manager(h.AdminPromoCodesHandler))
+	mux.Handle("GET /admin/promo-codes/new", manager(h.AdminNewPromoCodeHandler))
+	mux.Handle("POST /admin/promo-codes/new", manager(h.PostAdminNewPromoCodeHandler))
+	mux.Handle("GET /admin/promo-codes/{id}", manager(h.AdminPromoCodeHandler))
+	mux.Handle("POST /admin/promo-codes/{id}", manager(h.PostAdminPromoCodeHandler))
+	mux.Handle("POST /admin/promo-codes/{id}/delete", manager(h.PostAdminDeletePromoCodeHandler))
+	mux.Handle("GET /admin/security", manager(h.AdminSecurityHandler))
+	mux.Handle("POST /admin/security", manager(h.PostAdminSecurityHandler))
 
 	// Apply middleware chain (order matters: last middleware wraps first)
 	// Security headers (outermost - applies to all responses)
+	// -> Client address from trusted proxies
 	// -> Request logging
+	// -> Request tracing
 	// -> HTML cache control (for dynamic pages)
 	// -> Session management
 	// -> CSRF protection
 	// -> CSRF token generation
+	// -> Route recording (for metrics labels)
 	// -> Routes
-	return secureHeaders(
-		logRequest(
-			htmlCacheControl(
-				sessionMiddleware(
-					csrfProtect(
-						csrfTokenGenerator(mux),
+	return app.secureHeaders(
+		app.realIP(
+			app.logRequest(
+				app.traceRequest(
+					htmlCacheControl(
+						app.sessionMiddleware(
+							app.csrfProtect(
+								app.csrfTokenGenerator(recordRoute(mux)),
+							),
+						),
 					),
 				),
 			),
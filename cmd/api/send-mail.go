@@ -1,60 +1,160 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/dunky-star/modern-webapp-golang/internal/config"
 	"github.com/dunky-star/modern-webapp-golang/internal/data"
+	"github.com/dunky-star/modern-webapp-golang/internal/metrics"
+	"github.com/dunky-star/modern-webapp-golang/internal/tracing"
 	mail "github.com/xhit/go-simple-mail/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func listenForMail() {
-	app.InfoLog.Println("Email listener started - ready to send emails")
+// mailHeartbeat is how often an idle listener reports that it's still running
+const mailHeartbeat = 15 * time.Second
+
+// mailStallTimeout is how long the listener can go without a heartbeat before it's reported dead.
+// It covers the heartbeat interval and a send hitting both its connect and send timeouts.
+const mailStallTimeout = 2 * time.Minute
+
+// mailer sends queued emails from the config's mail channel on a background goroutine.
+// The channel is never closed: handlers still running after a shutdown timeout may send on it.
+type mailer struct {
+	cfg      *config.AppConfig
+	metrics  *metrics.Metrics
+	tracing  *tracing.Provider
+	wg       sync.WaitGroup // Tracks the listener goroutine so shutdown can wait for it
+	stop     chan struct{}  // Closed by drain to stop the listener once the queue is empty
+	running  atomic.Bool    // Set while the listener goroutine runs
+	lastBeat atomic.Int64   // Unix nanoseconds the listener was last between messages
+}
+
+func newMailer(cfg *config.AppConfig, mx *metrics.Metrics, tp *tracing.Provider) *mailer {
+	return &mailer{cfg: cfg, metrics: mx, tracing: tp, stop: make(chan struct{})}
+}
+
+func (m *mailer) listen() {
+	m.cfg.InfoLog.Println("Email listener started - ready to send emails")
+	m.running.Store(true)
+	m.beat()
+	m.cfg.MailAlive = m.alive
+	m.wg.Add(1)
 	go func() {
+		defer m.wg.Done()
+		defer m.cfg.InfoLog.Println("Email listener stopped")
+		defer m.running.Store(false)
+
+		ticker := time.NewTicker(mailHeartbeat)
+		defer ticker.Stop()
+		// Runs until drain stops it, then sends what's already queued
 		for {
-			msg := <-app.MailChan
-			sendMail(msg)
-			app.InfoLog.Println("Mail sent to", msg.To)
+			select {
+			case msg := <-m.cfg.MailChan:
+				m.deliver(msg)
+				m.beat()
+			case <-ticker.C:
+				m.beat()
+			case <-m.stop:
+				for {
+					select {
+					case msg := <-m.cfg.MailChan:
+						m.deliver(msg)
+					default:
+						return
+					}
+				}
+			}
 		}
 	}()
 }
 
-func sendMail(m data.MailData) {
+// beat records that the listener is alive and waiting for mail
+func (m *mailer) beat() {
+	m.lastBeat.Store(time.Now().UnixNano())
+}
+
+// alive reports whether the listener is running and hasn't been stuck on one message for too long
+func (m *mailer) alive() bool {
+	return m.running.Load() && time.Since(time.Unix(0, m.lastBeat.Load())) < mailStallTimeout
+}
+
+// deliver sends one queued message, logging and counting the outcome
+func (m *mailer) deliver(msg data.MailData) {
+	if err := m.send(msg); err != nil {
+		m.metrics.MailFailed.Inc()
+		m.cfg.ErrorLog.Printf("Failed to send mail to %s: %v", msg.To, err)
+		return
+	}
+	m.metrics.MailSent.Inc()
+	m.cfg.InfoLog.Println("Mail sent to", msg.To)
+}
+
+// drain stops the listener once it has sent every queued message and waits for it. Mail queued
+// after that isn't sent. Returns ctx.Err() if the deadline passes first.
+func (m *mailer) drain(ctx context.Context) error {
+	close(m.stop)
+
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *mailer) send(msg data.MailData) (err error) {
+	// Mail is sent after the request finished, so link to its span rather than nest under it
+	_, span := m.tracing.Tracer().Start(context.Background(), "mail send",
+		trace.WithLinks(trace.Link{SpanContext: msg.SpanContext}),
+		trace.WithAttributes(
+			attribute.String("mail.subject", msg.Subject),
+			attribute.String("mail.template", msg.Template),
+			attribute.String("smtp.host", m.cfg.SMTPHost),
+		),
+	)
+	defer func() { tracing.End(span, err) }()
+
 	server := mail.NewSMTPClient()
-	server.Host = "localhost"
-	server.Port = 1025
+	server.Host = m.cfg.SMTPHost
+	server.Port = m.cfg.SMTPPort
 	server.KeepAlive = false
 	server.ConnectTimeout = 10 * time.Second
 	server.SendTimeout = 10 * time.Second
 
 	smtpClient, err := server.Connect()
 	if err != nil {
-		app.ErrorLog.Printf("Failed to connect to SMTP server: %v", err)
-		return
+		return fmt.Errorf("failed to connect to SMTP server: %w", err)
 	}
 	defer smtpClient.Close()
 
 	email := mail.NewMSG()
-	email.SetFrom(m.From).AddTo(m.To).SetSubject(m.Subject)
+	email.SetFrom(msg.From).AddTo(msg.To).SetSubject(msg.Subject)
 	// Convert template.HTML to string for email library (template.HTML is a type-safe alias for trusted HTML)
-	if m.Template == "" {
-		email.SetBody(mail.TextHTML, string(m.Content))
+	if msg.Template == "" {
+		email.SetBody(mail.TextHTML, string(msg.Content))
 	} else {
-		data, err := os.ReadFile(fmt.Sprintf("./web/email-templates/%s", m.Template))
+		data, err := os.ReadFile(fmt.Sprintf("./web/email-templates/%s", msg.Template))
 		if err != nil {
-			app.ErrorLog.Printf("Failed to read template file: %v", err)
-			return
+			return fmt.Errorf("failed to read template file: %w", err)
 		}
 		mailTemplate := string(data)
-		mailTemplate = strings.Replace(mailTemplate, "[%body%]", string(m.Content), 1)
+		mailTemplate = strings.Replace(mailTemplate, "[%body%]", string(msg.Content), 1)
 		email.SetBody(mail.TextHTML, mailTemplate)
 	}
 
-	err = email.Send(smtpClient)
-	if err != nil {
-		app.ErrorLog.Println(err)
-		return
-	}
+	return email.Send(smtpClient)
 }
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/dunky-star/modern-webapp-golang/pkg/certreload"
+)
+
+// newTLSConfig builds the TLS configuration for the main server.
+// The certificate is served through a reloader so renewed certificates are picked up without a restart.
+func (app *application) newTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	reloader, err := certreload.New(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	reloader.ErrorLog = app.cfg.ErrorLog
+
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}, nil
+}
+
+// newRedirectServer returns a plain HTTP server that permanently redirects every request to HTTPS
+func (app *application) newRedirectServer(port, tlsPort int) *http.Server {
+	return &http.Server{
+		Addr: fmt.Sprintf(":%d", port),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			host := r.Host
+			if h, _, err := net.SplitHostPort(r.Host); err == nil {
+				host = h
+			}
+			if tlsPort != 443 {
+				host = net.JoinHostPort(host, fmt.Sprint(tlsPort))
+			}
+			http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+		}),
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 5 * time.Second,
+		IdleTimeout:  time.Minute,
+		ErrorLog:     app.cfg.ErrorLog,
+	}
+}
+
+// serve starts the HTTP server (and the optional HTTP->HTTPS redirect server) and blocks
+// until one of them fails or a SIGINT/SIGTERM is received.
+// On a signal it shuts down gracefully: stop accepting requests and wait for in-flight ones,
+// drain the mail queue, flush the request logs, then close the database pool.
+func (app *application) serve(srv *http.Server, redirectSrv *http.Server) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	serverErr := make(chan error, 2)
+	go func() {
+		var err error
+		if srv.TLSConfig != nil {
+			// Certificates come from TLSConfig.GetCertificate
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			serverErr <- err
+		}
+	}()
+	if redirectSrv != nil {
+		go func() {
+			if err := redirectSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				serverErr <- fmt.Errorf("redirect server: %w", err)
+			}
+		}()
+	}
+
+	select {
+	case err := <-serverErr:
+		// A server failed to start (e.g. port in use) - stop the other one and release resources
+		if redirectSrv != nil {
+			redirectSrv.Close()
+		}
+		srv.Close()
+		app.shutdownResources(context.Background())
+		return err
+	case <-ctx.Done():
+	}
+
+	// Restore default signal behaviour so a second Ctrl+C kills the process immediately
+	stop()
+	app.cfg.InfoLog.Println("Shutdown signal received, shutting down gracefully")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), app.cfg.Settings.Server.ShutdownTimeout)
+	defer cancel()
+
+	var shutdownErr error
+	if redirectSrv != nil {
+		if err := redirectSrv.Shutdown(shutdownCtx); err != nil {
+			shutdownErr = fmt.Errorf("redirect server shutdown: %w", err)
+		}
+	}
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		shutdownErr = fmt.Errorf("http server shutdown: %w", err)
+	}
+
+	app.shutdownResources(shutdownCtx)
+
+	return shutdownErr
+}
+
+// shutdownResources releases everything the server depends on, in dependency order.
+// Handlers still running after a shutdown timeout can keep queueing mail, but it isn't sent.
+func (app *application) shutdownResources(ctx context.Context) {
+	// Drain the mail queue before closing anything the mail worker might log to
+	if err := app.mailer.drain(ctx); err != nil {
+		app.cfg.WarningLog.Printf("Mail queue not fully drained: %v", err)
+	}
+
+	// Flush buffered spans (includes the mail sends above)
+	if err := app.tracing.Shutdown(ctx); err != nil {
+		app.cfg.WarningLog.Printf("Failed to flush traces: %v", err)
+	}
+
+	// Flush and close the request log
+	app.closeRequestLogger()
+
+	// Stop the expired-session cleanup before its pool goes away
+	if app.sessionStore != nil {
+		app.sessionStore.StopCleanup()
+	}
+
+	// Close database connection pools last
+	app.db.Close()
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"strconv"
+
+	"github.com/dunky-star/modern-webapp-golang/internal/config"
+	"github.com/dunky-star/modern-webapp-golang/internal/driver"
+)
+
+// loadSettings layers the configuration: defaults, then the config file, then environment
+// variables, then flags. Only flags given explicitly on the command line override the other layers.
+// The second return value reports whether -print-config was given.
+func loadSettings(args []string) (config.Settings, bool, error) {
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "YAML config file (env CONFIG_FILE)")
+	printConfig := fs.Bool("print-config", false, "Print the effective configuration with secrets redacted and exit")
+	defaults := config.DefaultSettings()
+	bindFlags(fs, &defaults)
+	fs.Parse(args)
+
+	s := config.DefaultSettings()
+	if *configFile != "" {
+		if err := s.LoadFile(*configFile); err != nil {
+			return s, false, err
+		}
+	}
+	if err := s.LoadEnv(); err != nil {
+		return s, false, err
+	}
+
+	// Replay the flags that were set onto the layered settings so they take precedence
+	overrides := flag.NewFlagSet("overrides", flag.ContinueOnError)
+	bindFlags(overrides, &s)
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if err != nil || overrides.Lookup(f.Name) == nil {
+			return
+		}
+		err = overrides.Set(f.Name, f.Value.String())
+	})
+
+	return s, *printConfig, err
+}
+
+// bindFlags registers a command-line flag for each setting that can be overridden from the command line
+func bindFlags(fs *flag.FlagSet, s *config.Settings) {
+	fs.IntVar(&s.Server.Port, "port", s.Server.Port, "API server port (env PORT)")
+	fs.StringVar(&s.Server.Env, "env", s.Server.Env, "Environment (dev|stage|prod) (env APP_ENV)")
+	fs.DurationVar(&s.Server.ShutdownTimeout, "shutdown-timeout", s.Server.ShutdownTimeout, "Time in-flight requests and queued mail get to finish on shutdown")
+	fs.StringVar(&s.Server.TLSCertFile, "tls-cert", s.Server.TLSCertFile, "TLS certificate file (enables HTTPS together with -tls-key) (env TLS_CERT_FILE)")
+	fs.StringVar(&s.Server.TLSKeyFile, "tls-key", s.Server.TLSKeyFile, "TLS private key file (env TLS_KEY_FILE)")
+	fs.IntVar(&s.Server.RedirectPort, "redirect-port", s.Server.RedirectPort, "Plain HTTP port that redirects to HTTPS when TLS is enabled (0 disables)")
+	fs.StringVar(&s.Server.TrustedProxies, "trusted-proxies", s.Server.TrustedProxies, "Comma-separated CIDRs of reverse proxies whose X-Forwarded-For is believed (empty trusts none)")
+
+	fs.StringVar(&s.Database.DSN, "db-dsn", s.Database.DSN, "DB connection string (env DB_DSN)")
+	fs.StringVar(&s.Database.ReplicaDSN, "db-replica-dsn", s.Database.ReplicaDSN, "Read-replica connection string for read-only queries (optional) (env DB_REPLICA_DSN)")
+	fs.Var(int32Value{&s.Database.MaxConns}, "db-max-conns", "Maximum pool connections")
+	fs.Var(int32Value{&s.Database.MinConns}, "db-min-conns", "Minimum idle pool connections")
+	fs.DurationVar(&s.Database.MaxConnLifetime, "db-max-conn-lifetime", s.Database.MaxConnLifetime, "Maximum lifetime of a pooled connection")
+	fs.DurationVar(&s.Database.MaxConnIdleTime, "db-max-conn-idle", s.Database.MaxConnIdleTime, "Close pooled connections idle longer than this")
+	fs.DurationVar(&s.Database.HealthCheckPeriod, "db-health-check-period", s.Database.HealthCheckPeriod, "How often idle pooled connections are health checked")
+	fs.StringVar(&s.Database.ExecMode, "db-exec-mode", s.Database.ExecMode, "Statement cache mode (cache_statement|cache_describe|describe_exec|exec|simple_protocol)")
+	fs.IntVar(&s.Database.ConnectAttempts, "db-connect-attempts", s.Database.ConnectAttempts, "Database connection attempts at startup before giving up")
+	fs.DurationVar(&s.Database.ConnectBackoff, "db-connect-backoff", s.Database.ConnectBackoff, "Initial wait between database connection attempts (doubles each retry, with jitter)")
+	fs.DurationVar(&s.Database.ConnectMaxBackoff, "db-connect-max-backoff", s.Database.ConnectMaxBackoff, "Maximum wait between database connection attempts")
+
+	fs.DurationVar(&s.Session.Lifetime, "session-lifetime", s.Session.Lifetime, "How long a session lasts")
+	fs.StringVar(&s.Session.Store, "session-store", s.Session.Store, "Where sessions are kept (postgres|memory); memory loses sessions on restart")
+	fs.DurationVar(&s.CSRF.MaxAge, "csrf-max-age", s.CSRF.MaxAge, "How long a CSRF token cookie is valid")
+
+	fs.StringVar(&s.Mail.SMTPHost, "smtp-host", s.Mail.SMTPHost, "SMTP server host (env SMTP_HOST)")
+	fs.IntVar(&s.Mail.SMTPPort, "smtp-port", s.Mail.SMTPPort, "SMTP server port (env SMTP_PORT)")
+
+	fs.StringVar(&s.Logging.Dir, "log-dir", s.Logging.Dir, "Directory for the rotating access log (env LOG_DIR)")
+
+	fs.StringVar(&s.Metrics.Allow, "metrics-allow", s.Metrics.Allow, "Comma-separated CIDRs allowed to scrape /metrics (empty denies all)")
+	fs.StringVar(&s.Metrics.Token, "metrics-token", s.Metrics.Token, "Bearer token required to scrape /metrics (optional) (env METRICS_TOKEN)")
+
+	fs.StringVar(&s.Tracing.Exporter, "trace-exporter", s.Tracing.Exporter, "Trace exporter (none|stdout|file|otlp); otlp reads OTEL_EXPORTER_OTLP_ENDPOINT")
+	fs.StringVar(&s.Tracing.File, "trace-file", s.Tracing.File, "File that spans are appended to with -trace-exporter=file")
+}
+
+// poolConfig converts the database settings into driver pool settings
+func poolConfig(s config.DatabaseSettings) driver.PoolConfig {
+	return driver.PoolConfig{
+		MaxConns:          s.MaxConns,
+		MinConns:          s.MinConns,
+		MaxConnLifetime:   s.MaxConnLifetime,
+		MaxConnIdleTime:   s.MaxConnIdleTime,
+		HealthCheckPeriod: s.HealthCheckPeriod,
+		ExecMode:          s.ExecMode,
+	}
+}
+
+// retryConfig converts the database settings into driver retry settings
+func retryConfig(s config.DatabaseSettings) driver.RetryConfig {
+	return driver.RetryConfig{
+		MaxAttempts:    s.ConnectAttempts,
+		InitialBackoff: s.ConnectBackoff,
+		MaxBackoff:     s.ConnectMaxBackoff,
+		AttemptTimeout: s.ConnectTimeout,
+	}
+}
+
+// int32Value is a flag.Value for int32 settings (used for pool sizes)
+type int32Value struct {
+	p *int32
+}
+
+func (v int32Value) String() string {
+	if v.p == nil {
+		return "0"
+	}
+	return strconv.FormatInt(int64(*v.p), 10)
+}
+
+func (v int32Value) Set(s string) error {
+	n, err := strconv.ParseInt(s, 10, 32)
+	if err != nil {
+		return err
+	}
+	*v.p = int32(n)
+	return nil
+}
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_sessions_expiry;
+
+DROP TABLE IF EXISTS sessions;
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_login_attempts_ip_created_at;
+DROP INDEX IF EXISTS idx_login_attempts_email_created_at;
+
+DROP TABLE IF EXISTS login_attempts;
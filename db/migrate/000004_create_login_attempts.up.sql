@@ -0,0 +1,17 @@
+CREATE TABLE login_attempts (
+    id         BIGSERIAL PRIMARY KEY,
+    email      VARCHAR(255) NOT NULL,
+    ip_address VARCHAR(64) NOT NULL,
+    user_agent TEXT NOT NULL DEFAULT '',
+    user_id    BIGINT,
+    outcome    VARCHAR(20) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+
+    CONSTRAINT fk_login_attempts_user
+        FOREIGN KEY (user_id)
+        REFERENCES users(id)
+        ON DELETE SET NULL
+);
+
+CREATE INDEX idx_login_attempts_email_created_at ON login_attempts(email, created_at);
+CREATE INDEX idx_login_attempts_ip_created_at ON login_attempts(ip_address, created_at);
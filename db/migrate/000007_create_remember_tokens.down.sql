@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_remember_tokens_user_id;
+
+DROP TABLE IF EXISTS remember_tokens;
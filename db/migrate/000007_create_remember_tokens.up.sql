@@ -0,0 +1,18 @@
+CREATE TABLE remember_tokens (
+    id             BIGSERIAL PRIMARY KEY,
+    user_id        BIGINT NOT NULL,
+    selector       VARCHAR(64) NOT NULL UNIQUE,
+    validator_hash BYTEA NOT NULL,
+    previous_validator_hash BYTEA,
+    user_agent     TEXT NOT NULL DEFAULT '',
+    expires_at     TIMESTAMPTZ NOT NULL,
+    last_used_at   TIMESTAMPTZ,
+    created_at     TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+
+    CONSTRAINT fk_remember_tokens_user
+        FOREIGN KEY (user_id)
+        REFERENCES users(id)
+        ON DELETE CASCADE
+);
+
+CREATE INDEX idx_remember_tokens_user_id ON remember_tokens(user_id);
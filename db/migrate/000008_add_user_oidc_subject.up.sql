@@ -0,0 +1,2 @@
+-- Identity provider subject ("iss|sub") the user signs in with, once linked
+ALTER TABLE users ADD COLUMN oidc_subject VARCHAR(512) UNIQUE;
@@ -0,0 +1,2 @@
+-- Guests' bookings are matched by email whatever case it was typed in
+CREATE INDEX idx_reservations_email_lower ON reservations (LOWER(email));
@@ -0,0 +1,2 @@
+ALTER TABLE reservations DROP COLUMN IF EXISTS cancelled_at;
+ALTER TABLE reservations DROP COLUMN IF EXISTS confirmation_code;
@@ -0,0 +1,4 @@
+-- Guests look up and cancel their bookings with the confirmation code. Reservations made
+-- before this have no code.
+ALTER TABLE reservations ADD COLUMN confirmation_code VARCHAR(16) UNIQUE;
+ALTER TABLE reservations ADD COLUMN cancelled_at TIMESTAMPTZ;
@@ -0,0 +1,4 @@
+ALTER TABLE reservations DROP COLUMN IF EXISTS currency;
+ALTER TABLE reservations DROP COLUMN IF EXISTS total_price;
+DROP TABLE IF EXISTS room_rates;
+ALTER TABLE rooms DROP COLUMN IF EXISTS nightly_rate;
@@ -0,0 +1,29 @@
+-- Prices are in the currency's minor unit (e.g. cents)
+ALTER TABLE rooms ADD COLUMN nightly_rate BIGINT NOT NULL DEFAULT 0;
+
+-- Overrides of a room's nightly rate for the nights from start_date to end_date (inclusive;
+-- NULL leaves that end open), optionally only Friday and Saturday nights
+CREATE TABLE room_rates (
+    id BIGSERIAL PRIMARY KEY,
+    room_id BIGINT NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    start_date DATE,
+    end_date   DATE,
+    weekends_only BOOLEAN NOT NULL DEFAULT FALSE,
+    nightly_rate BIGINT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+
+    CONSTRAINT fk_room_rates_room
+        FOREIGN KEY (room_id)
+        REFERENCES rooms(id)
+        ON DELETE CASCADE,
+    CONSTRAINT chk_room_rates_dates CHECK (start_date IS NULL OR end_date IS NULL OR start_date <= end_date),
+    CONSTRAINT chk_room_rates_rate CHECK (nightly_rate >= 0)
+);
+
+CREATE INDEX idx_room_rates_room_id ON room_rates(room_id);
+
+-- The price the guest was quoted when they booked; NULL for older reservations
+ALTER TABLE reservations ADD COLUMN total_price BIGINT;
+ALTER TABLE reservations ADD COLUMN currency CHAR(3);
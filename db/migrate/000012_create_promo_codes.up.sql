@@ -0,0 +1,59 @@
+-- Discount codes guests can enter when booking. amount is a percentage for 'percent' codes and
+-- minor currency units (e.g. cents) for 'fixed' ones. The codes can be redeemed from valid_from
+-- to valid_until (inclusive; NULL leaves that end open), at most max_uses times (NULL for no limit).
+CREATE TABLE promo_codes (
+    id BIGSERIAL PRIMARY KEY,
+    code VARCHAR(32) NOT NULL UNIQUE,
+    description VARCHAR(255) NOT NULL DEFAULT '',
+    discount_type VARCHAR(10) NOT NULL,
+    amount BIGINT NOT NULL,
+    valid_from  DATE,
+    valid_until DATE,
+    max_uses INTEGER,
+    min_nights INTEGER NOT NULL DEFAULT 1,
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+
+    CONSTRAINT chk_promo_codes_type CHECK (discount_type IN ('percent', 'fixed')),
+    CONSTRAINT chk_promo_codes_amount CHECK (amount > 0 AND (discount_type <> 'percent' OR amount <= 100)),
+    CONSTRAINT chk_promo_codes_dates CHECK (valid_from IS NULL OR valid_until IS NULL OR valid_from <= valid_until),
+    CONSTRAINT chk_promo_codes_max_uses CHECK (max_uses IS NULL OR max_uses > 0),
+    CONSTRAINT chk_promo_codes_min_nights CHECK (min_nights > 0)
+);
+
+-- The rooms a code is limited to; a code without rows here is good for every room
+CREATE TABLE promo_code_rooms (
+    promo_code_id BIGINT NOT NULL,
+    room_id BIGINT NOT NULL,
+
+    PRIMARY KEY (promo_code_id, room_id),
+    CONSTRAINT fk_promo_code_rooms_promo_code
+        FOREIGN KEY (promo_code_id)
+        REFERENCES promo_codes(id)
+        ON DELETE CASCADE,
+    CONSTRAINT fk_promo_code_rooms_room
+        FOREIGN KEY (room_id)
+        REFERENCES rooms(id)
+        ON DELETE CASCADE
+);
+
+-- One row per reservation booked with a code, with the amount it took off the total
+CREATE TABLE promo_redemptions (
+    id BIGSERIAL PRIMARY KEY,
+    promo_code_id BIGINT NOT NULL,
+    reservation_id BIGINT NOT NULL UNIQUE,
+    discount BIGINT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+
+    CONSTRAINT fk_promo_redemptions_promo_code
+        FOREIGN KEY (promo_code_id)
+        REFERENCES promo_codes(id)
+        ON DELETE RESTRICT,
+    CONSTRAINT fk_promo_redemptions_reservation
+        FOREIGN KEY (reservation_id)
+        REFERENCES reservations(id)
+        ON DELETE CASCADE
+);
+
+CREATE INDEX idx_promo_redemptions_promo_code_id ON promo_redemptions(promo_code_id);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS payments;
+ALTER TABLE reservations DROP COLUMN IF EXISTS hold_until;
+ALTER TABLE reservations DROP COLUMN IF EXISTS confirmed_at;
@@ -0,0 +1,27 @@
+-- A reservation's room is only booked once it's paid for, which sets confirmed_at. Until then
+-- the guest has until hold_until to pay. Earlier reservations were booked straight away.
+ALTER TABLE reservations ADD COLUMN confirmed_at TIMESTAMPTZ;
+ALTER TABLE reservations ADD COLUMN hold_until TIMESTAMPTZ;
+UPDATE reservations SET confirmed_at = created_at;
+
+-- Payments taken through the payment provider. amount is in the currency's minor unit.
+CREATE TABLE payments (
+    id BIGSERIAL PRIMARY KEY,
+    reservation_id BIGINT NOT NULL,
+    provider VARCHAR(32) NOT NULL,
+    intent_id VARCHAR(255) NOT NULL,
+    amount BIGINT NOT NULL,
+    currency CHAR(3) NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+
+    CONSTRAINT fk_payments_reservation
+        FOREIGN KEY (reservation_id)
+        REFERENCES reservations(id)
+        ON DELETE CASCADE,
+    CONSTRAINT uq_payments_intent UNIQUE (provider, intent_id),
+    CONSTRAINT chk_payments_status CHECK (status IN ('pending', 'capturing', 'captured', 'failed', 'refunded'))
+);
+
+CREATE INDEX idx_payments_reservation_id ON payments(reservation_id);
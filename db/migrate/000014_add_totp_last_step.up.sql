@@ -0,0 +1,2 @@
+-- The TOTP time step (Unix time / 30s) of the last code accepted, so a code can't be used twice
+ALTER TABLE users ADD COLUMN totp_last_step BIGINT;
@@ -0,0 +1,3 @@
+-- Emails are compared case-insensitively, so two accounts can't differ only in case. Fails if
+-- existing rows already do; merge or rename them first.
+CREATE UNIQUE INDEX idx_users_email_lower ON users (LOWER(email));
@@ -0,0 +1,4 @@
+UPDATE payments SET status = 'capturing' WHERE status = 'captured_unconfirmed';
+ALTER TABLE payments DROP CONSTRAINT chk_payments_status;
+ALTER TABLE payments ADD CONSTRAINT chk_payments_status
+    CHECK (status IN ('pending', 'capturing', 'captured', 'failed', 'refunded'));
@@ -0,0 +1,4 @@
+-- A payment taken from the guest whose room couldn't be booked yet is retried rather than left capturing
+ALTER TABLE payments DROP CONSTRAINT chk_payments_status;
+ALTER TABLE payments ADD CONSTRAINT chk_payments_status
+    CHECK (status IN ('pending', 'capturing', 'captured_unconfirmed', 'captured', 'failed', 'refunded'));
@@ -0,0 +1,4 @@
+UPDATE payments SET status = 'captured_unconfirmed' WHERE status = 'refund_failed';
+ALTER TABLE payments DROP CONSTRAINT chk_payments_status;
+ALTER TABLE payments ADD CONSTRAINT chk_payments_status
+    CHECK (status IN ('pending', 'capturing', 'captured_unconfirmed', 'captured', 'failed', 'refunded'));
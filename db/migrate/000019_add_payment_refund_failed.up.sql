@@ -0,0 +1,4 @@
+-- A payment whose room was taken and whose refund failed is marked for a manual refund
+ALTER TABLE payments DROP CONSTRAINT chk_payments_status;
+ALTER TABLE payments ADD CONSTRAINT chk_payments_status
+    CHECK (status IN ('pending', 'capturing', 'captured_unconfirmed', 'captured', 'failed', 'refunded', 'refund_failed'));
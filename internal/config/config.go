@@ -1,10 +1,13 @@
 package config
 
 import (
+	"fmt"
 	"html/template"
 	"log"
 	"net/http"
+	"net/netip"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/alexedwards/scs/v2"
@@ -13,34 +16,104 @@ import (
 
 // AppConfig holds the application configuration
 type AppConfig struct {
-	Port          int
-	Env           string
-	DSN           string
-	InfoLog       *log.Logger
-	ErrorLog      *log.Logger
-	WarningLog    *log.Logger
-	Session       *scs.SessionManager
-	UseCache      bool
-	TemplateCache map[string]*template.Template
-	MailChan      chan data.MailData
+	Port           int
+	Env            string
+	DSN            string
+	TLSCertFile    string
+	TLSKeyFile     string
+	BaseURL        string // Public URL of the site, without a trailing slash
+	SMTPHost       string
+	SMTPPort       int
+	MetricsAllow   []netip.Prefix // Client networks allowed to scrape /metrics
+	MetricsToken   string         // Optional bearer token required to scrape /metrics
+	TrustedProxies []netip.Prefix // Reverse proxies whose X-Forwarded-For header gives the client address
+	Version        string
+	StartTime      time.Time
+	InfoLog        *log.Logger
+	ErrorLog       *log.Logger
+	WarningLog     *log.Logger
+	Session        *scs.SessionManager
+	UseCache       bool
+	TemplateCache  map[string]*template.Template
+	MailChan       chan data.MailData
+	MailAlive      func() bool // Reports whether the mail worker is running and responsive, nil until it starts
+	Settings       Settings    // Effective settings the config was built from
 }
 
-// New creates a new application configuration
-func New(port int, env string, dsn string) *AppConfig {
+// New creates a new application configuration from validated settings
+func New(s Settings) (*AppConfig, error) {
+	metricsAllow, err := ParseCIDRs(s.Metrics.Allow)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metrics allow list: %w", err)
+	}
+	trustedProxies, err := ParseCIDRs(s.Server.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted proxies: %w", err)
+	}
+
 	infoLog := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
 	errorLog := log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
 	warningLog := log.New(os.Stdout, "WARNING\t", log.Ldate|log.Ltime|log.Lshortfile)
-	session := newSessionManager(env)
+	session := newSessionManager(s.Server.Env, s.Session.Lifetime)
+
+	baseURL := strings.TrimRight(s.Server.BaseURL, "/")
+	if baseURL == "" {
+		scheme := "http"
+		if s.Server.TLSCertFile != "" {
+			scheme = "https"
+		}
+		baseURL = fmt.Sprintf("%s://localhost:%d", scheme, s.Server.Port)
+	}
 
 	return &AppConfig{
-		Port:       port,
-		Env:        env,
-		DSN:        dsn,
-		InfoLog:    infoLog,
-		ErrorLog:   errorLog,
-		WarningLog: warningLog,
-		Session:    session,
+		Port:           s.Server.Port,
+		Env:            s.Server.Env,
+		DSN:            s.Database.DSN,
+		TLSCertFile:    s.Server.TLSCertFile,
+		TLSKeyFile:     s.Server.TLSKeyFile,
+		BaseURL:        baseURL,
+		SMTPHost:       s.Mail.SMTPHost,
+		SMTPPort:       s.Mail.SMTPPort,
+		MetricsAllow:   metricsAllow,
+		MetricsToken:   s.Metrics.Token,
+		TrustedProxies: trustedProxies,
+		InfoLog:        infoLog,
+		ErrorLog:       errorLog,
+		WarningLog:     warningLog,
+		Session:        session,
+		StartTime:      time.Now(),
+		Settings:       s,
+	}, nil
+}
+
+// TLSEnabled returns true if the server terminates TLS itself
+func (a *AppConfig) TLSEnabled() bool {
+	return a.TLSCertFile != "" && a.TLSKeyFile != ""
+}
+
+// ParseCIDRs parses a comma-separated list of CIDRs or bare IP addresses
+func ParseCIDRs(list string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			addr, err := netip.ParseAddr(item)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %q: %w", item, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", item, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
 	}
+	return prefixes, nil
 }
 
 // IsSecureCookie returns true if cookies should use the Secure flag (HTTPS only)
@@ -49,9 +122,9 @@ func IsSecureCookie(env string) bool {
 }
 
 // newSessionManager creates and configures a new session manager
-func newSessionManager(env string) *scs.SessionManager {
+func newSessionManager(env string, lifetime time.Duration) *scs.SessionManager {
 	sessionManager := scs.New()
-	sessionManager.Lifetime = 24 * time.Hour
+	sessionManager.Lifetime = lifetime
 	sessionManager.Cookie.Secure = IsSecureCookie(env)
 	sessionManager.Cookie.HttpOnly = true
 	sessionManager.Cookie.SameSite = http.SameSiteStrictMode
@@ -0,0 +1,458 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/dunky-star/modern-webapp-golang/internal/data"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+// redacted replaces secret values when settings are printed
+const redacted = "[REDACTED]"
+
+// Settings is the typed application configuration. Values are layered, each overriding the last:
+// built-in defaults, then the YAML config file, then environment variables, then command-line flags.
+// Fields tagged secret are redacted by Redacted.
+type Settings struct {
+	Server   ServerSettings   `yaml:"server"`
+	Database DatabaseSettings `yaml:"database"`
+	Session  SessionSettings  `yaml:"session"`
+	Auth     AuthSettings     `yaml:"auth"`
+	CSRF     CSRFSettings     `yaml:"csrf"`
+	Mail     MailSettings     `yaml:"mail"`
+	Logging  LoggingSettings  `yaml:"logging"`
+	Metrics  MetricsSettings  `yaml:"metrics"`
+	Tracing  TracingSettings  `yaml:"tracing"`
+	OIDC     OIDCSettings     `yaml:"oidc"`
+
+	Reservations ReservationSettings `yaml:"reservations"`
+	Payments     PaymentSettings     `yaml:"payments"`
+}
+
+// ServerSettings configures the HTTP server
+type ServerSettings struct {
+	Port            int           `yaml:"port" env:"PORT"`
+	Env             string        `yaml:"env" env:"APP_ENV"`
+	ReadTimeout     time.Duration `yaml:"read_timeout" env:"SERVER_READ_TIMEOUT"`
+	WriteTimeout    time.Duration `yaml:"write_timeout" env:"SERVER_WRITE_TIMEOUT"`
+	IdleTimeout     time.Duration `yaml:"idle_timeout" env:"SERVER_IDLE_TIMEOUT"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" env:"SERVER_SHUTDOWN_TIMEOUT"`
+	TLSCertFile     string        `yaml:"tls_cert" env:"TLS_CERT_FILE"`
+	TLSKeyFile      string        `yaml:"tls_key" env:"TLS_KEY_FILE"`
+	RedirectPort    int           `yaml:"redirect_port" env:"REDIRECT_PORT"`
+	BaseURL         string        `yaml:"base_url" env:"BASE_URL"`               // Public URL used in emailed links; defaults to localhost on Port
+	TrustedProxies  string        `yaml:"trusted_proxies" env:"TRUSTED_PROXIES"` // Comma-separated CIDRs of reverse proxies whose X-Forwarded-For is believed
+}
+
+// DatabaseSettings configures the connection pools and startup retries
+type DatabaseSettings struct {
+	DSN               string        `yaml:"dsn" env:"DB_DSN" secret:"true"`
+	ReplicaDSN        string        `yaml:"replica_dsn" env:"DB_REPLICA_DSN" secret:"true"`
+	MaxConns          int32         `yaml:"max_conns" env:"DB_MAX_CONNS"`
+	MinConns          int32         `yaml:"min_conns" env:"DB_MIN_CONNS"`
+	MaxConnLifetime   time.Duration `yaml:"max_conn_lifetime" env:"DB_MAX_CONN_LIFETIME"`
+	MaxConnIdleTime   time.Duration `yaml:"max_conn_idle" env:"DB_MAX_CONN_IDLE"`
+	HealthCheckPeriod time.Duration `yaml:"health_check_period" env:"DB_HEALTH_CHECK_PERIOD"`
+	ExecMode          string        `yaml:"exec_mode" env:"DB_EXEC_MODE"`
+	ConnectAttempts   int           `yaml:"connect_attempts" env:"DB_CONNECT_ATTEMPTS"`
+	ConnectBackoff    time.Duration `yaml:"connect_backoff" env:"DB_CONNECT_BACKOFF"`
+	ConnectMaxBackoff time.Duration `yaml:"connect_max_backoff" env:"DB_CONNECT_MAX_BACKOFF"`
+	ConnectTimeout    time.Duration `yaml:"connect_timeout" env:"DB_CONNECT_TIMEOUT"`
+}
+
+// SessionSettings configures the session cookie and where sessions are stored
+type SessionSettings struct {
+	Lifetime        time.Duration `yaml:"lifetime" env:"SESSION_LIFETIME"`
+	Store           string        `yaml:"store" env:"SESSION_STORE"`                       // postgres or memory
+	CleanupInterval time.Duration `yaml:"cleanup_interval" env:"SESSION_CLEANUP_INTERVAL"` // How often expired sessions are deleted from postgres
+}
+
+// AuthSettings configures login and account recovery
+type AuthSettings struct {
+	PasswordResetTTL   time.Duration `yaml:"password_reset_ttl" env:"PASSWORD_RESET_TTL"`       // How long an emailed reset link stays valid
+	InviteTTL          time.Duration `yaml:"invite_ttl" env:"INVITE_TTL"`                       // How long an invited user's link to set their password stays valid
+	EmailChangeTTL     time.Duration `yaml:"email_change_ttl" env:"EMAIL_CHANGE_TTL"`           // How long the link confirming a new email address stays valid
+	RememberMeTTL      time.Duration `yaml:"remember_me_ttl" env:"REMEMBER_ME_TTL"`             // How long a "remember me" login lasts without being used
+	MaxLoginFailures   int           `yaml:"max_login_failures" env:"MAX_LOGIN_FAILURES"`       // Failed logins for one email before it is locked
+	MaxIPLoginFailures int           `yaml:"max_ip_login_failures" env:"MAX_IP_LOGIN_FAILURES"` // Failed logins from one address before it is blocked
+	LockoutWindow      time.Duration `yaml:"lockout_window" env:"LOCKOUT_WINDOW"`               // Failures older than this are forgotten
+	LockoutDuration    time.Duration `yaml:"lockout_duration" env:"LOCKOUT_DURATION"`           // How long a lock lasts after the last failure
+	LoginDelay         time.Duration `yaml:"login_delay" env:"LOGIN_DELAY"`                     // Delay after the first failure; doubles with each further failure
+	MaxLoginDelay      time.Duration `yaml:"max_login_delay" env:"MAX_LOGIN_DELAY"`             // Upper bound for the failure delay
+	TOTPIssuer         string        `yaml:"totp_issuer" env:"TOTP_ISSUER"`                     // Name shown in authenticator apps
+
+	PasswordMinLength        int  `yaml:"password_min_length" env:"PASSWORD_MIN_LENGTH"`
+	PasswordRequireMixedCase bool `yaml:"password_require_mixed_case" env:"PASSWORD_REQUIRE_MIXED_CASE"` // Both upper and lower case letters
+	PasswordRequireDigit     bool `yaml:"password_require_digit" env:"PASSWORD_REQUIRE_DIGIT"`
+	PasswordRequireSymbol    bool `yaml:"password_require_symbol" env:"PASSWORD_REQUIRE_SYMBOL"` // Anything other than a letter or digit
+	BcryptCost               int  `yaml:"bcrypt_cost" env:"BCRYPT_COST"`                         // Hashes with a lower cost are upgraded at the next login
+}
+
+// CSRFSettings configures CSRF token cookies
+type CSRFSettings struct {
+	MaxAge time.Duration `yaml:"max_age" env:"CSRF_MAX_AGE"`
+}
+
+// MailSettings configures outgoing mail
+type MailSettings struct {
+	SMTPHost  string `yaml:"smtp_host" env:"SMTP_HOST"`
+	SMTPPort  int    `yaml:"smtp_port" env:"SMTP_PORT"`
+	QueueSize int    `yaml:"queue_size" env:"MAIL_QUEUE_SIZE"`
+	From      string `yaml:"from" env:"MAIL_FROM"`
+}
+
+// LoggingSettings configures the rotating access log
+type LoggingSettings struct {
+	Dir     string        `yaml:"dir" env:"LOG_DIR"`
+	File    string        `yaml:"file" env:"LOG_FILE"`
+	MaxSize int64         `yaml:"max_size" env:"LOG_MAX_SIZE"`
+	MaxAge  time.Duration `yaml:"max_age" env:"LOG_MAX_AGE"`
+}
+
+// MetricsSettings restricts access to /metrics
+type MetricsSettings struct {
+	Allow string `yaml:"allow" env:"METRICS_ALLOW"`
+	Token string `yaml:"token" env:"METRICS_TOKEN" secret:"true"`
+}
+
+// TracingSettings selects the trace exporter
+type TracingSettings struct {
+	Exporter string `yaml:"exporter" env:"TRACE_EXPORTER"`
+	File     string `yaml:"file" env:"TRACE_FILE"`
+}
+
+// OIDCSettings configures single sign-on with an OpenID Connect provider. Empty Issuer disables it.
+type OIDCSettings struct {
+	Issuer           string `yaml:"issuer" env:"OIDC_ISSUER"`
+	ClientID         string `yaml:"client_id" env:"OIDC_CLIENT_ID"`
+	ClientSecret     string `yaml:"client_secret" env:"OIDC_CLIENT_SECRET" secret:"true"` // Empty for public clients, which rely on PKCE alone
+	RedirectURL      string `yaml:"redirect_url" env:"OIDC_REDIRECT_URL"`                 // Defaults to server.base_url + /user/oidc/callback
+	ProviderName     string `yaml:"provider_name" env:"OIDC_PROVIDER_NAME"`               // Shown on the login button
+	AutoProvision    bool   `yaml:"auto_provision" env:"OIDC_AUTO_PROVISION"`             // Create users on first login instead of refusing unknown emails
+	ProvisionDomains string `yaml:"provision_domains" env:"OIDC_PROVISION_DOMAINS"`       // Comma-separated email domains allowed to auto-provision (empty allows any)
+	DefaultRole      string `yaml:"default_role" env:"OIDC_DEFAULT_ROLE"`                 // Role given to auto-provisioned users
+}
+
+// Enabled reports whether single sign-on is configured
+func (o OIDCSettings) Enabled() bool {
+	return o.Issuer != ""
+}
+
+// ReservationSettings configures what guests can do with their bookings online
+type ReservationSettings struct {
+	CancellationWindow time.Duration `yaml:"cancellation_window" env:"CANCELLATION_WINDOW"` // Guests can cancel online until this long before arrival
+	NotifyEmail        string        `yaml:"notify_email" env:"RESERVATIONS_NOTIFY_EMAIL"`  // Where cancellations are reported; defaults to mail.from
+	Currency           string        `yaml:"currency" env:"CURRENCY"`                       // ISO 4217 code that room rates are in
+}
+
+// PaymentSettings selects how guests pay for their bookings
+type PaymentSettings struct {
+	Provider      string        `yaml:"provider" env:"PAYMENT_PROVIDER"`                           // none or fake
+	WebhookSecret string        `yaml:"webhook_secret" env:"PAYMENT_WEBHOOK_SECRET" secret:"true"` // Verifies the provider's webhooks
+	HoldTimeout   time.Duration `yaml:"hold_timeout" env:"PAYMENT_HOLD_TIMEOUT"`                   // How long a guest has to pay before the booking is dropped
+}
+
+// Enabled reports whether guests pay when they book
+func (p PaymentSettings) Enabled() bool {
+	return p.Provider != "none"
+}
+
+// DefaultSettings returns the settings used when nothing is configured
+func DefaultSettings() Settings {
+	return Settings{
+		Server: ServerSettings{
+			Port:            3000,
+			Env:             "dev",
+			ReadTimeout:     10 * time.Second,
+			WriteTimeout:    30 * time.Second,
+			IdleTimeout:     time.Minute,
+			ShutdownTimeout: 30 * time.Second,
+		},
+		Database: DatabaseSettings{
+			MaxConns:          25,
+			MinConns:          2,
+			MaxConnLifetime:   time.Hour,
+			MaxConnIdleTime:   30 * time.Minute,
+			HealthCheckPeriod: 30 * time.Second,
+			ExecMode:          "cache_statement",
+			ConnectAttempts:   10,
+			ConnectBackoff:    500 * time.Millisecond,
+			ConnectMaxBackoff: 30 * time.Second,
+			ConnectTimeout:    5 * time.Second,
+		},
+		Session: SessionSettings{
+			Lifetime:        24 * time.Hour,
+			Store:           "postgres",
+			CleanupInterval: 5 * time.Minute,
+		},
+		Auth: AuthSettings{
+			PasswordResetTTL:   time.Hour,
+			InviteTTL:          72 * time.Hour,
+			EmailChangeTTL:     24 * time.Hour,
+			RememberMeTTL:      30 * 24 * time.Hour,
+			MaxLoginFailures:   5,
+			MaxIPLoginFailures: 20,
+			LockoutWindow:      15 * time.Minute,
+			LockoutDuration:    15 * time.Minute,
+			LoginDelay:         250 * time.Millisecond,
+			MaxLoginDelay:      5 * time.Second,
+			TOTPIssuer:         "Bookings",
+			PasswordMinLength:  8,
+			BcryptCost:         bcrypt.DefaultCost,
+		},
+		CSRF: CSRFSettings{
+			MaxAge: 12 * time.Hour,
+		},
+		Mail: MailSettings{
+			SMTPHost:  "localhost",
+			SMTPPort:  1025,
+			QueueSize: 100,
+			From:      "me@here.com",
+		},
+		Logging: LoggingSettings{
+			Dir:     "output/logs",
+			File:    "access.log",
+			MaxSize: 5 * 1024 * 1024,
+			MaxAge:  14 * 24 * time.Hour,
+		},
+		Metrics: MetricsSettings{
+			Allow: "127.0.0.1,::1",
+		},
+		Tracing: TracingSettings{
+			Exporter: "none",
+			File:     "output/traces/traces.json",
+		},
+		OIDC: OIDCSettings{
+			ProviderName: "Company SSO",
+			DefaultRole:  "guest",
+		},
+		Reservations: ReservationSettings{
+			CancellationWindow: 48 * time.Hour,
+			Currency:           "USD",
+		},
+		Payments: PaymentSettings{
+			Provider:    "none",
+			HoldTimeout: 30 * time.Minute,
+		},
+	}
+}
+
+// LoadFile overlays settings from a YAML file. Keys missing from the file keep their current values;
+// unknown keys are an error so typos don't go unnoticed.
+func (s *Settings) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("cannot open config file: %w", err)
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(s); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// LoadEnv overlays settings from the environment variables named in the env struct tags.
+// Unset variables are ignored.
+func (s *Settings) LoadEnv() error {
+	var errs []error
+	walkFields(reflect.ValueOf(s).Elem(), func(field reflect.StructField, v reflect.Value) {
+		name := field.Tag.Get("env")
+		if name == "" {
+			return
+		}
+		raw, ok := os.LookupEnv(name)
+		if !ok {
+			return
+		}
+		if err := setValue(v, raw); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// Validate checks the settings and reports every problem found, not just the first
+func (s *Settings) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(s.Server.Port > 0 && s.Server.Port <= 65535, "server.port must be between 1 and 65535, got %d", s.Server.Port)
+	check(s.Server.Env == "dev" || s.Server.Env == "stage" || s.Server.Env == "prod", "server.env must be dev, stage or prod, got %q", s.Server.Env)
+	check(s.Server.ReadTimeout > 0, "server.read_timeout must be positive")
+	check(s.Server.WriteTimeout > 0, "server.write_timeout must be positive")
+	check(s.Server.IdleTimeout > 0, "server.idle_timeout must be positive")
+	check(s.Server.ShutdownTimeout > 0, "server.shutdown_timeout must be positive")
+	check((s.Server.TLSCertFile == "") == (s.Server.TLSKeyFile == ""), "server.tls_cert and server.tls_key must be set together")
+	check(s.Server.RedirectPort >= 0 && s.Server.RedirectPort <= 65535, "server.redirect_port must be between 0 and 65535, got %d", s.Server.RedirectPort)
+	check(s.Server.RedirectPort == 0 || s.Server.RedirectPort != s.Server.Port, "server.redirect_port must differ from server.port")
+	if s.Server.BaseURL != "" {
+		u, err := url.Parse(s.Server.BaseURL)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "server.base_url must be an absolute http(s) URL, got %q", s.Server.BaseURL)
+	}
+
+	check(s.Database.DSN != "", "database.dsn must be set (db-dsn flag or DB_DSN environment variable)")
+	check(s.Database.MaxConns >= 1, "database.max_conns must be at least 1, got %d", s.Database.MaxConns)
+	check(s.Database.MinConns >= 0 && s.Database.MinConns <= s.Database.MaxConns, "database.min_conns must be between 0 and database.max_conns (%d), got %d", s.Database.MaxConns, s.Database.MinConns)
+	switch s.Database.ExecMode {
+	case "cache_statement", "cache_describe", "describe_exec", "exec", "simple_protocol":
+	default:
+		errs = append(errs, fmt.Errorf("database.exec_mode must be cache_statement, cache_describe, describe_exec, exec or simple_protocol, got %q", s.Database.ExecMode))
+	}
+	check(s.Database.ConnectAttempts >= 1, "database.connect_attempts must be at least 1, got %d", s.Database.ConnectAttempts)
+	check(s.Database.ConnectBackoff >= 0, "database.connect_backoff must not be negative")
+	check(s.Database.ConnectMaxBackoff >= s.Database.ConnectBackoff, "database.connect_max_backoff must be at least database.connect_backoff")
+	check(s.Database.ConnectTimeout >= 0, "database.connect_timeout must not be negative")
+
+	check(s.Session.Lifetime > 0, "session.lifetime must be positive")
+	check(s.Session.Store == "postgres" || s.Session.Store == "memory", "session.store must be postgres or memory, got %q", s.Session.Store)
+	check(s.Session.CleanupInterval > 0, "session.cleanup_interval must be positive")
+	check(s.Auth.PasswordResetTTL > 0, "auth.password_reset_ttl must be positive")
+	check(s.Auth.InviteTTL > 0, "auth.invite_ttl must be positive")
+	check(s.Auth.EmailChangeTTL > 0, "auth.email_change_ttl must be positive")
+	check(s.Auth.RememberMeTTL > 0, "auth.remember_me_ttl must be positive")
+	check(s.Auth.MaxLoginFailures >= 1, "auth.max_login_failures must be at least 1, got %d", s.Auth.MaxLoginFailures)
+	check(s.Auth.MaxIPLoginFailures >= s.Auth.MaxLoginFailures, "auth.max_ip_login_failures must be at least auth.max_login_failures")
+	check(s.Auth.LockoutWindow > 0, "auth.lockout_window must be positive")
+	check(s.Auth.LockoutDuration > 0, "auth.lockout_duration must be positive")
+	check(s.Auth.LoginDelay >= 0 && s.Auth.MaxLoginDelay >= s.Auth.LoginDelay, "auth.max_login_delay must be at least auth.login_delay")
+	check(s.Auth.TOTPIssuer != "", "auth.totp_issuer must not be empty")
+	check(s.Auth.PasswordMinLength >= 1, "auth.password_min_length must be at least 1, got %d", s.Auth.PasswordMinLength)
+	check(s.Auth.BcryptCost >= bcrypt.MinCost && s.Auth.BcryptCost <= bcrypt.MaxCost,
+		"auth.bcrypt_cost must be between %d and %d, got %d", bcrypt.MinCost, bcrypt.MaxCost, s.Auth.BcryptCost)
+	check(s.CSRF.MaxAge > 0, "csrf.max_age must be positive")
+
+	check(s.Mail.SMTPHost != "", "mail.smtp_host must be set")
+	check(s.Mail.SMTPPort > 0 && s.Mail.SMTPPort <= 65535, "mail.smtp_port must be between 1 and 65535, got %d", s.Mail.SMTPPort)
+	check(s.Mail.QueueSize >= 1, "mail.queue_size must be at least 1, got %d", s.Mail.QueueSize)
+	check(s.Mail.From != "", "mail.from must be set")
+	check(s.Reservations.CancellationWindow >= 0, "reservations.cancellation_window must not be negative")
+	check(regexp.MustCompile(`^[A-Z]{3}$`).MatchString(s.Reservations.Currency), "reservations.currency must be a 3 letter upper case ISO 4217 code, got %q", s.Reservations.Currency)
+	check(s.Payments.Provider == "none" || s.Payments.Provider == "fake", "payments.provider must be none or fake, got %q", s.Payments.Provider)
+	check(s.Payments.Provider != "fake" || s.Server.Env != "prod", "payments.provider fake takes no real payments and can't be used in prod")
+	check(s.Payments.HoldTimeout > 0, "payments.hold_timeout must be positive")
+
+	check(s.Logging.Dir != "", "logging.dir must be set")
+	check(s.Logging.File != "", "logging.file must be set")
+	check(s.Logging.MaxSize > 0, "logging.max_size must be positive")
+	check(s.Logging.MaxAge > 0, "logging.max_age must be positive")
+
+	if _, err := ParseCIDRs(s.Metrics.Allow); err != nil {
+		errs = append(errs, fmt.Errorf("metrics.allow: %w", err))
+	}
+	if _, err := ParseCIDRs(s.Server.TrustedProxies); err != nil {
+		errs = append(errs, fmt.Errorf("server.trusted_proxies: %w", err))
+	}
+
+	switch s.Tracing.Exporter {
+	case "none", "stdout", "file", "otlp":
+	default:
+		errs = append(errs, fmt.Errorf("tracing.exporter must be none, stdout, file or otlp, got %q", s.Tracing.Exporter))
+	}
+
+	if s.OIDC.Enabled() {
+		check(s.OIDC.ClientID != "", "oidc.client_id must be set when oidc.issuer is")
+		if u, err := url.Parse(s.OIDC.Issuer); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("oidc.issuer must be an http(s) URL, got %q", s.OIDC.Issuer))
+		}
+		if _, err := data.ParseRole(s.OIDC.DefaultRole); err != nil {
+			errs = append(errs, fmt.Errorf("oidc.default_role: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Redacted returns a copy of the settings with secrets hidden, safe to print or log.
+// Passwords in URL-style DSNs are masked so the host and database stay visible.
+func (s Settings) Redacted() Settings {
+	walkFields(reflect.ValueOf(&s).Elem(), func(field reflect.StructField, v reflect.Value) {
+		if field.Tag.Get("secret") != "true" || v.Kind() != reflect.String || v.String() == "" {
+			return
+		}
+		v.SetString(redactSecret(v.String()))
+	})
+	return s
+}
+
+// Print writes the settings as YAML with secrets redacted. The output can be used as a config file.
+func (s Settings) Print(w io.Writer) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(s.Redacted()); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// redactSecret masks the password of a URL, or the whole value if it isn't a URL with credentials
+func redactSecret(secret string) string {
+	u, err := url.Parse(secret)
+	if err != nil || u.User == nil || u.Host == "" {
+		return redacted
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	}
+	return u.String()
+}
+
+// walkFields calls fn for every leaf field of a (nested) settings struct
+func walkFields(v reflect.Value, fn func(reflect.StructField, reflect.Value)) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field, fv := t.Field(i), v.Field(i)
+		if fv.Kind() == reflect.Struct {
+			walkFields(fv, fn)
+			continue
+		}
+		fn(field, fv)
+	}
+}
+
+// setValue parses raw into a settings field
+func setValue(v reflect.Value, raw string) error {
+	if v.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported setting type %s", v.Type())
+	}
+	return nil
+}
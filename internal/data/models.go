@@ -4,6 +4,8 @@ import (
 	"encoding/gob"
 	"html/template"
 	"time"
+
+	"go.opentelemetry.io/otel/trace"
 )
 
 type User struct {
@@ -13,15 +15,19 @@ type User struct {
 	Email       string    `json:"email"`
 	Password    string    `json:"password"`
 	AccessLevel int       `json:"access_level"`
+	TOTPEnabled bool      `json:"totp_enabled"`
+	TOTPSecret  string    `json:"-"`      // Base32 TOTP secret, set once two-factor authentication is enabled
+	Active      bool      `json:"active"` // Deactivated users can't log in
 	CreatedAt   time.Time `json:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at"`
 }
 
 type Room struct {
-	Id        int       `json:"id"`
-	RoomName  string    `json:"room_name"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	Id          int       `json:"id"`
+	RoomName    string    `json:"room_name"`
+	NightlyRate int64     `json:"nightly_rate"` // Base price per night in the currency's minor unit
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
 }
 
 type Restriction struct {
@@ -43,6 +49,54 @@ type Reservation struct {
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 	Room      Room      `json:"room"`
+
+	ConfirmationCode string     `json:"confirmation_code"` // Empty for reservations made before codes were issued
+	CancelledAt      *time.Time `json:"cancelled_at"`
+	TotalPrice       int64      `json:"total_price"`   // In the currency's minor unit
+	Currency         string     `json:"currency"`      // Empty for reservations made before prices were stored
+	PromoCodeId      int        `json:"promo_code_id"` // 0 when booked without a promo code
+	PromoCode        string     `json:"promo_code"`
+	Discount         int64      `json:"discount"`     // Already taken off TotalPrice
+	ConfirmedAt      *time.Time `json:"confirmed_at"` // When the room was booked; nil while waiting for payment
+	HoldUntil        *time.Time `json:"hold_until"`   // When an unpaid reservation is dropped
+}
+
+// Price is the reservation's total price for display, or "" if it has none
+func (r Reservation) Price() string {
+	if r.Currency == "" {
+		return ""
+	}
+	return FormatMoney(r.TotalPrice, r.Currency)
+}
+
+// Format formats an amount in the reservation's currency, for templates
+func (r Reservation) Format(amount int64) string {
+	return FormatMoney(amount, r.Currency)
+}
+
+// Payment statuses
+const (
+	PaymentPending     = "pending"              // Waiting for the guest to pay
+	PaymentCapturing   = "capturing"            // Being captured and the room booked
+	PaymentUnconfirmed = "captured_unconfirmed" // Taken from the guest, but booking the room failed; tried again on the next claim
+	PaymentCaptured    = "captured"
+	PaymentFailed      = "failed" // Declined, or too late to book the room
+	PaymentRefunded    = "refunded"
+	// Taken from the guest, but the room was booked meanwhile and the refund failed; refund it manually
+	PaymentRefundFailed = "refund_failed"
+)
+
+// Payment is a payment for a reservation taken through the payment provider
+type Payment struct {
+	Id            int       `json:"id"`
+	ReservationId int       `json:"reservation_id"`
+	Provider      string    `json:"provider"`
+	IntentId      string    `json:"intent_id"` // The provider's id for the payment
+	Amount        int64     `json:"amount"`
+	Currency      string    `json:"currency"`
+	Status        string    `json:"status"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
 }
 
 type RoomRestriction struct {
@@ -59,6 +113,60 @@ type RoomRestriction struct {
 	Restriction   Restriction `json:"restriction"`
 }
 
+// Login attempt outcomes recorded in the audit log
+const (
+	LoginSucceeded  = "success"
+	LoginFailed     = "failure"
+	LoginLocked     = "locked"     // Rejected without checking the password because the account is locked
+	LoginIPBlocked  = "ip_blocked" // Rejected because of too many failures from the client's address
+	LoginBusy       = "busy"       // Rejected because another attempt for the email was still being checked
+	LoginInactive   = "inactive"   // Correct password for a deactivated account
+	LoginRemembered = "remembered" // Logged in from a "remember me" cookie
+
+	LoginTwoFactorRequired = "2fa_required" // Password accepted, waiting for the second factor
+	LoginTwoFactorFailed   = "2fa_failure"  // Wrong TOTP or recovery code
+
+	LoginSSO       = "sso"        // Logged in through the single sign-on provider
+	LoginSSODenied = "sso_denied" // Signed in at the provider but not allowed in here
+)
+
+// LoginAttempt is one entry in the login audit log
+type LoginAttempt struct {
+	Id        int       `json:"id"`
+	Email     string    `json:"email"`
+	IPAddress string    `json:"ip_address"`
+	UserAgent string    `json:"user_agent"`
+	UserId    int       `json:"user_id"` // Zero if the credentials didn't match a user
+	Outcome   string    `json:"outcome"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// RememberToken is a long-lived "remember me" login for one device.
+// The cookie holds the selector and a validator; only the validator's hash is stored.
+type RememberToken struct {
+	Id            int        `json:"id"`
+	UserId        int        `json:"user_id"`
+	Selector      string     `json:"-"`
+	ValidatorHash []byte     `json:"-"`
+	PreviousHash  []byte     `json:"-"` // Validator hash before the last rotation, accepted briefly for concurrent requests
+	UserAgent     string     `json:"user_agent"`
+	ExpiresAt     time.Time  `json:"expires_at"`
+	LastUsedAt    *time.Time `json:"last_used_at"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+// SessionInfo describes one logged-in session, for listing and revoking sessions
+type SessionInfo struct {
+	ID        string // Derived from the session token, which is never shown
+	UserAgent string
+	IPAddress string
+	LoginAt   time.Time
+	LastSeen  time.Time
+	Current   bool // The session making the request
+
+	RememberSelector string // Selector of the "remember me" token the session came from, if any
+}
+
 // MailData holds an email message
 type MailData struct {
 	To       string
@@ -66,6 +174,8 @@ type MailData struct {
 	Subject  string
 	Content  template.HTML
 	Template string
+	// SpanContext links the asynchronous send back to the request that queued it (optional)
+	SpanContext trace.SpanContext
 }
 
 // init registers custom types with gob for session serialization
@@ -0,0 +1,152 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RateOverride replaces a room's nightly rate for a season, weekends, or weekends in a season
+type RateOverride struct {
+	Id           int        `json:"id"`
+	RoomId       int        `json:"room_id"`
+	Name         string     `json:"name"`
+	StartDate    *time.Time `json:"start_date"` // First night it applies to; nil for no start
+	EndDate      *time.Time `json:"end_date"`   // Last night it applies to; nil for no end
+	WeekendsOnly bool       `json:"weekends_only"`
+	NightlyRate  int64      `json:"nightly_rate"`
+}
+
+// NightPrice is the price of one night of a stay
+type NightPrice struct {
+	Date     time.Time `json:"date"`
+	RateName string    `json:"rate_name"` // Name of the override used, or "Standard rate"
+	Rate     int64     `json:"rate"`
+}
+
+// Quote is the price of a stay, night by night
+type Quote struct {
+	Nights    []NightPrice `json:"nights"`
+	Total     int64        `json:"total"` // Before any discount
+	Currency  string       `json:"currency"`
+	PromoCode string       `json:"promo_code,omitempty"`
+	Discount  int64        `json:"discount"`
+}
+
+// Due is what the guest pays: the total less any discount
+func (q Quote) Due() int64 {
+	return q.Total - q.Discount
+}
+
+// Format formats an amount in the quote's currency, for templates
+func (q Quote) Format(amount int64) string {
+	return FormatMoney(amount, q.Currency)
+}
+
+// Discount types of promo codes
+const (
+	DiscountPercent = "percent"
+	DiscountFixed   = "fixed"
+)
+
+// PromoCode is a discount code guests can enter when booking
+type PromoCode struct {
+	Id           int        `json:"id"`
+	Code         string     `json:"code"` // Upper case
+	Description  string     `json:"description"`
+	DiscountType string     `json:"discount_type"` // DiscountPercent or DiscountFixed
+	Amount       int64      `json:"amount"`        // A percentage, or minor currency units for fixed discounts
+	ValidFrom    *time.Time `json:"valid_from"`    // First day it can be redeemed; nil for no start
+	ValidUntil   *time.Time `json:"valid_until"`   // Last day it can be redeemed; nil for no end
+	MaxUses      int        `json:"max_uses"`      // 0 for no limit
+	MinNights    int        `json:"min_nights"`
+	Active       bool       `json:"active"`
+	RoomIds      []int      `json:"room_ids"` // Rooms it's limited to; empty for every room
+	Uses         int        `json:"uses"`     // Redemptions by reservations that aren't cancelled
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+}
+
+// Discount is the amount the code takes off a total, which is never more than the total
+func (p PromoCode) Discount(total int64) int64 {
+	if p.DiscountType == DiscountPercent {
+		// Round half a cent up
+		return (total*p.Amount + 50) / 100
+	}
+	return min(p.Amount, total)
+}
+
+// HasRoom reports whether the code is limited to rooms including id
+func (p PromoCode) HasRoom(id int) bool {
+	for _, roomID := range p.RoomIds {
+		if roomID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// AppliesToRoom reports whether the code can be used to book the room
+func (p PromoCode) AppliesToRoom(id int) bool {
+	return len(p.RoomIds) == 0 || p.HasRoom(id)
+}
+
+// Describe describes the discount, e.g. "15% off" or "$20.00 off"
+func (p PromoCode) Describe(currency string) string {
+	if p.DiscountType == DiscountPercent {
+		return fmt.Sprintf("%d%% off", p.Amount)
+	}
+	return FormatMoney(p.Amount, currency) + " off"
+}
+
+// AmountInput is the amount as it's entered in the admin form, e.g. "15" or "20.00"
+func (p PromoCode) AmountInput() string {
+	if p.Amount == 0 {
+		return ""
+	}
+	if p.DiscountType == DiscountPercent {
+		return strconv.FormatInt(p.Amount, 10)
+	}
+	return fmt.Sprintf("%d.%02d", p.Amount/100, p.Amount%100)
+}
+
+// currencySymbols are shown in place of the code for common currencies
+var currencySymbols = map[string]string{
+	"USD": "$",
+	"EUR": "€",
+	"GBP": "£",
+}
+
+// FormatMoney formats an amount in minor units, e.g. FormatMoney(12050, "USD") is "$120.50"
+func FormatMoney(amount int64, currency string) string {
+	sign := ""
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+	if symbol, ok := currencySymbols[currency]; ok {
+		return fmt.Sprintf("%s%s%d.%02d", sign, symbol, amount/100, amount%100)
+	}
+	return fmt.Sprintf("%s%d.%02d %s", sign, amount/100, amount%100, currency)
+}
+
+// ParseMoney parses an amount such as "120", "120.5" or "120.50" into minor units
+func ParseMoney(s string) (int64, error) {
+	whole, frac, _ := strings.Cut(strings.TrimSpace(s), ".")
+	if len(frac) > 2 {
+		return 0, errors.New("too many decimal places")
+	}
+	if whole == "" {
+		whole = "0"
+	}
+	units, err := strconv.ParseUint(whole, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	cents, err := strconv.ParseUint(frac+strings.Repeat("0", 2-len(frac)), 10, 8)
+	if err != nil {
+		return 0, err
+	}
+	return int64(units*100 + cents), nil
+}
@@ -0,0 +1,76 @@
+package data
+
+import "testing"
+
+func TestFormatMoney(t *testing.T) {
+	tests := []struct {
+		amount   int64
+		currency string
+		want     string
+	}{
+		{12050, "USD", "$120.50"},
+		{0, "USD", "$0.00"},
+		{5, "EUR", "€0.05"},
+		{-1999, "GBP", "-£19.99"},
+		{100000, "CHF", "1000.00 CHF"},
+	}
+
+	for _, tt := range tests {
+		if got := FormatMoney(tt.amount, tt.currency); got != tt.want {
+			t.Errorf("FormatMoney(%d, %q) = %q, want %q", tt.amount, tt.currency, got, tt.want)
+		}
+	}
+}
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{"120", 12000, false},
+		{"120.5", 12050, false},
+		{"120.50", 12050, false},
+		{" 7.05 ", 705, false},
+		{".99", 99, false},
+		{"1.", 100, false},
+		{"1.234", 0, true},
+		{"-5", 0, true},
+		{"1,50", 0, true},
+		{"1.x", 0, true},
+		{"abc", 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseMoney(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseMoney(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseMoney(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestPromoCodeDiscount(t *testing.T) {
+	tests := []struct {
+		name  string
+		code  PromoCode
+		total int64
+		want  int64
+	}{
+		{"percent", PromoCode{DiscountType: DiscountPercent, Amount: 15}, 10000, 1500},
+		{"percent rounds half a cent up", PromoCode{DiscountType: DiscountPercent, Amount: 10}, 5, 1},
+		{"percent rounds down below half a cent", PromoCode{DiscountType: DiscountPercent, Amount: 15}, 333, 50},
+		{"whole total", PromoCode{DiscountType: DiscountPercent, Amount: 100}, 12345, 12345},
+		{"fixed", PromoCode{DiscountType: DiscountFixed, Amount: 2000}, 10000, 2000},
+		{"fixed is capped at the total", PromoCode{DiscountType: DiscountFixed, Amount: 2000}, 1500, 1500},
+	}
+
+	for _, tt := range tests {
+		if got := tt.code.Discount(tt.total); got != tt.want {
+			t.Errorf("%s: Discount(%d) = %d, want %d", tt.name, tt.total, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package data
+
+import "fmt"
+
+// Role is a user's authorization level, stored in users.access_level.
+// Roles are ordered: each role can do everything the roles below it can.
+type Role int
+
+const (
+	RoleGuest   Role = iota + 1 // Default for new users; no access to admin pages
+	RoleStaff                   // Can view and process reservations
+	RoleManager                 // Can also manage rooms and staff accounts
+	RoleOwner                   // Full access, including managing managers and owners
+)
+
+var roleNames = map[Role]string{
+	RoleGuest:   "guest",
+	RoleStaff:   "staff",
+	RoleManager: "manager",
+	RoleOwner:   "owner",
+}
+
+// Roles returns all roles from least to most privileged
+func Roles() []Role {
+	return []Role{RoleGuest, RoleStaff, RoleManager, RoleOwner}
+}
+
+// RoleFromAccessLevel maps an access_level value to a role. Unknown levels get the least privilege.
+func RoleFromAccessLevel(level int) Role {
+	r := Role(level)
+	if _, ok := roleNames[r]; !ok {
+		return RoleGuest
+	}
+	return r
+}
+
+// ParseRole returns the role with the given name
+func ParseRole(name string) (Role, error) {
+	for r, n := range roleNames {
+		if n == name {
+			return r, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown role %q", name)
+}
+
+// String returns the role's name
+func (r Role) String() string {
+	if n, ok := roleNames[r]; ok {
+		return n
+	}
+	return fmt.Sprintf("Role(%d)", int(r))
+}
+
+// AtLeast reports whether the role grants at least the privileges of min
+func (r Role) AtLeast(min Role) bool {
+	return r >= min
+}
+
+// Role returns the user's role based on their access level
+func (u User) Role() Role {
+	return RoleFromAccessLevel(u.AccessLevel)
+}
@@ -14,9 +14,20 @@ type TemplateData struct {
 	Error           string
 	Form            *forms.Form
 	IsAuthenticated bool
+	Role            Role // Role of the logged-in user (zero when not logged in)
 }
 
 // SetCSRFToken sets the CSRF token (used by render package to auto-inject from context)
 func (td *TemplateData) SetCSRFToken(token string) {
 	td.CSRFToken = token
 }
+
+// Can reports whether the current user has at least the named role, e.g. {{if .Can "manager"}}.
+// Templates use it to hide actions the user isn't allowed to perform.
+func (td *TemplateData) Can(role string) bool {
+	min, err := ParseRole(role)
+	if err != nil {
+		return false
+	}
+	return td.IsAuthenticated && td.Role.AtLeast(min)
+}
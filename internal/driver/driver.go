@@ -3,70 +3,223 @@ package driver
 import (
 	"context"
 	"fmt"
-	"sync"
+	"log"
+	"math/rand/v2"
 	"time"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"go.opentelemetry.io/otel/trace"
 )
 
-var (
-	pool    *pgxpool.Pool
-	once    sync.Once
-	initErr error
-)
+// PoolConfig holds the tunable connection pool settings
+type PoolConfig struct {
+	MaxConns          int32
+	MinConns          int32
+	MaxConnLifetime   time.Duration
+	MaxConnIdleTime   time.Duration
+	HealthCheckPeriod time.Duration
+	// ExecMode selects how pgx prepares and caches statements:
+	// cache_statement (default), cache_describe, describe_exec, exec or simple_protocol.
+	// Use exec or simple_protocol behind PgBouncer in transaction pooling mode.
+	ExecMode string
+}
+
+// execModes maps config names to pgx query exec modes
+var execModes = map[string]pgx.QueryExecMode{
+	"cache_statement": pgx.QueryExecModeCacheStatement,
+	"cache_describe":  pgx.QueryExecModeCacheDescribe,
+	"describe_exec":   pgx.QueryExecModeDescribeExec,
+	"exec":            pgx.QueryExecModeExec,
+	"simple_protocol": pgx.QueryExecModeSimpleProtocol,
+}
+
+// RetryConfig controls how connecting at startup is retried
+type RetryConfig struct {
+	MaxAttempts    int           // Total attempts including the first; 1 disables retries
+	InitialBackoff time.Duration // Wait before the second attempt; doubles on every attempt
+	MaxBackoff     time.Duration // Upper bound for a single wait
+	AttemptTimeout time.Duration // Timeout for each individual connection attempt
+}
+
+// backoff returns the wait before the given retry (1-based) using exponential backoff with jitter.
+// Half the delay is fixed and half is random, so retries from several replicas spread out
+// while still growing steadily.
+func (rc RetryConfig) backoff(retry int) time.Duration {
+	d := rc.InitialBackoff
+	for i := 1; i < retry && d < rc.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > rc.MaxBackoff {
+		d = rc.MaxBackoff
+	}
+	half := d / 2
+	if half <= 0 {
+		return d
+	}
+	return half + rand.N(half)
+}
+
+// Driver owns the database connection pools. Create one with New and pass it to whatever needs the database.
+// Once connected, pgxpool replaces broken connections on its own; retries only matter at startup.
+type Driver struct {
+	Pool    PoolConfig
+	Retry   RetryConfig
+	InfoLog *log.Logger  // Optional: connection attempts are logged here
+	Tracer  trace.Tracer // Optional: a span is recorded for every query
+	primary *pgxpool.Pool
+	replica *pgxpool.Pool
+}
 
-// Init initializes the global connection pool using the provided DSN and returns it.
-// Subsequent calls reuse the same pool.
-func Init(ctx context.Context, dsn string) (*pgxpool.Pool, error) {
+// New creates a driver with the given pool and retry settings. Nothing is connected until Connect.
+func New(pc PoolConfig, rc RetryConfig) *Driver {
+	return &Driver{
+		Pool:  pc,
+		Retry: rc,
+	}
+}
+
+// Connect creates the primary pool, retrying with backoff until it succeeds,
+// Retry.MaxAttempts is reached or ctx is cancelled.
+func (d *Driver) Connect(ctx context.Context, dsn string) (*pgxpool.Pool, error) {
 	if dsn == "" {
 		return nil, fmt.Errorf("dsn must not be empty")
 	}
+	if d.primary != nil {
+		return d.primary, nil
+	}
 
-	once.Do(func() {
-		cfg, err := pgxpool.ParseConfig(dsn)
-		if err != nil {
-			initErr = fmt.Errorf("unable to parse config: %w", err)
-			return
-		}
+	p, err := d.connectWithRetry(ctx, "primary", dsn)
+	if err != nil {
+		return nil, err
+	}
+	d.primary = p
+	return p, nil
+}
+
+// ConnectReplica creates the read-replica pool used for read-only queries, with the same retry policy.
+func (d *Driver) ConnectReplica(ctx context.Context, dsn string) (*pgxpool.Pool, error) {
+	if dsn == "" {
+		return nil, fmt.Errorf("replica dsn must not be empty")
+	}
+	if d.replica != nil {
+		return d.replica, nil
+	}
+
+	p, err := d.connectWithRetry(ctx, "replica", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("replica: %w", err)
+	}
+	d.replica = p
+	return p, nil
+}
 
-		cfg.MaxConns = 5
-		cfg.MinConns = 2
-		cfg.MaxConnLifetime = time.Hour
-		cfg.HealthCheckPeriod = 30 * time.Second
+// connectWithRetry attempts to create a pool until it succeeds or the retry budget is spent
+func (d *Driver) connectWithRetry(ctx context.Context, name string, dsn string) (*pgxpool.Pool, error) {
+	attempts := d.Retry.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
 
-		p, err := pgxpool.NewWithConfig(ctx, cfg)
-		if err != nil {
-			initErr = fmt.Errorf("unable to create pool: %w", err)
-			return
+	var lastErr error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		attemptCtx := ctx
+		cancel := func() {}
+		if d.Retry.AttemptTimeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, d.Retry.AttemptTimeout)
+		}
+		p, err := newPool(attemptCtx, dsn, d.Pool, d.Tracer)
+		cancel()
+		if err == nil {
+			return p, nil
 		}
+		lastErr = err
 
-		if err := p.Ping(ctx); err != nil {
-			p.Close()
-			initErr = fmt.Errorf("database ping failed: %w", err)
-			return
+		if attempt == attempts {
+			break
 		}
 
-		var now time.Time
-		if err := p.QueryRow(ctx, "SELECT now()").Scan(&now); err != nil {
-			p.Close()
-			initErr = fmt.Errorf("validation query failed: %w", err)
-			return
+		wait := d.Retry.backoff(attempt)
+		d.logf("Database %s not ready (attempt %d/%d): %v - retrying in %v", name, attempt, attempts, err, wait.Round(time.Millisecond))
+		if err := sleepContext(ctx, wait); err != nil {
+			return nil, fmt.Errorf("gave up connecting to database: %w (last error: %v)", err, lastErr)
 		}
+	}
 
-		pool = p
-	})
+	return nil, fmt.Errorf("unable to connect to database after %d attempts: %w", attempts, lastErr)
+}
 
-	return pool, initErr
+// newPool creates a pool with the given settings and verifies it can run queries
+func newPool(ctx context.Context, dsn string, pc PoolConfig, tracer trace.Tracer) (*pgxpool.Pool, error) {
+	cfg, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse config: %w", err)
+	}
+
+	cfg.MaxConns = pc.MaxConns
+	cfg.MinConns = pc.MinConns
+	cfg.MaxConnLifetime = pc.MaxConnLifetime
+	cfg.MaxConnIdleTime = pc.MaxConnIdleTime
+	cfg.HealthCheckPeriod = pc.HealthCheckPeriod
+	cfg.ConnConfig.DefaultQueryExecMode = execModes[pc.ExecMode]
+	if tracer != nil {
+		// Record a tracing span for every query
+		cfg.ConnConfig.Tracer = queryTracer{tracer: tracer}
+	}
+
+	p, err := pgxpool.NewWithConfig(ctx, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create pool: %w", err)
+	}
+
+	if err := p.Ping(ctx); err != nil {
+		p.Close()
+		return nil, fmt.Errorf("database ping failed: %w", err)
+	}
+
+	var now time.Time
+	if err := p.QueryRow(ctx, "SELECT now()").Scan(&now); err != nil {
+		p.Close()
+		return nil, fmt.Errorf("validation query failed: %w", err)
+	}
+
+	return p, nil
+}
+
+// Close closes the pools that have been connected.
+func (d *Driver) Close() {
+	if d.replica != nil {
+		d.replica.Close()
+	}
+	if d.primary != nil {
+		d.primary.Close()
+	}
+}
+
+// Primary returns the primary pool, or nil before Connect succeeds.
+func (d *Driver) Primary() *pgxpool.Pool {
+	return d.primary
 }
 
-// Close closes the global pool if it has been initialized.
-func Close() {
-	if pool != nil {
-		pool.Close()
+// Replica returns the read-replica pool, or nil if no replica is configured.
+func (d *Driver) Replica() *pgxpool.Pool {
+	return d.replica
+}
+
+func (d *Driver) logf(format string, v ...interface{}) {
+	if d.InfoLog != nil {
+		d.InfoLog.Printf(format, v...)
 	}
 }
 
-// Pool returns the initialized pool instance.
-func Pool() *pgxpool.Pool {
-	return pool
+// sleepContext waits for d or until ctx is cancelled
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
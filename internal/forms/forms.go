@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"unicode"
 )
 
 // Form creates a custom form struct and embeds a url.Values object
@@ -62,3 +63,57 @@ func (f *Form) IsEmail(field string) {
 		f.Errors.Add(field, "Invalid email address")
 	}
 }
+
+// Matches checks that two fields have the same value (e.g. a password and its confirmation)
+func (f *Form) Matches(field, other string) {
+	if f.Get(field) != f.Get(other) {
+		f.Errors.Add(other, "Values do not match")
+	}
+}
+
+// PasswordPolicy describes what a new password must contain
+type PasswordPolicy struct {
+	MinLength        int
+	RequireMixedCase bool
+	RequireDigit     bool
+	RequireSymbol    bool
+}
+
+// MaxPasswordBytes is the longest password bcrypt can hash
+const MaxPasswordBytes = 72
+
+// Password checks a new password against the policy
+func (f *Form) Password(field string, p PasswordPolicy) {
+	x := f.Get(field)
+	if len(x) < p.MinLength {
+		f.Errors.Add(field, fmt.Sprintf("This field must be at least %d characters long", p.MinLength))
+		return
+	}
+	if len(x) > MaxPasswordBytes {
+		f.Errors.Add(field, fmt.Sprintf("Password must be at most %d bytes long", MaxPasswordBytes))
+		return
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, c := range x {
+		switch {
+		case unicode.IsUpper(c):
+			upper = true
+		case unicode.IsLower(c):
+			lower = true
+		case unicode.IsDigit(c):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	if p.RequireMixedCase && !(upper && lower) {
+		f.Errors.Add(field, "Password must contain both upper and lower case letters")
+	}
+	if p.RequireDigit && !digit {
+		f.Errors.Add(field, "Password must contain a digit")
+	}
+	if p.RequireSymbol && !symbol {
+		f.Errors.Add(field, "Password must contain a symbol")
+	}
+}
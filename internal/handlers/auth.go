@@ -0,0 +1,321 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/dunky-star/modern-webapp-golang/internal/data"
+	"github.com/dunky-star/modern-webapp-golang/internal/forms"
+	"github.com/dunky-star/modern-webapp-golang/internal/helpers"
+	"github.com/dunky-star/modern-webapp-golang/internal/repository"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// passwordPolicy returns the configured rules for new passwords
+func (m *Repository) passwordPolicy() forms.PasswordPolicy {
+	as := m.app.Settings.Auth
+	return forms.PasswordPolicy{
+		MinLength:        as.PasswordMinLength,
+		RequireMixedCase: as.PasswordRequireMixedCase,
+		RequireDigit:     as.PasswordRequireDigit,
+		RequireSymbol:    as.PasswordRequireSymbol,
+	}
+}
+
+// ShowForgotPasswordHandler shows the form for requesting a password reset link
+func (m *Repository) ShowForgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	m.render.TemplateCache(w, r, "forgot-password.page.tmpl", &data.TemplateData{
+		Form: forms.New(nil),
+		Data: map[string]interface{}{
+			"Title": "Forgot Password",
+		},
+	})
+}
+
+// PostForgotPasswordHandler emails a single-use reset link if the address belongs to a user.
+// The response is the same either way so the form can't be used to discover accounts.
+func (m *Repository) PostForgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("email")
+	form.IsEmail("email")
+	if !form.Valid() {
+		m.render.TemplateCache(w, r, "forgot-password.page.tmpl", &data.TemplateData{
+			Form: form,
+			Data: map[string]interface{}{
+				"Title": "Forgot Password",
+			},
+		})
+		return
+	}
+
+	email := form.Get("email")
+	if user, err := m.db.GetUserByEmail(r.Context(), email); err == nil && user.Active {
+		if err := m.sendPasswordReset(r, user); err != nil {
+			m.app.ErrorLog.Printf("Failed to create password reset for user %d: %v", user.Id, err)
+		}
+	}
+
+	m.app.Session.Put(r.Context(), "flash", "If an account exists for that address, we've emailed a link to reset the password")
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+// sendPasswordReset stores a new reset token for the user and queues the email with the link
+func (m *Repository) sendPasswordReset(r *http.Request, user data.User) error {
+	token, tokenHash, err := helpers.NewToken()
+	if err != nil {
+		return err
+	}
+
+	ttl := m.app.Settings.Auth.PasswordResetTTL
+	if err := m.db.InsertPasswordReset(r.Context(), user.Id, tokenHash, time.Now().Add(ttl)); err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/user/reset-password?token=%s", m.app.BaseURL, url.QueryEscape(token))
+	htmlMessage := fmt.Sprintf(`
+	<strong>Password Reset</strong><br />
+	Dear %s, <br /><br />
+	Someone asked to reset the password for your account. If it was you, follow the link below
+	within %d minutes to choose a new password:<br /><br />
+	<a href="%s">%s</a><br /><br />
+	If you didn't ask for this, you can ignore this email.<br />
+	`, template.HTMLEscapeString(user.FirstName), int(ttl.Minutes()), link, link)
+
+	m.sendMail(r, data.MailData{
+		To:       user.Email,
+		From:     m.app.Settings.Mail.From,
+		Subject:  "Reset your password",
+		Content:  template.HTML(htmlMessage),
+		Template: "dunky.html",
+	})
+	return nil
+}
+
+// ShowResetPasswordHandler shows the new password form for a valid reset link
+func (m *Repository) ShowResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if _, err := m.db.GetPasswordResetUserID(r.Context(), helpers.HashToken(token)); err != nil {
+		if !errors.Is(err, repository.ErrInvalidToken) {
+			m.helpers.ServerError(w, err)
+			return
+		}
+		m.app.Session.Put(r.Context(), "error", "That reset link is invalid or has expired. Please request a new one.")
+		http.Redirect(w, r, "/user/forgot-password", http.StatusSeeOther)
+		return
+	}
+
+	m.render.TemplateCache(w, r, "reset-password.page.tmpl", &data.TemplateData{
+		Form: forms.New(nil),
+		StringMap: map[string]string{
+			"token": token,
+		},
+		Data: map[string]interface{}{
+			"Title": "Reset Password",
+		},
+	})
+}
+
+// PostResetPasswordHandler sets the new password, uses up the token and logs the user out everywhere else
+func (m *Repository) PostResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+
+	token := r.PostForm.Get("token")
+	form := forms.New(r.PostForm)
+	form.Required("password", "confirm_password")
+	form.Password("password", m.passwordPolicy())
+	form.Matches("password", "confirm_password")
+	if !form.Valid() {
+		m.render.TemplateCache(w, r, "reset-password.page.tmpl", &data.TemplateData{
+			Form: form,
+			StringMap: map[string]string{
+				"token": token,
+			},
+			Data: map[string]interface{}{
+				"Title": "Reset Password",
+			},
+		})
+		return
+	}
+
+	userID, err := m.db.ResetPassword(r.Context(), helpers.HashToken(token), form.Get("password"))
+	if errors.Is(err, bcrypt.ErrPasswordTooLong) {
+		form.Errors.Add("password", fmt.Sprintf("Password must be at most %d bytes long", forms.MaxPasswordBytes))
+		m.render.TemplateCache(w, r, "reset-password.page.tmpl", &data.TemplateData{
+			Form: form,
+			StringMap: map[string]string{
+				"token": token,
+			},
+			Data: map[string]interface{}{
+				"Title": "Reset Password",
+			},
+		})
+		return
+	} else if errors.Is(err, repository.ErrInvalidToken) {
+		m.app.Session.Put(r.Context(), "error", "That reset link is invalid or has expired. Please request a new one.")
+		http.Redirect(w, r, "/user/forgot-password", http.StatusSeeOther)
+		return
+	} else if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+
+	// Anyone holding a session or remembered device from before the reset must log in again
+	if err := m.destroyUserSessions(r.Context(), userID); err != nil {
+		m.app.ErrorLog.Printf("Failed to end sessions for user %d after password reset: %v", userID, err)
+	}
+	m.forgetAllDevices(r.Context(), userID)
+
+	_ = m.app.Session.RenewToken(r.Context())
+	m.app.Session.Put(r.Context(), "flash", "Your password has been reset. Please log in.")
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+// loginLocks lets one login attempt per email be checked at a time. It's kept in memory rather
+// than in the database so a waiting attempt doesn't hold a pooled connection. It only holds
+// within this server process: with several instances, each can check one attempt per email at
+// once, so up to one guess per instance can get past the lockout check before a failure counts.
+type loginLocks struct {
+	mu   sync.Mutex
+	held map[string]bool
+}
+
+// tryLock takes the lock for key, or returns false if another attempt holds it.
+// The returned unlock may be called more than once.
+func (l *loginLocks) tryLock(key string) (unlock func(), ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.held[key] {
+		return nil, false
+	}
+	if l.held == nil {
+		l.held = make(map[string]bool)
+	}
+	l.held[key] = true
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			delete(l.held, key)
+		})
+	}, true
+}
+
+// loginBlocked reports why a login attempt must be refused without checking the password:
+// data.LoginBusy, data.LoginIPBlocked, data.LoginLocked, or "" if it may go ahead.
+// Locks are tracked per email whether or not the account exists, so they don't reveal which accounts do.
+// Attempts for one email are checked one at a time, so parallel guesses can't all get in before
+// the first failure is recorded; the caller must call unlock once the attempt's outcome is recorded,
+// and before loginFailed slows the response down.
+func (m *Repository) loginBlocked(ctx context.Context, a data.LoginAttempt) (outcome string, unlock func(), err error) {
+	unlock, ok := m.logins.tryLock(a.Email)
+	if !ok {
+		return data.LoginBusy, func() {}, nil
+	}
+
+	as := m.app.Settings.Auth
+	since := time.Now().Add(-as.LockoutWindow)
+
+	ipFailures, err := m.db.CountIPLoginFailures(ctx, a.IPAddress, since)
+	if err != nil {
+		unlock()
+		return "", nil, err
+	}
+	if ipFailures >= as.MaxIPLoginFailures {
+		return data.LoginIPBlocked, unlock, nil
+	}
+
+	failures, lastFailure, err := m.db.CountLoginFailures(ctx, a.Email, since)
+	if err != nil {
+		unlock()
+		return "", nil, err
+	}
+	if failures >= as.MaxLoginFailures && time.Since(lastFailure) < as.LockoutDuration {
+		return data.LoginLocked, unlock, nil
+	}
+	return "", unlock, nil
+}
+
+// loginFailed locks the account once it reaches the failure limit and slows down the response,
+// doubling the delay with each consecutive failure
+func (m *Repository) loginFailed(r *http.Request, a data.LoginAttempt) {
+	as := m.app.Settings.Auth
+	failures, _, err := m.db.CountLoginFailures(r.Context(), a.Email, time.Now().Add(-as.LockoutWindow))
+	if err != nil {
+		m.app.ErrorLog.Printf("Failed to count login failures: %v", err)
+		return
+	}
+
+	if failures == as.MaxLoginFailures {
+		m.app.WarningLog.Printf("Locking logins for %s for %s after %d failed attempts (last from %s)",
+			a.Email, as.LockoutDuration, failures, a.IPAddress)
+		m.sendLockoutNotice(r, a)
+	}
+
+	delay := loginDelay(failures, as.LoginDelay, as.MaxLoginDelay)
+	select {
+	case <-time.After(delay):
+	case <-r.Context().Done():
+	}
+}
+
+// loginDelay returns how long to wait after the given number of consecutive failures
+func loginDelay(failures int, base, max time.Duration) time.Duration {
+	d := base
+	for i := 1; i < failures && d < max; i++ {
+		d *= 2
+	}
+	return min(d, max)
+}
+
+// sendLockoutNotice emails the account owner (if the account exists) that logins have been locked
+func (m *Repository) sendLockoutNotice(r *http.Request, a data.LoginAttempt) {
+	user, err := m.db.GetUserByEmail(r.Context(), a.Email)
+	if err != nil {
+		return
+	}
+
+	as := m.app.Settings.Auth
+	htmlMessage := fmt.Sprintf(`
+	<strong>Account Locked</strong><br />
+	Dear %s, <br /><br />
+	There were %d failed attempts to log in to your account, most recently from %s, so logins
+	are blocked for the next %d minutes.<br /><br />
+	If this wasn't you, someone may be guessing your password. You can choose a new one at
+	<a href="%s/user/forgot-password">%s/user/forgot-password</a>.<br />
+	`, template.HTMLEscapeString(user.FirstName), as.MaxLoginFailures, template.HTMLEscapeString(a.IPAddress),
+		int(as.LockoutDuration.Minutes()), m.app.BaseURL, m.app.BaseURL)
+
+	m.sendMail(r, data.MailData{
+		To:       user.Email,
+		From:     m.app.Settings.Mail.From,
+		Subject:  "Your account has been locked",
+		Content:  template.HTML(htmlMessage),
+		Template: "dunky.html",
+	})
+}
+
+// recordLoginAttempt writes the attempt to the audit log. A failure to record is logged, not fatal.
+func (m *Repository) recordLoginAttempt(ctx context.Context, a data.LoginAttempt) {
+	m.metrics.LoginAttempts.WithLabelValues(a.Outcome).Inc()
+	if err := m.db.InsertLoginAttempt(ctx, a); err != nil {
+		m.app.ErrorLog.Printf("Failed to record login attempt for %s: %v", a.Email, err)
+	}
+}
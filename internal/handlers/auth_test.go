@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dunky-star/modern-webapp-golang/internal/config"
+	"github.com/dunky-star/modern-webapp-golang/internal/data"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newLoginRepo returns handlers whose database has a single connection and one active user
+func newLoginRepo(t *testing.T) (*Repository, *fakeDB, data.User) {
+	t.Helper()
+	s := config.DefaultSettings()
+	s.Database.MaxConns = 1
+	s.Auth.LoginDelay = 300 * time.Millisecond
+	s.Auth.MaxLoginDelay = 300 * time.Millisecond
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := newFakeDB()
+	db.conns = make(chan struct{}, s.Database.MaxConns)
+	user := db.addUser(data.User{Email: "ada@example.com", Password: string(hash), Active: true})
+	return newTestRepo(t, db, s), db, user
+}
+
+// login returns a login form submission
+func login(email, password string) *http.Request {
+	form := url.Values{"email": {email}, "password": {password}}
+	r := httptest.NewRequest(http.MethodPost, "/user/login", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r
+}
+
+func TestLoginWithOneConnection(t *testing.T) {
+	m, db, user := newLoginRepo(t)
+
+	w, ctx := m.serve(t, m.PostLoginHandler, login("ada@example.com", "correct horse"))
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/" {
+		t.Fatalf("login = %d to %q, want redirect to /", w.Code, w.Header().Get("Location"))
+	}
+	if got := m.app.Session.GetInt(ctx, "user_id"); got != user.Id {
+		t.Errorf("logged in user = %d, want %d", got, user.Id)
+	}
+	if got := db.loginAttempts(); len(got) != 1 || got[0].Outcome != data.LoginSucceeded {
+		t.Errorf("recorded attempts = %+v, want one success", got)
+	}
+}
+
+func TestLoginUnlockedDuringFailureDelay(t *testing.T) {
+	m, db, user := newLoginRepo(t)
+
+	failed := make(chan *httptest.ResponseRecorder)
+	go func() {
+		w, _ := m.serve(t, m.PostLoginHandler, login("ada@example.com", "wrong"))
+		failed <- w
+	}()
+
+	// Wait for the failure to be recorded, then log in while its response is being delayed
+	for len(db.loginAttempts()) == 0 {
+		time.Sleep(5 * time.Millisecond)
+	}
+	w, ctx := m.serve(t, m.PostLoginHandler, login("ada@example.com", "correct horse"))
+	if got := m.app.Session.GetInt(ctx, "user_id"); got != user.Id {
+		t.Errorf("login during delay = %d to %q, want user %d logged in", w.Code, w.Header().Get("Location"), user.Id)
+	}
+
+	if w := <-failed; w.Header().Get("Location") != "/user/login" {
+		t.Errorf("failed login redirected to %q, want /user/login", w.Header().Get("Location"))
+	}
+	attempts := db.loginAttempts()
+	if len(attempts) != 2 || attempts[0].Outcome != data.LoginFailed || attempts[1].Outcome != data.LoginSucceeded {
+		t.Errorf("recorded attempts = %+v, want a failure then a success", attempts)
+	}
+}
+
+// profile returns a profile form submission that keeps the user's details
+func profile(currentPassword string) *http.Request {
+	form := url.Values{
+		"first_name":       {"Ada"},
+		"last_name":        {"Lovelace"},
+		"email":            {"ada@example.com"},
+		"current_password": {currentPassword},
+	}
+	r := httptest.NewRequest(http.MethodPost, "/user/profile", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r
+}
+
+func TestProfileWrongPasswordCountsTowardsLockout(t *testing.T) {
+	m, db, user := newLoginRepo(t)
+	ctx := loginSession(t, m)
+	user.Email = "Ada@Example.com"
+	db.users[user.Id] = user
+
+	m.serveIn(ctx, m.PostProfileHandler, profile("wrong"))
+	attempts := db.loginAttempts()
+	if last := attempts[len(attempts)-1]; last.Outcome != data.LoginFailed || last.Email != "ada@example.com" {
+		t.Errorf("recorded attempt = %+v, want a failure for ada@example.com", last)
+	}
+}
+
+func TestProfileDeactivatedUserLoggedOut(t *testing.T) {
+	m, db, user := newLoginRepo(t)
+	ctx := loginSession(t, m)
+	user.Active = false
+	db.users[user.Id] = user
+
+	w := m.serveIn(ctx, m.PostProfileHandler, profile("correct horse"))
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/user/login" {
+		t.Fatalf("profile = %d to %q, want redirect to /user/login", w.Code, w.Header().Get("Location"))
+	}
+	if m.app.Session.GetInt(ctx, "user_id") != 0 {
+		t.Error("deactivated user still logged in")
+	}
+	attempts := db.loginAttempts()
+	if last := attempts[len(attempts)-1]; last.Outcome != data.LoginInactive {
+		t.Errorf("recorded attempt = %+v, want an inactive login", last)
+	}
+}
@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dunky-star/modern-webapp-golang/internal/data"
+	"github.com/dunky-star/modern-webapp-golang/internal/forms"
+	"github.com/dunky-star/modern-webapp-golang/internal/helpers"
+	"github.com/dunky-star/modern-webapp-golang/internal/repository"
+)
+
+// ShowRegisterHandler shows the form for a guest to create an account
+func (m *Repository) ShowRegisterHandler(w http.ResponseWriter, r *http.Request) {
+	if m.helpers.IsAuthenticated(r) {
+		http.Redirect(w, r, "/user/bookings", http.StatusSeeOther)
+		return
+	}
+
+	m.render.TemplateCache(w, r, "register.page.tmpl", &data.TemplateData{
+		Form: forms.New(r.URL.Query()),
+		Data: map[string]interface{}{
+			"Title": "Create an Account",
+		},
+	})
+}
+
+// PostRegisterHandler creates a guest account and emails a link to choose its password, which
+// also proves the guest owns the address their bookings are listed under. An existing account
+// gets a password reset link instead, and the response is the same either way so the form
+// can't be used to discover accounts.
+func (m *Repository) PostRegisterHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("first_name", "last_name", "email")
+	form.IsEmail("email")
+	if !form.Valid() {
+		m.render.TemplateCache(w, r, "register.page.tmpl", &data.TemplateData{
+			Form: form,
+			Data: map[string]interface{}{
+				"Title": "Create an Account",
+			},
+		})
+		return
+	}
+
+	email := strings.ToLower(strings.TrimSpace(form.Get("email")))
+	user, err := m.db.GetUserByEmail(r.Context(), email)
+	switch {
+	case err == nil:
+		if user.Active {
+			if err := m.sendPasswordReset(r, user); err != nil {
+				m.app.ErrorLog.Printf("Failed to create password reset for user %d: %v", user.Id, err)
+			}
+		}
+	case errors.Is(err, repository.ErrUserNotFound):
+		if err := m.registerGuest(r, form.Get("first_name"), form.Get("last_name"), email); err != nil {
+			m.helpers.ServerError(w, err)
+			return
+		}
+	default:
+		m.helpers.ServerError(w, err)
+		return
+	}
+
+	m.app.Session.Put(r.Context(), "flash", fmt.Sprintf("We've emailed %s a link to choose your password", email))
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+// registerGuest creates a guest user who can't log in until they follow the emailed link
+func (m *Repository) registerGuest(r *http.Request, firstName, lastName, email string) error {
+	password, _, err := helpers.NewToken()
+	if err != nil {
+		return err
+	}
+
+	user := data.User{
+		FirstName:   firstName,
+		LastName:    lastName,
+		Email:       email,
+		AccessLevel: int(data.RoleGuest),
+	}
+	user.Id, err = m.db.InsertUser(r.Context(), user, password)
+	if err != nil {
+		return err
+	}
+
+	token, tokenHash, err := helpers.NewToken()
+	if err != nil {
+		return err
+	}
+	ttl := m.app.Settings.Auth.InviteTTL
+	if err := m.db.InsertPasswordReset(r.Context(), user.Id, tokenHash, time.Now().Add(ttl)); err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/user/reset-password?token=%s", m.app.BaseURL, url.QueryEscape(token))
+	htmlMessage := fmt.Sprintf(`
+	<strong>Welcome</strong><br />
+	Dear %s, <br /><br />
+	Thanks for creating an account. Follow the link below within %d hours to choose your
+	password:<br /><br />
+	<a href="%s">%s</a><br /><br />
+	You can then log in to see all your bookings made with this email address.<br />
+	`, template.HTMLEscapeString(user.FirstName), int(ttl.Hours()), link, link)
+
+	m.sendMail(r, data.MailData{
+		To:       user.Email,
+		From:     m.app.Settings.Mail.From,
+		Subject:  "Finish creating your account",
+		Content:  template.HTML(htmlMessage),
+		Template: "dunky.html",
+	})
+	m.app.InfoLog.Printf("Guest %d registered", user.Id)
+	return nil
+}
+
+// MyBookingsHandler lists the logged-in user's upcoming and past reservations
+func (m *Repository) MyBookingsHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := m.db.GetUserByID(r.Context(), m.app.Session.GetInt(r.Context(), "user_id"))
+	if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+
+	reservations, err := m.db.GuestReservations(r.Context(), user.Email)
+	if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+
+	// A stay is upcoming until its departure day has passed
+	today := time.Now().Truncate(24 * time.Hour)
+	var upcoming, past []data.Reservation
+	for _, res := range reservations {
+		if res.EndDate.Before(today) {
+			past = append(past, res)
+		} else {
+			upcoming = append(upcoming, res)
+		}
+	}
+	// Reservations come latest first; upcoming stays are shown soonest first
+	slices.Reverse(upcoming)
+
+	m.render.TemplateCache(w, r, "my-bookings.page.tmpl", &data.TemplateData{
+		Data: map[string]interface{}{
+			"Title":    "My Bookings",
+			"Upcoming": upcoming,
+			"Past":     past,
+		},
+	})
+}
@@ -1,64 +1,73 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/dunky-star/modern-webapp-golang/internal/config"
 	"github.com/dunky-star/modern-webapp-golang/internal/data"
+	"github.com/dunky-star/modern-webapp-golang/internal/driver"
 	"github.com/dunky-star/modern-webapp-golang/internal/forms"
 	"github.com/dunky-star/modern-webapp-golang/internal/helpers"
+	"github.com/dunky-star/modern-webapp-golang/internal/metrics"
+	"github.com/dunky-star/modern-webapp-golang/internal/oidcauth"
+	"github.com/dunky-star/modern-webapp-golang/internal/payments"
+	"github.com/dunky-star/modern-webapp-golang/internal/pricing"
 	"github.com/dunky-star/modern-webapp-golang/internal/render"
 	"github.com/dunky-star/modern-webapp-golang/internal/repository"
 	"github.com/dunky-star/modern-webapp-golang/internal/repository/dbrepo"
-	"github.com/jackc/pgx/v5/pgxpool"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// Repo the repository used by the handlers
-var Repo *Repository
-
 // Repository is the repository type
 type Repository struct {
-	app *config.AppConfig
-	db  repository.DatabaseConn
-}
-
-// NewRepo creates a new repository
-func NewRepo(a *config.AppConfig, dbconn *pgxpool.Pool) *Repository {
-	return &Repository{
-		app: a,
-		db:  dbrepo.NewDBConnection(dbconn, a),
-	}
-}
-
-// NewHandlers sets the repository for the handlers
-func NewHandlers(r *Repository) {
-	Repo = r
+	app      *config.AppConfig
+	db       repository.DatabaseConn
+	driver   *driver.Driver
+	render   *render.Renderer
+	helpers  *helpers.Helpers
+	metrics  *metrics.Metrics
+	pricing  *pricing.Service
+	oidc     *oidcauth.Client  // nil when single sign-on isn't configured
+	payments payments.Provider // nil when bookings are confirmed without payment
+	logins   loginLocks        // Emails with a login attempt being checked
 }
 
-var appVersion string
-var appStartTime time.Time
-
-// SetAppVersion sets the application version for health check
-func SetAppVersion(version string) {
-	appVersion = version
-}
-
-// SetAppStartTime sets the application start time for health check
-func SetAppStartTime(startTime time.Time) {
-	appStartTime = startTime
+// NewRepo creates a new repository on top of a connected driver.
+// Read-only queries use the driver's replica when one is connected.
+func NewRepo(a *config.AppConfig, drv *driver.Driver, rend *render.Renderer, h *helpers.Helpers, mx *metrics.Metrics) *Repository {
+	db := dbrepo.NewDBConnection(drv.Primary(), drv.Replica(), a)
+	repo := &Repository{
+		app:     a,
+		db:      db,
+		driver:  drv,
+		render:  rend,
+		helpers: h,
+		metrics: mx,
+		pricing: pricing.New(db, a.Settings.Reservations.Currency),
+	}
+	if a.Settings.OIDC.Enabled() {
+		repo.oidc = oidcauth.New(a.Settings.OIDC, a.BaseURL)
+	}
+	if a.Settings.Payments.Enabled() {
+		repo.payments = payments.New(a.Settings.Payments, a.BaseURL)
+	}
+	return repo
 }
 
 func (m *Repository) HealthCheckHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	// Calculate uptime dynamically
-	uptime := time.Since(appStartTime).Truncate(time.Second)
+	uptime := time.Since(m.app.StartTime).Truncate(time.Second)
 	status := map[string]interface{}{
-		"version":   appVersion,
+		"version":   m.app.Version,
 		"status":    "available",
 		"uptime":    uptime.String(),
 		"timestamp": time.Now().Format(time.RFC3339),
@@ -68,7 +77,7 @@ func (m *Repository) HealthCheckHandler(w http.ResponseWriter, r *http.Request)
 	encoder := json.NewEncoder(w)
 	encoder.SetIndent("", "  ")
 	if err := encoder.Encode(status); err != nil {
-		helpers.ServerError(w, err)
+		m.helpers.ServerError(w, err)
 		return
 	}
 }
@@ -78,7 +87,7 @@ func (m *Repository) HomeHandler(w http.ResponseWriter, r *http.Request) {
 	m.app.InfoLog.Printf("Remote address: %s", remoteIPAddr)
 	m.app.Session.Put(r.Context(), "remote_addr", remoteIPAddr)
 
-	render.TemplateCache(w, r, "home.page.tmpl", &data.TemplateData{
+	m.render.TemplateCache(w, r, "home.page.tmpl", &data.TemplateData{
 		Data: map[string]interface{}{
 			"Title": "Home, welcome!",
 		},
@@ -99,14 +108,14 @@ func (m *Repository) AboutUsHandler(w http.ResponseWriter, r *http.Request) {
 		stringMap["remote_addr"] = remoteAddr
 	}
 
-	render.TemplateCache(w, r, "about.page.tmpl", &data.TemplateData{
+	m.render.TemplateCache(w, r, "about.page.tmpl", &data.TemplateData{
 		Data:      dataMap,
 		StringMap: stringMap,
 	})
 }
 
 func (m *Repository) GeneralsQuartersHandler(w http.ResponseWriter, r *http.Request) {
-	render.TemplateCache(w, r, "generals.page.tmpl", &data.TemplateData{
+	m.render.TemplateCache(w, r, "generals.page.tmpl", &data.TemplateData{
 		Data: map[string]interface{}{
 			"Title": "Generals Quarters",
 		},
@@ -114,7 +123,7 @@ func (m *Repository) GeneralsQuartersHandler(w http.ResponseWriter, r *http.Requ
 }
 
 func (m *Repository) MajorsSuiteHandler(w http.ResponseWriter, r *http.Request) {
-	render.TemplateCache(w, r, "majors.page.tmpl", &data.TemplateData{
+	m.render.TemplateCache(w, r, "majors.page.tmpl", &data.TemplateData{
 		Data: map[string]interface{}{
 			"Title": "Majors Suite",
 		},
@@ -122,7 +131,7 @@ func (m *Repository) MajorsSuiteHandler(w http.ResponseWriter, r *http.Request)
 }
 
 func (m *Repository) SearchAvailabilityHandler(w http.ResponseWriter, r *http.Request) {
-	render.TemplateCache(w, r, "search-availability.page.tmpl", &data.TemplateData{
+	m.render.TemplateCache(w, r, "search-availability.page.tmpl", &data.TemplateData{
 		Data: map[string]interface{}{
 			"Title": "Search Availability",
 		},
@@ -132,7 +141,7 @@ func (m *Repository) SearchAvailabilityHandler(w http.ResponseWriter, r *http.Re
 func (m *Repository) PostAvailabilityHandler(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
-		helpers.ServerError(w, err)
+		m.helpers.ServerError(w, err)
 		return
 	}
 
@@ -155,7 +164,7 @@ func (m *Repository) PostAvailabilityHandler(w http.ResponseWriter, r *http.Requ
 
 	// If form is invalid, re-render the form with errors
 	if !form.Valid() {
-		render.TemplateCache(w, r, "search-availability.page.tmpl", &data.TemplateData{
+		m.render.TemplateCache(w, r, "search-availability.page.tmpl", &data.TemplateData{
 			Form: form,
 			Data: map[string]interface{}{
 				"Title": "Search Availability",
@@ -164,9 +173,9 @@ func (m *Repository) PostAvailabilityHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	rooms, err := m.db.SearchAvailabilityForAllRooms(startDate, endDate)
+	rooms, err := m.db.SearchAvailabilityForAllRooms(r.Context(), startDate, endDate)
 	if err != nil {
-		helpers.ServerError(w, err)
+		m.helpers.ServerError(w, err)
 		return
 	}
 
@@ -176,6 +185,16 @@ func (m *Repository) PostAvailabilityHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
+	// Price the stay in each room
+	quotes := make(map[int]data.Quote, len(rooms))
+	for _, room := range rooms {
+		quotes[room.Id], err = m.pricing.QuoteRoom(r.Context(), room, startDate, endDate)
+		if err != nil {
+			m.helpers.ServerError(w, err)
+			return
+		}
+	}
+
 	// Store reservation with dates in session
 	res := data.Reservation{
 		StartDate: startDate,
@@ -185,11 +204,12 @@ func (m *Repository) PostAvailabilityHandler(w http.ResponseWriter, r *http.Requ
 
 	// Render choose-room template with available rooms
 	dataMap := map[string]interface{}{
-		"Title": "Choose Your Room",
-		"rooms": rooms,
+		"Title":  "Choose Your Room",
+		"rooms":  rooms,
+		"quotes": quotes,
 	}
 
-	render.TemplateCache(w, r, "choose-room.page.tmpl", &data.TemplateData{
+	m.render.TemplateCache(w, r, "choose-room.page.tmpl", &data.TemplateData{
 		Data: dataMap,
 	})
 }
@@ -234,7 +254,7 @@ func (m *Repository) BookRoomHandler(w http.ResponseWriter, r *http.Request) {
 
 	var res data.Reservation
 
-	room, err := m.db.GetRoomByID(roomID)
+	room, err := m.db.GetRoomByID(r.Context(), roomID)
 	if err != nil {
 		m.app.Session.Put(r.Context(), "error", "Can't get room from db!")
 		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
@@ -252,7 +272,7 @@ func (m *Repository) BookRoomHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (m *Repository) ContactHandler(w http.ResponseWriter, r *http.Request) {
-	render.TemplateCache(w, r, "contact.page.tmpl", &data.TemplateData{
+	m.render.TemplateCache(w, r, "contact.page.tmpl", &data.TemplateData{
 		Data: map[string]interface{}{
 			"Title": "Contact Us",
 		},
@@ -290,7 +310,7 @@ func (m *Repository) AvialabilityJSONHandler(w http.ResponseWriter, r *http.Requ
 
 	roomID, _ := strconv.Atoi(r.Form.Get("room_id"))
 
-	available, err := m.db.SearchAvailabilityByDatesByRoomId(startDate, endDate, roomID)
+	available, err := m.db.SearchAvailabilityByDatesByRoomId(r.Context(), startDate, endDate, roomID, 0)
 	if err != nil {
 		resp := jsonResponse{
 			OK:      false,
@@ -327,7 +347,7 @@ func (m *Repository) MakeReservationHandler(w http.ResponseWriter, r *http.Reque
 	}
 
 	// Get room from database
-	room, err := m.db.GetRoomByID(res.RoomId)
+	room, err := m.db.GetRoomByID(r.Context(), res.RoomId)
 	if err != nil {
 		m.app.Session.Put(r.Context(), "error", "can't find room!")
 		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
@@ -336,6 +356,18 @@ func (m *Repository) MakeReservationHandler(w http.ResponseWriter, r *http.Reque
 
 	res.Room.RoomName = room.RoomName
 
+	// Logged-in guests don't have to type their details again
+	if m.helpers.IsAuthenticated(r) && res.Email == "" {
+		user, err := m.db.GetUserByID(r.Context(), m.app.Session.GetInt(r.Context(), "user_id"))
+		if err != nil {
+			m.helpers.ServerError(w, err)
+			return
+		}
+		res.FirstName = user.FirstName
+		res.LastName = user.LastName
+		res.Email = user.Email
+	}
+
 	// Store reservation back in session
 	m.app.Session.Put(r.Context(), "reservation", res)
 
@@ -347,10 +379,17 @@ func (m *Repository) MakeReservationHandler(w http.ResponseWriter, r *http.Reque
 	stringMap["start_date"] = sd
 	stringMap["end_date"] = ed
 
+	quote, err := m.pricing.QuoteRoom(r.Context(), room, res.StartDate, res.EndDate)
+	if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+
 	dataMap := make(map[string]interface{})
 	dataMap["reservation"] = res
+	dataMap["quote"] = quote
 
-	render.TemplateCache(w, r, "make-reservation.page.tmpl", &data.TemplateData{
+	m.render.TemplateCache(w, r, "make-reservation.page.tmpl", &data.TemplateData{
 		Form:      forms.New(nil),
 		Data:      dataMap,
 		StringMap: stringMap,
@@ -401,62 +440,188 @@ func (m *Repository) PostReservationHandler(w http.ResponseWriter, r *http.Reque
 		RoomId:    roomID,
 	}
 
+	// Price the stay again rather than trusting anything the page showed
+	room, err := m.db.GetRoomByID(r.Context(), roomID)
+	if err != nil {
+		m.app.Session.Put(r.Context(), "error", "can't find room!")
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
+	}
+	reservation.Room = room
+	quote, err := m.pricing.QuoteRoom(r.Context(), room, startDate, endDate)
+	if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+
 	form := forms.New(r.PostForm)
 
 	form.Required("first_name", "last_name", "email")
 	form.MinLength("first_name", 3, r)
 	form.IsEmail("email")
 
-	if !form.Valid() {
+	if strings.TrimSpace(form.Get("promo_code")) != "" {
+		promo, err := m.pricing.ApplyPromo(r.Context(), &quote, form.Get("promo_code"), roomID)
+		var promoErr *pricing.PromoError
+		if errors.As(err, &promoErr) {
+			form.Errors.Add("promo_code", promoErr.Reason)
+		} else if err != nil {
+			m.helpers.ServerError(w, err)
+			return
+		}
+		reservation.PromoCodeId, reservation.PromoCode = promo.Id, promo.Code
+	}
+	reservation.TotalPrice = quote.Due()
+	reservation.Currency = quote.Currency
+	reservation.Discount = quote.Discount
+
+	showForm := func() {
 		dataMap := make(map[string]interface{})
 		dataMap["reservation"] = reservation
-		render.TemplateCache(w, r, "make-reservation.page.tmpl", &data.TemplateData{
+		dataMap["quote"] = quote
+		m.render.TemplateCache(w, r, "make-reservation.page.tmpl", &data.TemplateData{
 			Form: form,
 			Data: dataMap,
 		})
+	}
+	if !form.Valid() {
+		showForm()
 		return
 	}
 
-	newReservationID, err := m.db.InsertReservation(reservation)
+	reservation.ConfirmationCode, err = helpers.NewConfirmationCode()
 	if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+	// The room isn't booked until the reservation is confirmed; the hold keeps its promo code use till then
+	holdUntil := time.Now().Add(m.app.Settings.Payments.HoldTimeout)
+	reservation.HoldUntil = &holdUntil
+
+	reservation.Id, err = m.db.InsertReservation(r.Context(), reservation)
+	if errors.Is(err, repository.ErrPromoCodeUsedUp) || errors.Is(err, repository.ErrPromoCodeNotFound) {
+		// Someone else took the code's last use, or it was deactivated, since it was checked
+		form.Errors.Add("promo_code", "That promo code can no longer be used")
+		quote.PromoCode, quote.Discount = "", 0
+		showForm()
+		return
+	} else if err != nil {
 		m.app.Session.Put(r.Context(), "error", "can't insert reservation into database!")
 		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
 		return
 	}
 
-	restriction := data.RoomRestriction{
-		StartDate:     startDate,
-		EndDate:       endDate,
-		RoomId:        roomID,
-		ReservationId: newReservationID,
-		RestrictionId: 1,
+	if m.payments != nil && reservation.TotalPrice > 0 {
+		m.startPayment(w, r, reservation)
+		return
 	}
 
-	err = m.db.InsertRoomRestriction(restriction)
-	if err != nil {
-		m.app.Session.Put(r.Context(), "error", "can't insert room restriction!")
-		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+	err = m.db.ConfirmReservation(r.Context(), reservation.Id, 0)
+	if errors.Is(err, repository.ErrRoomUnavailable) {
+		m.releaseReservation(r, reservation)
+		m.app.Session.Put(r.Context(), "error", "Sorry, this room has just been booked for those dates. Please search again.")
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+		return
+	} else if err != nil {
+		m.helpers.ServerError(w, err)
 		return
 	}
+	m.reservationConfirmed(r, reservation)
+
+	m.app.Session.Put(r.Context(), "reservation", reservation)
 
+	http.Redirect(w, r, "/reservation-summary", http.StatusSeeOther)
+}
+
+// reservationConfirmed counts a newly booked reservation and emails the guest its confirmation
+func (m *Repository) reservationConfirmed(r *http.Request, reservation data.Reservation) {
+	m.metrics.ReservationsCreated.Inc()
+
+	link := fmt.Sprintf("%s/reservation/lookup?code=%s", m.app.BaseURL, reservation.ConfirmationCode)
+	savings := ""
+	if reservation.PromoCode != "" {
+		savings = fmt.Sprintf(" (promo code %s saved you %s)", reservation.PromoCode, reservation.Format(reservation.Discount))
+	}
 	htmlMessage := fmt.Sprintf(`
 	<strong>Reservation Confirmation</strong><br />
 	Dear %s, <br /><br />
-	Your reservation has been confirmed for %s to %s.<br /><br />
-	`, reservation.FirstName, reservation.StartDate.Format("2006-01-02"), reservation.EndDate.Format("2006-01-02"))
+	Your reservation for the %s has been confirmed for %s to %s.<br /><br />
+	Total price: <strong>%s</strong>%s<br /><br />
+	Your confirmation code is <strong>%s</strong>. To view or cancel your booking, go to
+	<a href="%s">%s</a> and enter it with this email address.<br />
+	`, template.HTMLEscapeString(reservation.FirstName), template.HTMLEscapeString(reservation.Room.RoomName),
+		reservation.StartDate.Format("2006-01-02"), reservation.EndDate.Format("2006-01-02"),
+		reservation.Price(), template.HTMLEscapeString(savings), reservation.ConfirmationCode, link, link)
 
 	msg := data.MailData{
 		To:       reservation.Email,
-		From:     "me@here.com",
+		From:     m.app.Settings.Mail.From,
 		Subject:  "Reservation Confirmation",
 		Content:  template.HTML(htmlMessage),
 		Template: "dunky.html",
 	}
-	m.app.MailChan <- msg
+	m.sendMail(r, msg)
+}
 
-	m.app.Session.Put(r.Context(), "reservation", reservation)
+// mailQueueWait is how long sendMail waits for room in a full mail queue before dropping the message
+const mailQueueWait = 5 * time.Second
 
-	http.Redirect(w, r, "/reservation-summary", http.StatusSeeOther)
+// sendMail queues the message for the mail listener, linking its send span back to the request.
+// A full queue is waited on for up to mailQueueWait, even if the guest goes away meanwhile, as
+// the change the mail reports has been made. If it stays full, e.g. because the listener has
+// stopped for shutdown, the message is dropped and logged rather than holding up the request.
+func (m *Repository) sendMail(r *http.Request, msg data.MailData) {
+	msg.SpanContext = trace.SpanContextFromContext(r.Context())
+
+	select {
+	case m.app.MailChan <- msg:
+		return
+	default:
+	}
+
+	timer := time.NewTimer(mailQueueWait)
+	defer timer.Stop()
+	select {
+	case m.app.MailChan <- msg:
+		return
+	case <-timer.C:
+	}
+	m.metrics.MailFailed.Inc()
+	m.app.ErrorLog.Printf("Dropped mail to %s (%q): the mail queue was still full after %s", msg.To, msg.Subject, mailQueueWait)
+}
+
+// primaryReadWindow is how long after saving something a user's pages read from the primary, so
+// they show the change even if a read replica hasn't caught up with it yet
+const primaryReadWindow = 10 * time.Second
+
+// readOwnWrites makes the session's next pages, e.g. the list an admin is sent back to after
+// saving, read from the primary for primaryReadWindow
+func (m *Repository) readOwnWrites(ctx context.Context) {
+	m.app.Session.Put(ctx, "primary_reads_until", time.Now().Add(primaryReadWindow).Unix())
+}
+
+// readContext returns the request's context for read-only queries. It reads from the primary
+// if the session saved something within primaryReadWindow.
+func (m *Repository) readContext(r *http.Request) context.Context {
+	ctx := r.Context()
+	if time.Now().Unix() < m.app.Session.GetInt64(ctx, "primary_reads_until") {
+		return repository.WithPrimaryReads(ctx)
+	}
+	return ctx
+}
+
+// continuePage moves the browser on with a same-site navigation, so the SameSite=Strict session
+// cookie is sent on the next page after a redirect back from another site
+var continuePage = template.Must(template.New("continue").Parse(
+	`<!doctype html><meta http-equiv="refresh" content="0;url={{.}}"><a href="{{.}}">Continue</a>`))
+
+// continueTo ends a request that came from another site by sending the browser to target
+func (m *Repository) continueTo(w http.ResponseWriter, target string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := continuePage.Execute(w, target); err != nil {
+		m.app.ErrorLog.Printf("Failed to write redirect to %s: %v", target, err)
+	}
 }
 
 // ReservationSummary displays the reservation summary page
@@ -472,6 +637,8 @@ func (m *Repository) ReservationSummary(w http.ResponseWriter, r *http.Request)
 
 	dataMap := make(map[string]interface{})
 	dataMap["reservation"] = reservation
+	// Anonymous guests are offered an account so they can find this booking later
+	dataMap["CanRegister"] = !m.helpers.IsAuthenticated(r)
 
 	sd := reservation.StartDate.Format("2006-01-02")
 	ed := reservation.EndDate.Format("2006-01-02")
@@ -479,17 +646,18 @@ func (m *Repository) ReservationSummary(w http.ResponseWriter, r *http.Request)
 	stringMap["start_date"] = sd
 	stringMap["end_date"] = ed
 
-	render.TemplateCache(w, r, "reservation-summary.page.tmpl", &data.TemplateData{
+	m.render.TemplateCache(w, r, "reservation-summary.page.tmpl", &data.TemplateData{
 		Data:      dataMap,
 		StringMap: stringMap,
 	})
 }
 
 func (m *Repository) ShowLoginHandler(w http.ResponseWriter, r *http.Request) {
-	render.TemplateCache(w, r, "login.page.tmpl", &data.TemplateData{
+	m.render.TemplateCache(w, r, "login.page.tmpl", &data.TemplateData{
 		Form: forms.New(nil),
 		Data: map[string]interface{}{
-			"Title": "Login",
+			"Title":   "Login",
+			"SSOName": m.ssoName(),
 		},
 	})
 }
@@ -503,34 +671,95 @@ func (m *Repository) PostLoginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	email := r.Form.Get("email")
+	email := strings.ToLower(strings.TrimSpace(r.Form.Get("email")))
 	password := r.Form.Get("password")
+	remember := r.Form.Get("remember") == "on"
 	form := forms.New(r.PostForm)
 	form.Required("email", "password")
 
 	if !form.Valid() {
-		render.TemplateCache(w, r, "login.page.tmpl", &data.TemplateData{
+		m.render.TemplateCache(w, r, "login.page.tmpl", &data.TemplateData{
 			Form: form,
 			Data: map[string]interface{}{
-				"Title": "Login",
+				"Title":   "Login",
+				"SSOName": m.ssoName(),
 			},
 		})
 		return
 	}
 
-	id, _, err := m.db.Authenticate(email, password)
+	attempt := data.LoginAttempt{
+		Email:     email,
+		IPAddress: helpers.ClientIP(r),
+		UserAgent: r.UserAgent(),
+	}
+
+	// Refuse locked accounts and blocked addresses before checking the password
+	outcome, unlock, err := m.loginBlocked(r.Context(), attempt)
 	if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+	defer unlock()
+	if outcome != "" {
+		attempt.Outcome = outcome
+		m.recordLoginAttempt(r.Context(), attempt)
+		m.app.Session.Put(r.Context(), "error", "Too many failed login attempts. Please try again later.")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	user, err := m.db.Authenticate(r.Context(), email, password)
+	if errors.Is(err, repository.ErrUserInactive) {
+		attempt.Outcome = data.LoginInactive
+		m.recordLoginAttempt(r.Context(), attempt)
+		m.app.Session.Put(r.Context(), "error", "This account has been deactivated")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	} else if err != nil {
+		if !errors.Is(err, repository.ErrInvalidCredentials) {
+			m.helpers.ServerError(w, err)
+			return
+		}
+		attempt.Outcome = data.LoginFailed
+		m.recordLoginAttempt(r.Context(), attempt)
+		unlock()
+		m.loginFailed(r, attempt)
 		m.app.Session.Put(r.Context(), "error", "can't authenticate user!")
 		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
 		return
 	}
 
-	m.app.Session.Put(r.Context(), "user_id", id)
+	attempt.UserId = user.Id
+
+	// Users with two-factor turned on aren't logged in until they enter a code
+	if user.TOTPEnabled {
+		attempt.Outcome = data.LoginTwoFactorRequired
+		m.recordLoginAttempt(r.Context(), attempt)
+		m.startTwoFactor(r.Context(), user, remember)
+		http.Redirect(w, r, "/user/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	attempt.Outcome = data.LoginSucceeded
+	m.recordLoginAttempt(r.Context(), attempt)
+
+	if err := m.completeLogin(r, user); err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+	if remember {
+		if err := m.rememberUser(w, r, user.Id); err != nil {
+			m.app.ErrorLog.Printf("Failed to remember device for user %d: %v", user.Id, err)
+		}
+	}
 	m.app.Session.Put(r.Context(), "flash", "Logged in successfully")
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
 func (m *Repository) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	m.forgetDevice(w, r)
+	m.untrackSession(r.Context(), m.app.Session.Token(r.Context()))
 	_ = m.app.Session.Destroy(r.Context())
 	_ = m.app.Session.RenewToken(r.Context())
 	m.app.Session.Put(r.Context(), "flash", "Logged out successfully")
@@ -538,7 +767,7 @@ func (m *Repository) LogoutHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (m *Repository) AdminDashboardHandler(w http.ResponseWriter, r *http.Request) {
-	render.TemplateCache(w, r, "admin-dashboard.page.tmpl", &data.TemplateData{
+	m.render.TemplateCache(w, r, "admin-dashboard.page.tmpl", &data.TemplateData{
 		Data: map[string]interface{}{
 			"Title": "Admin Dashboard",
 		},
@@ -0,0 +1,489 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dunky-star/modern-webapp-golang/internal/config"
+	"github.com/dunky-star/modern-webapp-golang/internal/data"
+	"github.com/dunky-star/modern-webapp-golang/internal/helpers"
+	"github.com/dunky-star/modern-webapp-golang/internal/metrics"
+	"github.com/dunky-star/modern-webapp-golang/internal/pricing"
+	"github.com/dunky-star/modern-webapp-golang/internal/render"
+	"github.com/dunky-star/modern-webapp-golang/internal/repository"
+	"github.com/dunky-star/modern-webapp-golang/internal/tracing"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// fakeDB keeps the tables the handler tests touch in memory. Calling any other method panics
+// on the nil embedded interface, so a test notices when a handler needs more.
+type fakeDB struct {
+	repository.DatabaseConn
+
+	mu       sync.Mutex
+	users    map[int]data.User
+	subjects map[string]int
+	attempts []data.LoginAttempt
+	conns    chan struct{}  // When set, login queries each hold a slot for the call, like a pooled connection
+	sessions map[string]int // Session index: token to user id
+
+	rooms        map[int]data.Room
+	reservations map[int]data.Reservation
+	restrictions []data.RoomRestriction
+	payments     map[int]data.Payment
+	confirmErr   error  // Returned once by the next ConfirmReservation
+	afterClaim   func() // Called once a payment is claimed, e.g. to have the guest disconnect
+}
+
+func newFakeDB() *fakeDB {
+	return &fakeDB{
+		users:        make(map[int]data.User),
+		subjects:     make(map[string]int),
+		sessions:     make(map[string]int),
+		rooms:        make(map[int]data.Room),
+		reservations: make(map[int]data.Reservation),
+		payments:     make(map[int]data.Payment),
+	}
+}
+
+func (db *fakeDB) addUser(u data.User) data.User {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	u.Id = len(db.users) + 1
+	db.users[u.Id] = u
+	return u
+}
+
+func (db *fakeDB) GetUserByID(_ context.Context, id int) (data.User, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	u, ok := db.users[id]
+	if !ok {
+		return data.User{}, repository.ErrUserNotFound
+	}
+	return u, nil
+}
+
+func (db *fakeDB) GetUserByEmail(ctx context.Context, email string) (data.User, error) {
+	release, err := db.conn(ctx)
+	if err != nil {
+		return data.User{}, err
+	}
+	defer release()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, u := range db.users {
+		if u.Email == email {
+			return u, nil
+		}
+	}
+	return data.User{}, repository.ErrUserNotFound
+}
+
+func (db *fakeDB) InsertUser(_ context.Context, u data.User, _ string) (int, error) {
+	return db.addUser(u).Id, nil
+}
+
+func (db *fakeDB) GetUserByOIDCSubject(_ context.Context, subject string) (data.User, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	id, ok := db.subjects[subject]
+	if !ok {
+		return data.User{}, repository.ErrUserNotFound
+	}
+	return db.users[id], nil
+}
+
+func (db *fakeDB) LinkOIDCSubject(_ context.Context, userID int, subject string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for s, id := range db.subjects {
+		if id == userID && s != subject {
+			return repository.ErrSubjectLinked
+		}
+	}
+	db.subjects[subject] = userID
+	return nil
+}
+
+func (db *fakeDB) InsertUserSession(_ context.Context, userID int, token string, _ time.Time) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.sessions[token] = userID
+	return nil
+}
+
+func (db *fakeDB) UserSessionTokens(_ context.Context, userID int) ([]string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var tokens []string
+	for token, id := range db.sessions {
+		if id == userID {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens, nil
+}
+
+func (db *fakeDB) DeleteUserSession(_ context.Context, token string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	delete(db.sessions, token)
+	return nil
+}
+
+func (db *fakeDB) CountRememberTokens(context.Context, int) (int, error) {
+	return 0, nil
+}
+
+// conn waits for a free connection when the fake has a limited pool, failing like a query timeout
+func (db *fakeDB) conn(ctx context.Context) (release func(), err error) {
+	if db.conns == nil {
+		return func() {}, nil
+	}
+	select {
+	case db.conns <- struct{}{}:
+		return func() { <-db.conns }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(time.Second):
+		return nil, errors.New("timed out waiting for a connection")
+	}
+}
+
+func (db *fakeDB) Authenticate(ctx context.Context, email, testPassword string) (data.User, error) {
+	release, err := db.conn(ctx)
+	if err != nil {
+		return data.User{}, err
+	}
+	defer release()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, u := range db.users {
+		if !strings.EqualFold(u.Email, email) {
+			continue
+		}
+		if bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(testPassword)) != nil {
+			return data.User{}, repository.ErrInvalidCredentials
+		}
+		if !u.Active {
+			return data.User{}, repository.ErrUserInactive
+		}
+		return u, nil
+	}
+	return data.User{}, repository.ErrInvalidCredentials
+}
+
+func (db *fakeDB) InsertLoginAttempt(ctx context.Context, a data.LoginAttempt) error {
+	release, err := db.conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	a.CreatedAt = time.Now()
+	db.attempts = append(db.attempts, a)
+	return nil
+}
+
+// loginAttempts returns the recorded attempts
+func (db *fakeDB) loginAttempts() []data.LoginAttempt {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return append([]data.LoginAttempt(nil), db.attempts...)
+}
+
+// countFailures counts the matching failed attempts since the given time, starting again after
+// each success if resetOnSuccess is set
+func (db *fakeDB) countFailures(match func(data.LoginAttempt) bool, since time.Time, resetOnSuccess bool) (int, time.Time) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var count int
+	var last time.Time
+	for _, a := range db.attempts {
+		if !match(a) || !a.CreatedAt.After(since) {
+			continue
+		}
+		switch a.Outcome {
+		case data.LoginFailed, data.LoginTwoFactorFailed:
+			count++
+			last = a.CreatedAt
+		case data.LoginSucceeded:
+			if resetOnSuccess {
+				count = 0
+			}
+		}
+	}
+	return count, last
+}
+
+func (db *fakeDB) CountLoginFailures(ctx context.Context, email string, since time.Time) (int, time.Time, error) {
+	release, err := db.conn(ctx)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	defer release()
+	count, last := db.countFailures(func(a data.LoginAttempt) bool { return a.Email == email }, since, true)
+	return count, last, nil
+}
+
+func (db *fakeDB) CountIPLoginFailures(ctx context.Context, ip string, since time.Time) (int, error) {
+	release, err := db.conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	count, _ := db.countFailures(func(a data.LoginAttempt) bool { return a.IPAddress == ip }, since, false)
+	return count, nil
+}
+
+func (db *fakeDB) GetRoomByID(_ context.Context, id int) (data.Room, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	room, ok := db.rooms[id]
+	if !ok {
+		return data.Room{}, errors.New("room not found")
+	}
+	return room, nil
+}
+
+func (db *fakeDB) RoomRateOverrides(context.Context, int, time.Time, time.Time) ([]data.RateOverride, error) {
+	return nil, nil
+}
+
+func (db *fakeDB) InsertReservation(_ context.Context, res data.Reservation) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	res.Id = len(db.reservations) + 1
+	db.reservations[res.Id] = res
+	return res.Id, nil
+}
+
+func (db *fakeDB) GetReservationByID(_ context.Context, id int) (data.Reservation, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	res, ok := db.reservations[id]
+	if !ok {
+		return data.Reservation{}, repository.ErrReservationNotFound
+	}
+	res.Room = db.rooms[res.RoomId]
+	return res, nil
+}
+
+// roomBooked reports whether the room has a restriction overlapping start to end
+func (db *fakeDB) roomBooked(roomID int, start, end time.Time) bool {
+	for _, rr := range db.restrictions {
+		if rr.RoomId == roomID && start.Before(rr.EndDate) && end.After(rr.StartDate) {
+			return true
+		}
+	}
+	return false
+}
+
+func (db *fakeDB) ConfirmReservation(ctx context.Context, id, paymentID int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.confirmErr; err != nil {
+		db.confirmErr = nil
+		return err
+	}
+
+	res, ok := db.reservations[id]
+	if !ok || res.CancelledAt != nil || res.ConfirmedAt != nil {
+		return repository.ErrReservationNotFound
+	}
+	if db.roomBooked(res.RoomId, res.StartDate, res.EndDate) {
+		return repository.ErrRoomUnavailable
+	}
+
+	db.restrictions = append(db.restrictions, data.RoomRestriction{
+		RoomId: res.RoomId, ReservationId: id, StartDate: res.StartDate, EndDate: res.EndDate, RestrictionId: 1,
+	})
+	now := time.Now()
+	res.ConfirmedAt = &now
+	db.reservations[id] = res
+	if paymentID != 0 {
+		p := db.payments[paymentID]
+		p.Status = data.PaymentCaptured
+		db.payments[paymentID] = p
+	}
+	return nil
+}
+
+func (db *fakeDB) CancelReservation(_ context.Context, id int) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	res, ok := db.reservations[id]
+	if !ok || res.CancelledAt != nil {
+		return repository.ErrReservationNotFound
+	}
+	now := time.Now()
+	res.CancelledAt = &now
+	db.reservations[id] = res
+
+	kept := db.restrictions[:0]
+	for _, rr := range db.restrictions {
+		if rr.ReservationId != id {
+			kept = append(kept, rr)
+		}
+	}
+	db.restrictions = kept
+	return nil
+}
+
+func (db *fakeDB) InsertPayment(_ context.Context, p data.Payment) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	p.Id = len(db.payments) + 1
+	p.UpdatedAt = time.Now()
+	db.payments[p.Id] = p
+	return p.Id, nil
+}
+
+func (db *fakeDB) GetPaymentByIntent(_ context.Context, provider, intentID string) (data.Payment, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, p := range db.payments {
+		if p.Provider == provider && p.IntentId == intentID {
+			return p, nil
+		}
+	}
+	return data.Payment{}, repository.ErrPaymentNotFound
+}
+
+func (db *fakeDB) GetReservationPayment(_ context.Context, reservationID int) (data.Payment, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var latest data.Payment
+	for _, p := range db.payments {
+		if p.ReservationId == reservationID && p.Id > latest.Id {
+			latest = p
+		}
+	}
+	if latest.Id == 0 {
+		return data.Payment{}, repository.ErrPaymentNotFound
+	}
+	return latest, nil
+}
+
+func (db *fakeDB) ClaimPayment(_ context.Context, id int, staleAfter time.Duration) (data.Payment, bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	p, ok := db.payments[id]
+	if !ok {
+		return data.Payment{}, false, repository.ErrPaymentNotFound
+	}
+	if p.Status == data.PaymentPending || p.Status == data.PaymentUnconfirmed ||
+		(p.Status == data.PaymentCapturing && time.Since(p.UpdatedAt) > staleAfter) {
+		claimed := p
+		claimed.Status, claimed.UpdatedAt = data.PaymentCapturing, time.Now()
+		db.payments[id] = claimed
+		if db.afterClaim != nil {
+			db.afterClaim()
+		}
+		return p, true, nil
+	}
+	return p, false, nil
+}
+
+func (db *fakeDB) SetPaymentStatus(ctx context.Context, id int, status string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	p := db.payments[id]
+	p.Status, p.UpdatedAt = status, time.Now()
+	db.payments[id] = p
+	return nil
+}
+
+// newTestRepo returns handlers on top of db with quiet logs and an in-memory session store
+func newTestRepo(t *testing.T, db repository.DatabaseConn, s config.Settings) *Repository {
+	t.Helper()
+	app, err := config.New(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	quiet := log.New(io.Discard, "", 0)
+	app.InfoLog, app.ErrorLog, app.WarningLog = quiet, quiet, quiet
+	app.MailChan = make(chan data.MailData, 10)
+
+	return &Repository{
+		app:     app,
+		db:      db,
+		render:  render.New(app, tracing.Disabled()),
+		helpers: helpers.New(app),
+		metrics: metrics.New(),
+		pricing: pricing.New(db, s.Reservations.Currency),
+	}
+}
+
+// newSession returns a context holding a new, empty session
+func (m *Repository) newSession(t *testing.T) context.Context {
+	t.Helper()
+	ctx, err := m.app.Session.Load(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ctx
+}
+
+// serve runs the handler with a fresh session and returns the response and the session's context
+func (m *Repository) serve(t *testing.T, h http.HandlerFunc, r *http.Request) (*httptest.ResponseRecorder, context.Context) {
+	t.Helper()
+	ctx := m.newSession(t)
+	return m.serveIn(ctx, h, r), ctx
+}
+
+// serveIn runs the handler in the session held by ctx, so requests can share one session
+func (m *Repository) serveIn(ctx context.Context, h http.HandlerFunc, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h(w, r.WithContext(ctx))
+	return w
+}
+
+func TestSendMailAfterGuestLeaves(t *testing.T) {
+	m := newTestRepo(t, newFakeDB(), config.DefaultSettings())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := httptest.NewRequest(http.MethodPost, "/", nil).WithContext(ctx)
+
+	for i := 0; i < cap(m.app.MailChan); i++ {
+		m.sendMail(r, data.MailData{To: "ada@example.com"})
+	}
+	if got := len(m.app.MailChan); got != cap(m.app.MailChan) {
+		t.Errorf("queued %d mails, want %d", got, cap(m.app.MailChan))
+	}
+}
+
+func TestReadOwnWritesFromPrimary(t *testing.T) {
+	m := newTestRepo(t, newFakeDB(), config.DefaultSettings())
+	ctx := m.newSession(t)
+	r := httptest.NewRequest(http.MethodGet, "/admin/users", nil).WithContext(ctx)
+
+	if repository.PrimaryReads(m.readContext(r)) {
+		t.Error("read from the primary before saving anything")
+	}
+	m.readOwnWrites(ctx)
+	if !repository.PrimaryReads(m.readContext(r)) {
+		t.Error("read from a replica straight after saving")
+	}
+
+	m.app.Session.Put(ctx, "primary_reads_until", time.Now().Add(-time.Second).Unix())
+	if repository.PrimaryReads(m.readContext(r)) {
+		t.Error("still reading from the primary after primaryReadWindow")
+	}
+}
@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// HealthDetailsKey is the context key middleware sets on readiness requests allowed to see
+// each check's errors and details. Everyone else only gets the status of each check.
+type HealthDetailsKey struct{}
+
+// readinessCheckTimeout bounds each dependency check so a hung dependency can't hang the probe
+const readinessCheckTimeout = 2 * time.Second
+
+// checkResult is the outcome of a single readiness check
+type checkResult struct {
+	Status  string                 `json:"status"`
+	Error   string                 `json:"error,omitempty"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+func (c checkResult) healthy() bool {
+	return c.Status == "ok"
+}
+
+// LivenessHandler reports whether the process is up and serving requests.
+// It deliberately checks no dependencies so a database outage doesn't get the process restarted.
+func (m *Repository) LivenessHandler(w http.ResponseWriter, r *http.Request) {
+	m.writeHealthJSON(w, http.StatusOK, map[string]interface{}{
+		"status":    "alive",
+		"version":   m.app.Version,
+		"uptime":    time.Since(m.app.StartTime).Truncate(time.Second).String(),
+		"timestamp": time.Now().Format(time.RFC3339),
+	})
+}
+
+// ReadinessHandler reports whether the application can serve traffic.
+// Returns 503 if the database, mail or template checks fail. A failing read replica only makes
+// the status "degraded", as taking every instance out of rotation over it would also stop logins
+// and everything else that only needs the primary. Errors and details of each check are only
+// included for clients allowed to see them.
+func (m *Repository) ReadinessHandler(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]checkResult{
+		"database":  m.checkDatabase(r.Context(), m.driver.Primary()),
+		"mail":      m.checkMail(r.Context()),
+		"templates": m.checkTemplates(),
+	}
+
+	status := "ready"
+	code := http.StatusOK
+	for _, c := range checks {
+		if !c.healthy() {
+			status = "unavailable"
+			code = http.StatusServiceUnavailable
+			break
+		}
+	}
+
+	if replica := m.driver.Replica(); replica != nil {
+		checks["database_replica"] = m.checkDatabase(r.Context(), replica)
+		if !checks["database_replica"].healthy() && code == http.StatusOK {
+			status = "degraded"
+		}
+	}
+
+	if detailed, _ := r.Context().Value(HealthDetailsKey{}).(bool); !detailed {
+		for name, c := range checks {
+			checks[name] = checkResult{Status: c.Status}
+		}
+	}
+
+	m.writeHealthJSON(w, code, map[string]interface{}{
+		"status":    status,
+		"version":   m.app.Version,
+		"checks":    checks,
+		"timestamp": time.Now().Format(time.RFC3339),
+	})
+}
+
+// checkDatabase pings the pool and reports its connection stats
+func (m *Repository) checkDatabase(ctx context.Context, pool *pgxpool.Pool) checkResult {
+	if pool == nil {
+		return checkResult{Status: "fail", Error: "database pool not initialized"}
+	}
+
+	stat := pool.Stat()
+	details := map[string]interface{}{
+		"acquired_conns": stat.AcquiredConns(),
+		"idle_conns":     stat.IdleConns(),
+		"total_conns":    stat.TotalConns(),
+		"max_conns":      stat.MaxConns(),
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, readinessCheckTimeout)
+	defer cancel()
+
+	start := time.Now()
+	if err := pool.Ping(ctx); err != nil {
+		return checkResult{Status: "fail", Error: fmt.Sprintf("ping failed: %v", err), Details: details}
+	}
+	details["ping"] = time.Since(start).String()
+
+	return checkResult{Status: "ok", Details: details}
+}
+
+// checkMail reports whether the mail worker is running, the mail queue depth and whether the
+// SMTP server accepts connections. A full queue also means the mail worker has stalled.
+func (m *Repository) checkMail(ctx context.Context) checkResult {
+	depth, capacity := len(m.app.MailChan), cap(m.app.MailChan)
+	details := map[string]interface{}{
+		"queue_depth":    depth,
+		"queue_capacity": capacity,
+	}
+
+	if m.app.MailAlive == nil || !m.app.MailAlive() {
+		return checkResult{Status: "fail", Error: "mail worker is not running", Details: details}
+	}
+	if capacity > 0 && depth >= capacity {
+		return checkResult{Status: "fail", Error: "mail queue is full", Details: details}
+	}
+
+	addr := net.JoinHostPort(m.app.SMTPHost, strconv.Itoa(m.app.SMTPPort))
+	details["smtp"] = addr
+
+	dialer := net.Dialer{Timeout: readinessCheckTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return checkResult{Status: "fail", Error: fmt.Sprintf("smtp unreachable: %v", err), Details: details}
+	}
+	conn.Close()
+
+	return checkResult{Status: "ok", Details: details}
+}
+
+// checkTemplates verifies that the template cache has been built
+func (m *Repository) checkTemplates() checkResult {
+	count := len(m.app.TemplateCache)
+	details := map[string]interface{}{
+		"loaded": count,
+	}
+	if count == 0 {
+		return checkResult{Status: "fail", Error: "no templates loaded", Details: details}
+	}
+	return checkResult{Status: "ok", Details: details}
+}
+
+// writeHealthJSON writes a pretty-printed JSON health response with the given status code
+func (m *Repository) writeHealthJSON(w http.ResponseWriter, code int, body interface{}) {
+	out, err := json.MarshalIndent(body, "", "  ")
+	if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	w.Write(out)
+}
@@ -0,0 +1,250 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dunky-star/modern-webapp-golang/internal/config"
+	"github.com/dunky-star/modern-webapp-golang/internal/data"
+	"github.com/dunky-star/modern-webapp-golang/internal/helpers"
+	"github.com/dunky-star/modern-webapp-golang/internal/oidcauth"
+	"github.com/dunky-star/modern-webapp-golang/internal/repository"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// oidcCookie holds "state:nonce:verifier" while the user signs in at the provider.
+	// The session cookie is SameSite=Strict, so it isn't sent on the provider's redirect back.
+	oidcCookie = "oidc_login"
+	// oidcTimeout is how long a user has to sign in at the provider before the attempt expires
+	oidcTimeout = 10 * time.Minute
+)
+
+// ssoName is the provider name for the login page's single sign-on button, or "" when it's off
+func (m *Repository) ssoName() string {
+	if m.oidc == nil {
+		return ""
+	}
+	return m.oidc.ProviderName()
+}
+
+// OIDCLoginHandler sends the user to the identity provider to sign in
+func (m *Repository) OIDCLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if m.oidc == nil {
+		m.helpers.ClientError(w, http.StatusNotFound)
+		return
+	}
+
+	state, _, err := helpers.NewToken()
+	if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+	nonce, _, err := helpers.NewToken()
+	if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	authURL, err := m.oidc.AuthCodeURL(r.Context(), state, nonce, verifier)
+	if err != nil {
+		m.app.ErrorLog.Printf("Failed to start single sign-on: %v", err)
+		m.app.Session.Put(r.Context(), "error", "Single sign-on is unavailable right now. Please try again later.")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	m.setOIDCCookie(w, state+":"+nonce+":"+verifier, int(oidcTimeout.Seconds()))
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// setOIDCCookie writes (or with maxAge -1, removes) the cookie for a sign-in in progress. It's
+// SameSite=Lax so it comes back on the provider's top-level redirect to the callback.
+func (m *Repository) setOIDCCookie(w http.ResponseWriter, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookie,
+		Value:    value,
+		Path:     oidcauth.CallbackPath,
+		HttpOnly: true,
+		Secure:   config.IsSecureCookie(m.app.Env),
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   maxAge,
+	})
+}
+
+// OIDCCallbackHandler logs in the user the identity provider sent back, matching them to an
+// existing user by verified email and optionally creating one
+func (m *Repository) OIDCCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if m.oidc == nil {
+		m.helpers.ClientError(w, http.StatusNotFound)
+		return
+	}
+
+	ctx := r.Context()
+	var state, nonce, verifier string
+	if c, err := r.Cookie(oidcCookie); err == nil {
+		parts := strings.Split(c.Value, ":")
+		if len(parts) == 3 {
+			state, nonce, verifier = parts[0], parts[1], parts[2]
+		}
+	}
+	// Each sign-in attempt can only be completed once
+	m.setOIDCCookie(w, "", -1)
+
+	q := r.URL.Query()
+	if state == "" || subtle.ConstantTimeCompare([]byte(q.Get("state")), []byte(state)) != 1 {
+		m.app.Session.Put(ctx, "error", "Your sign-in expired. Please try again.")
+		m.continueTo(w, "/user/login")
+		return
+	}
+	if e := q.Get("error"); e != "" {
+		m.app.InfoLog.Printf("Single sign-on was refused by the provider: %s %s", e, q.Get("error_description"))
+		m.app.Session.Put(ctx, "error", "Single sign-on was cancelled")
+		m.continueTo(w, "/user/login")
+		return
+	}
+
+	claims, err := m.oidc.Exchange(ctx, q.Get("code"), verifier, nonce)
+	if err != nil {
+		m.app.ErrorLog.Printf("Failed to complete single sign-on: %v", err)
+		m.app.Session.Put(ctx, "error", "Single sign-on failed. Please try again.")
+		m.continueTo(w, "/user/login")
+		return
+	}
+
+	attempt := data.LoginAttempt{
+		Email:     strings.ToLower(strings.TrimSpace(claims.Email)),
+		IPAddress: helpers.ClientIP(r),
+		UserAgent: r.UserAgent(),
+	}
+	deny := func(reason, message string) {
+		attempt.Outcome = data.LoginSSODenied
+		m.recordLoginAttempt(ctx, attempt)
+		m.app.WarningLog.Printf("Refused single sign-on for %q (%s): %s", attempt.Email, claims.Key(), reason)
+		m.app.Session.Put(ctx, "error", message)
+		m.continueTo(w, "/user/login")
+	}
+
+	// An unverified email could belong to anyone, so it can't be matched to a user
+	if attempt.Email == "" || !claims.EmailVerified {
+		deny("email not verified", "Your email address hasn't been verified by "+m.oidc.ProviderName())
+		return
+	}
+
+	user, err := m.ssoUser(r, claims, attempt.Email)
+	if errors.Is(err, repository.ErrUserNotFound) {
+		deny("no matching user", "There's no account for "+attempt.Email)
+		return
+	} else if errors.Is(err, repository.ErrSubjectLinked) {
+		// Someone else at the provider now has this email, e.g. a reused mailbox
+		deny("email linked to another subject", "This account signs on with a different "+m.oidc.ProviderName()+" login")
+		return
+	} else if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+
+	attempt.UserId = user.Id
+	if !user.Active {
+		deny("user deactivated", "This account has been deactivated")
+		return
+	}
+
+	// The provider's own second factor isn't visible to us, so users who turned on
+	// two-factor here still enter their code
+	if user.TOTPEnabled {
+		attempt.Outcome = data.LoginTwoFactorRequired
+		m.recordLoginAttempt(ctx, attempt)
+		m.startTwoFactor(ctx, user, false)
+		m.continueTo(w, "/user/two-factor")
+		return
+	}
+
+	attempt.Outcome = data.LoginSSO
+	m.recordLoginAttempt(ctx, attempt)
+
+	if err := m.completeLogin(r, user); err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+	m.app.Session.Put(ctx, "flash", "Logged in successfully")
+	m.continueTo(w, "/")
+}
+
+// ssoUser finds the user for the provider's claims: first by the subject they signed in with
+// before, then by email, linking the subject so a later email change at the provider still
+// matches. With auto-provisioning on, unknown users from allowed domains are created.
+func (m *Repository) ssoUser(r *http.Request, claims oidcauth.Claims, email string) (data.User, error) {
+	ctx := r.Context()
+	user, err := m.db.GetUserByOIDCSubject(ctx, claims.Key())
+	if !errors.Is(err, repository.ErrUserNotFound) {
+		return user, err
+	}
+
+	user, err = m.db.GetUserByEmail(ctx, email)
+	if errors.Is(err, repository.ErrUserNotFound) {
+		if !m.ssoProvisionAllowed(email) {
+			return data.User{}, err
+		}
+		user, err = m.provisionSSOUser(r, claims, email)
+	}
+	if err != nil {
+		return data.User{}, err
+	}
+
+	if err := m.db.LinkOIDCSubject(ctx, user.Id, claims.Key()); err != nil {
+		return data.User{}, err
+	}
+	return user, nil
+}
+
+// ssoProvisionAllowed reports whether a user may be created for email on their first sign-on
+func (m *Repository) ssoProvisionAllowed(email string) bool {
+	s := m.app.Settings.OIDC
+	if !s.AutoProvision {
+		return false
+	}
+	if strings.TrimSpace(s.ProvisionDomains) == "" {
+		return true
+	}
+
+	_, domain, _ := strings.Cut(email, "@")
+	for _, d := range strings.Split(s.ProvisionDomains, ",") {
+		if strings.EqualFold(strings.TrimSpace(d), domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// provisionSSOUser creates a user with the default role for a first sign-on
+func (m *Repository) provisionSSOUser(r *http.Request, claims oidcauth.Claims, email string) (data.User, error) {
+	role, err := data.ParseRole(m.app.Settings.OIDC.DefaultRole)
+	if err != nil {
+		return data.User{}, err
+	}
+
+	// SSO users sign in at the provider, but can set a local password with "forgot password"
+	password, _, err := helpers.NewToken()
+	if err != nil {
+		return data.User{}, err
+	}
+
+	user := data.User{
+		FirstName:   claims.GivenName,
+		LastName:    claims.FamilyName,
+		Email:       email,
+		AccessLevel: int(role),
+		Active:      true,
+	}
+	user.Id, err = m.db.InsertUser(r.Context(), user, password)
+	if err != nil {
+		return data.User{}, err
+	}
+	m.app.InfoLog.Printf("Created user %d for %s on first single sign-on as %s", user.Id, email, role)
+	return user, nil
+}
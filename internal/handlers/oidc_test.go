@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/dunky-star/modern-webapp-golang/internal/config"
+	"github.com/dunky-star/modern-webapp-golang/internal/data"
+	"github.com/dunky-star/modern-webapp-golang/internal/oidcauth"
+	"github.com/dunky-star/modern-webapp-golang/internal/oidcauth/oidctest"
+)
+
+// newSSORepo returns handlers signing on with a local issuer
+func newSSORepo(t *testing.T, db *fakeDB, autoProvision bool) (*Repository, *oidctest.Issuer) {
+	t.Helper()
+	issuer := oidctest.NewIssuer("bookings", "s3cret")
+	t.Cleanup(issuer.Close)
+
+	s := config.DefaultSettings()
+	s.OIDC.Issuer = issuer.URL
+	s.OIDC.ClientID = "bookings"
+	s.OIDC.ClientSecret = "s3cret"
+	s.OIDC.AutoProvision = autoProvision
+	s.OIDC.DefaultRole = data.RoleGuest.String()
+
+	m := newTestRepo(t, db, s)
+	m.oidc = oidcauth.New(s.OIDC, m.app.BaseURL)
+	return m, issuer
+}
+
+// callback returns the provider's redirect back to the app after id signed in
+func callback(issuer *oidctest.Issuer, id oidctest.Identity) *http.Request {
+	id.Nonce = "nonce-1"
+	code := issuer.Authorize(id)
+	q := url.Values{"state": {"state-1"}, "code": {code}}
+	r := httptest.NewRequest(http.MethodGet, oidcauth.CallbackPath+"?"+q.Encode(), nil)
+	r.AddCookie(&http.Cookie{Name: oidcCookie, Value: "state-1:nonce-1:verifier-1"})
+	return r
+}
+
+func TestOIDCCallbackLinksExistingUser(t *testing.T) {
+	db := newFakeDB()
+	user := db.addUser(data.User{Email: "ada@example.com", Active: true, AccessLevel: int(data.RoleStaff)})
+	m, issuer := newSSORepo(t, db, false)
+
+	// The provider may send the email in a different case
+	r := callback(issuer, oidctest.Identity{Subject: "sub-1", Email: "Ada@Example.com", EmailVerified: true})
+	_, ctx := m.serve(t, m.OIDCCallbackHandler, r)
+
+	if got := m.app.Session.GetInt(ctx, "user_id"); got != user.Id {
+		t.Fatalf("logged in user = %d, want %d", got, user.Id)
+	}
+	if got := db.subjects[issuer.URL+"|sub-1"]; got != user.Id {
+		t.Errorf("subject linked to user %d, want %d", got, user.Id)
+	}
+	if len(db.users) != 1 {
+		t.Errorf("%d users, want no new user", len(db.users))
+	}
+
+	// A later sign-on matches by subject even after the email changed at the provider
+	r = callback(issuer, oidctest.Identity{Subject: "sub-1", Email: "ada@new.example.com", EmailVerified: true})
+	_, ctx = m.serve(t, m.OIDCCallbackHandler, r)
+	if got := m.app.Session.GetInt(ctx, "user_id"); got != user.Id {
+		t.Errorf("logged in user after email change = %d, want %d", got, user.Id)
+	}
+}
+
+func TestOIDCCallbackProvisionsUser(t *testing.T) {
+	db := newFakeDB()
+	m, issuer := newSSORepo(t, db, true)
+
+	r := callback(issuer, oidctest.Identity{
+		Subject: "sub-2", Email: "grace@example.com", EmailVerified: true,
+		GivenName: "Grace", FamilyName: "Hopper",
+	})
+	_, ctx := m.serve(t, m.OIDCCallbackHandler, r)
+
+	user, err := db.GetUserByEmail(ctx, "grace@example.com")
+	if err != nil {
+		t.Fatalf("user wasn't created: %v", err)
+	}
+	if user.FirstName != "Grace" || user.LastName != "Hopper" || !user.Active || user.Role() != data.RoleGuest {
+		t.Errorf("created %+v, want an active guest named Grace Hopper", user)
+	}
+	if got := m.app.Session.GetInt(ctx, "user_id"); got != user.Id {
+		t.Errorf("logged in user = %d, want %d", got, user.Id)
+	}
+	if got := db.subjects[issuer.URL+"|sub-2"]; got != user.Id {
+		t.Errorf("subject linked to user %d, want %d", got, user.Id)
+	}
+}
+
+func TestOIDCCallbackDenied(t *testing.T) {
+	tests := []struct {
+		name string
+		id   oidctest.Identity
+	}{
+		{"unknown user without auto-provisioning", oidctest.Identity{Subject: "sub-3", Email: "eve@example.com", EmailVerified: true}},
+		{"unverified email", oidctest.Identity{Subject: "sub-4", Email: "ada@example.com"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newFakeDB()
+			db.addUser(data.User{Email: "ada@example.com", Active: true})
+			m, issuer := newSSORepo(t, db, false)
+
+			_, ctx := m.serve(t, m.OIDCCallbackHandler, callback(issuer, tt.id))
+
+			if got := m.app.Session.GetInt(ctx, "user_id"); got != 0 {
+				t.Errorf("logged in as user %d, want nobody", got)
+			}
+			if len(db.users) != 1 || len(db.subjects) != 0 {
+				t.Errorf("users = %d, linked subjects = %d; want no changes", len(db.users), len(db.subjects))
+			}
+			if n := len(db.attempts); n != 1 || db.attempts[0].Outcome != data.LoginSSODenied {
+				t.Errorf("login attempts = %+v, want one %q", db.attempts, data.LoginSSODenied)
+			}
+		})
+	}
+}
+
+func TestOIDCCallbackStateMismatch(t *testing.T) {
+	db := newFakeDB()
+	db.addUser(data.User{Email: "ada@example.com", Active: true})
+	m, issuer := newSSORepo(t, db, false)
+
+	r := callback(issuer, oidctest.Identity{Subject: "sub-1", Email: "ada@example.com", EmailVerified: true})
+	r.Header.Set("Cookie", oidcCookie+"=other:nonce-1:verifier-1")
+	_, ctx := m.serve(t, m.OIDCCallbackHandler, r)
+
+	if got := m.app.Session.GetInt(ctx, "user_id"); got != 0 {
+		t.Errorf("logged in as user %d, want nobody", got)
+	}
+}
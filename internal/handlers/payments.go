@@ -0,0 +1,414 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/dunky-star/modern-webapp-golang/internal/data"
+	"github.com/dunky-star/modern-webapp-golang/internal/payments"
+	"github.com/dunky-star/modern-webapp-golang/internal/repository"
+)
+
+const (
+	// paymentSessionKey holds the id of the reservation the guest is paying for
+	paymentSessionKey = "payment_reservation_id"
+	// claimTimeout is how long a payment can be capturing before the claim is taken over,
+	// as whoever made it must have stopped
+	claimTimeout = 5 * time.Minute
+)
+
+var (
+	// errPaymentPending means the guest hasn't paid yet, or another request is capturing the payment
+	errPaymentPending = errors.New("payment is not complete yet")
+	// errPaymentDeclined means the provider refused the payment, so the reservation was cancelled
+	errPaymentDeclined = errors.New("payment was declined")
+	// errPaymentExpired means the hold ran out (or the reservation was cancelled) before payment
+	errPaymentExpired = errors.New("reservation expired before payment")
+	// errRoomTaken means the room was booked by someone else while the guest paid, so the payment was refunded
+	errRoomTaken = errors.New("room was booked while paying")
+)
+
+// startPayment sends the guest to the payment provider to pay for the reservation, which is
+// confirmed once the payment is captured
+func (m *Repository) startPayment(w http.ResponseWriter, r *http.Request, res data.Reservation) {
+	intent, err := m.payments.CreateIntent(r.Context(), payments.IntentRequest{
+		Amount:    res.TotalPrice,
+		Currency:  res.Currency,
+		Reference: res.ConfirmationCode,
+		Description: fmt.Sprintf("%s, %s to %s", res.Room.RoomName,
+			res.StartDate.Format("2006-01-02"), res.EndDate.Format("2006-01-02")),
+		ReturnURL: m.app.BaseURL + "/reservation/payment/return?code=" + url.QueryEscape(res.ConfirmationCode),
+	})
+	if err != nil {
+		m.app.ErrorLog.Printf("Failed to start payment for reservation %d: %v", res.Id, err)
+		m.releaseReservation(r, res)
+		m.app.Session.Put(r.Context(), "error", "We can't take payments right now. Please try again later.")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	_, err = m.db.InsertPayment(r.Context(), data.Payment{
+		ReservationId: res.Id,
+		Provider:      m.payments.Name(),
+		IntentId:      intent.ID,
+		Amount:        res.TotalPrice,
+		Currency:      res.Currency,
+		Status:        data.PaymentPending,
+	})
+	if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+
+	m.app.Session.Put(r.Context(), paymentSessionKey, res.Id)
+	http.Redirect(w, r, intent.CheckoutURL, http.StatusSeeOther)
+}
+
+// PaymentReturnHandler is where the payment provider sends the guest back. The session cookie
+// isn't sent on a redirect from another site, so it moves on to PaymentCompleteHandler first.
+func (m *Repository) PaymentReturnHandler(w http.ResponseWriter, r *http.Request) {
+	m.continueTo(w, "/reservation/payment?code="+url.QueryEscape(r.URL.Query().Get("code")))
+}
+
+// PaymentCompleteHandler captures the guest's payment and confirms their reservation, or tells
+// them why it couldn't be
+func (m *Repository) PaymentCompleteHandler(w http.ResponseWriter, r *http.Request) {
+	id := m.app.Session.GetInt(r.Context(), paymentSessionKey)
+	res, err := m.db.GetReservationByID(r.Context(), id)
+	if errors.Is(err, repository.ErrReservationNotFound) || (err == nil && res.ConfirmationCode != r.URL.Query().Get("code")) {
+		m.app.Session.Put(r.Context(), "error", "We couldn't find the booking you were paying for")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	} else if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+
+	p, err := m.db.GetReservationPayment(r.Context(), res.Id)
+	if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+
+	res, err = m.capturePayment(r, p)
+	if errors.Is(err, errPaymentPending) {
+		m.app.Session.Put(r.Context(), "warning", "Your payment hasn't gone through yet. We'll email your confirmation once it has.")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	m.app.Session.Remove(r.Context(), paymentSessionKey)
+
+	switch {
+	case err == nil:
+		m.app.Session.Put(r.Context(), "reservation", res)
+		http.Redirect(w, r, "/reservation-summary", http.StatusSeeOther)
+	case errors.Is(err, errPaymentDeclined):
+		m.app.Session.Put(r.Context(), "error", "Your payment was declined, so the room hasn't been booked. Please try again.")
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+	case errors.Is(err, errPaymentExpired):
+		m.app.Session.Put(r.Context(), "error", "Your booking expired before it was paid for. Please book again.")
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+	case errors.Is(err, errRoomTaken):
+		m.app.Session.Put(r.Context(), "error", "Sorry, the room was booked by someone else while you were paying. Your payment has been refunded.")
+		http.Redirect(w, r, "/search-availability", http.StatusSeeOther)
+	default:
+		m.helpers.ServerError(w, err)
+	}
+}
+
+// PaymentWebhookHandler receives payment events from the provider, so bookings are confirmed even
+// if the guest never comes back from paying
+func (m *Repository) PaymentWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if m.payments == nil {
+		m.helpers.ClientError(w, http.StatusNotFound)
+		return
+	}
+
+	event, err := m.payments.VerifyWebhook(r)
+	if errors.Is(err, payments.ErrInvalidSignature) {
+		m.app.InfoLog.Printf("Rejected payment webhook from %s: %v", r.RemoteAddr, err)
+		m.helpers.ClientError(w, http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		m.helpers.ClientError(w, http.StatusBadRequest)
+		return
+	}
+
+	p, err := m.db.GetPaymentByIntent(r.Context(), m.payments.Name(), event.IntentID)
+	if errors.Is(err, repository.ErrPaymentNotFound) {
+		m.helpers.ClientError(w, http.StatusNotFound)
+		return
+	} else if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+
+	switch event.Type {
+	case payments.EventAuthorized:
+		_, err = m.capturePayment(r, p)
+		if errors.Is(err, errPaymentPending) || errors.Is(err, errPaymentDeclined) ||
+			errors.Is(err, errPaymentExpired) || errors.Is(err, errRoomTaken) {
+			err = nil
+		}
+	case payments.EventFailed:
+		err = m.failPayment(r, p)
+	}
+	if err != nil {
+		// The provider retries the event, which also picks up a payment captured but not yet confirmed
+		m.helpers.ServerError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// capturePayment takes the payment and confirms its reservation, returning the confirmed
+// reservation. Only one request captures a payment; others get errPaymentPending until it's done,
+// or until its claim is older than claimTimeout and is resumed from where the provider has it.
+// A payment that can't be taken, or whose room was booked meanwhile, cancels the reservation.
+// A payment taken whose room couldn't be booked is left captured but unconfirmed, and the
+// next call books the room without taking the payment again.
+func (m *Repository) capturePayment(r *http.Request, p data.Payment) (data.Reservation, error) {
+	if p.Provider != m.payments.Name() {
+		return data.Reservation{}, fmt.Errorf("payment %d was made with %s, not %s", p.Id, p.Provider, m.payments.Name())
+	}
+
+	claimed, ok, err := m.db.ClaimPayment(r.Context(), p.Id, claimTimeout)
+	if err != nil {
+		return data.Reservation{}, err
+	}
+	if !ok {
+		switch claimed.Status {
+		case data.PaymentCaptured:
+			return m.db.GetReservationByID(r.Context(), p.ReservationId)
+		case data.PaymentCapturing:
+			return data.Reservation{}, errPaymentPending
+		default:
+			return data.Reservation{}, errPaymentDeclined
+		}
+	}
+
+	// Finish once claimed even if the guest goes away, so the payment isn't left capturing
+	r = r.WithContext(context.WithoutCancel(r.Context()))
+
+	if claimed.Status == data.PaymentCapturing {
+		m.app.WarningLog.Printf("Resuming payment %d, claimed at %s but never finished", p.Id, claimed.UpdatedAt.Format(time.RFC3339))
+		claimed.Status, err = m.resumedStatus(r, p)
+		if errors.Is(err, errRoomTaken) {
+			return data.Reservation{}, err
+		} else if err != nil {
+			m.unclaimPayment(r, claimed)
+			return data.Reservation{}, err
+		}
+	}
+
+	res, err := m.db.GetReservationByID(r.Context(), p.ReservationId)
+	if err != nil {
+		m.unclaimPayment(r, claimed)
+		return data.Reservation{}, err
+	}
+
+	if claimed.Status == data.PaymentPending {
+		if res.CancelledAt != nil || (res.HoldUntil != nil && time.Now().After(*res.HoldUntil)) {
+			m.setPaymentStatus(r, p, data.PaymentFailed)
+			m.releaseReservation(r, res)
+			m.metrics.Payments.WithLabelValues("expired").Inc()
+			return data.Reservation{}, errPaymentExpired
+		}
+
+		err = m.payments.Capture(r.Context(), p.IntentId)
+		if errors.Is(err, payments.ErrDeclined) {
+			m.setPaymentStatus(r, p, data.PaymentFailed)
+			m.releaseReservation(r, res)
+			m.metrics.Payments.WithLabelValues("declined").Inc()
+			return data.Reservation{}, errPaymentDeclined
+		} else if errors.Is(err, payments.ErrNotAuthorized) {
+			m.unclaimPayment(r, claimed)
+			return data.Reservation{}, errPaymentPending
+		} else if err != nil {
+			m.unclaimPayment(r, claimed)
+			return data.Reservation{}, err
+		}
+	} else if res.ConfirmedAt != nil {
+		// An earlier attempt booked the room but couldn't tell
+		m.setPaymentStatus(r, p, data.PaymentCaptured)
+		return res, nil
+	}
+
+	err = m.db.ConfirmReservation(r.Context(), res.Id, p.Id)
+	if errors.Is(err, repository.ErrRoomUnavailable) || errors.Is(err, repository.ErrReservationNotFound) {
+		// Someone else booked the room, or the guest's hold was cancelled, while they paid
+		if err := m.payments.Refund(r.Context(), p.IntentId, p.Amount); err != nil {
+			m.setPaymentStatus(r, p, data.PaymentRefundFailed)
+			m.app.ErrorLog.Printf("Failed to refund payment %d for reservation %d, refund it manually: %v", p.Id, res.Id, err)
+		} else {
+			m.setPaymentStatus(r, p, data.PaymentRefunded)
+			m.metrics.Payments.WithLabelValues("refunded").Inc()
+		}
+		m.releaseReservation(r, res)
+		return data.Reservation{}, errRoomTaken
+	} else if err != nil {
+		m.setPaymentStatus(r, p, data.PaymentUnconfirmed)
+		m.app.ErrorLog.Printf("Payment %d was captured but reservation %d couldn't be confirmed yet", p.Id, res.Id)
+		return data.Reservation{}, err
+	}
+	m.metrics.Payments.WithLabelValues("captured").Inc()
+	m.app.InfoLog.Printf("Captured payment %d for reservation %d", p.Id, res.Id)
+
+	m.reservationConfirmed(r, res)
+	return res, nil
+}
+
+// resumedStatus works out from the provider how far a claim that was never finished got: captured
+// but unconfirmed if the money was taken, otherwise pending. A payment that was already refunded
+// because its room was taken is marked refunded, its reservation released and errRoomTaken returned.
+func (m *Repository) resumedStatus(r *http.Request, p data.Payment) (string, error) {
+	state, err := m.payments.State(r.Context(), p.IntentId)
+	if err != nil {
+		return data.PaymentCapturing, err
+	}
+	switch state {
+	case payments.StateCaptured:
+		return data.PaymentUnconfirmed, nil
+	case payments.StateRefunded:
+		m.setPaymentStatus(r, p, data.PaymentRefunded)
+		if res, err := m.db.GetReservationByID(r.Context(), p.ReservationId); err == nil {
+			m.releaseReservation(r, res)
+		}
+		return data.PaymentRefunded, errRoomTaken
+	default:
+		return data.PaymentPending, nil
+	}
+}
+
+// failPayment records that the guest's payment failed and cancels its reservation
+func (m *Repository) failPayment(r *http.Request, p data.Payment) error {
+	claimed, ok, err := m.db.ClaimPayment(r.Context(), p.Id, claimTimeout)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+	r = r.WithContext(context.WithoutCancel(r.Context()))
+	if claimed.Status == data.PaymentCapturing {
+		if claimed.Status, err = m.resumedStatus(r, p); errors.Is(err, errRoomTaken) {
+			return nil
+		} else if err != nil {
+			m.unclaimPayment(r, claimed)
+			return err
+		}
+	}
+	if claimed.Status == data.PaymentUnconfirmed {
+		// The payment was already taken, so only booking the room is left to do
+		m.unclaimPayment(r, claimed)
+		return nil
+	}
+
+	m.setPaymentStatus(r, p, data.PaymentFailed)
+	m.metrics.Payments.WithLabelValues("declined").Inc()
+	res, err := m.db.GetReservationByID(r.Context(), p.ReservationId)
+	if err != nil {
+		return err
+	}
+	m.releaseReservation(r, res)
+	return nil
+}
+
+// refundReservation refunds a cancelled reservation's payment, if it was paid for
+func (m *Repository) refundReservation(r *http.Request, res data.Reservation) {
+	p, err := m.db.GetReservationPayment(r.Context(), res.Id)
+	if errors.Is(err, repository.ErrPaymentNotFound) {
+		return
+	} else if err != nil {
+		m.app.ErrorLog.Printf("Failed to load the payment for cancelled reservation %d: %v", res.Id, err)
+		return
+	}
+	if p.Status != data.PaymentCaptured && p.Status != data.PaymentUnconfirmed {
+		return
+	}
+	if m.payments == nil || p.Provider != m.payments.Name() {
+		m.app.ErrorLog.Printf("Payment %d for cancelled reservation %d was made with %s, refund it manually", p.Id, res.Id, p.Provider)
+		return
+	}
+
+	if err := m.payments.Refund(r.Context(), p.IntentId, p.Amount); err != nil {
+		m.app.ErrorLog.Printf("Failed to refund payment %d for cancelled reservation %d, refund it manually: %v", p.Id, res.Id, err)
+		return
+	}
+	m.setPaymentStatus(r, p, data.PaymentRefunded)
+	m.metrics.Payments.WithLabelValues("refunded").Inc()
+	m.app.InfoLog.Printf("Refunded payment %d for cancelled reservation %d", p.Id, res.Id)
+}
+
+// releaseReservation cancels a reservation that won't be confirmed, giving back its promo code use
+func (m *Repository) releaseReservation(r *http.Request, res data.Reservation) {
+	err := m.db.CancelReservation(r.Context(), res.Id)
+	if err != nil && !errors.Is(err, repository.ErrReservationNotFound) {
+		m.app.ErrorLog.Printf("Failed to cancel unconfirmed reservation %d: %v", res.Id, err)
+	}
+}
+
+// unclaimPayment hands a claimed payment back for another try, in the status it had before the claim
+func (m *Repository) unclaimPayment(r *http.Request, claimed data.Payment) {
+	m.setPaymentStatus(r, claimed, claimed.Status)
+}
+
+// setPaymentStatus records the payment's new status, logging rather than failing if it can't
+func (m *Repository) setPaymentStatus(r *http.Request, p data.Payment, status string) {
+	if err := m.db.SetPaymentStatus(r.Context(), p.Id, status); err != nil {
+		m.app.ErrorLog.Printf("Failed to mark payment %d %s: %v", p.Id, status, err)
+	}
+}
+
+// fakePayments returns the fake provider, or false when another provider (or none) is configured
+func (m *Repository) fakePayments() (*payments.Fake, bool) {
+	fake, ok := m.payments.(*payments.Fake)
+	return fake, ok
+}
+
+// FakeCheckoutHandler shows the fake provider's checkout page, where the guest chooses whether
+// their payment succeeds
+func (m *Repository) FakeCheckoutHandler(w http.ResponseWriter, r *http.Request) {
+	fake, ok := m.fakePayments()
+	if !ok {
+		m.helpers.ClientError(w, http.StatusNotFound)
+		return
+	}
+	intent, err := fake.Intent(r.PathValue("id"))
+	if err != nil {
+		m.helpers.ClientError(w, http.StatusNotFound)
+		return
+	}
+
+	m.render.TemplateCache(w, r, "fake-checkout.page.tmpl", &data.TemplateData{
+		Data: map[string]interface{}{
+			"Intent": intent,
+			"Amount": data.FormatMoney(intent.Amount, intent.Currency),
+		},
+	})
+}
+
+// PostFakeCheckoutHandler records the guest's choice on the fake checkout page and sends them back
+func (m *Repository) PostFakeCheckoutHandler(w http.ResponseWriter, r *http.Request) {
+	fake, ok := m.fakePayments()
+	if !ok {
+		m.helpers.ClientError(w, http.StatusNotFound)
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+
+	returnURL, err := fake.Complete(r.PathValue("id"), r.Form.Get("outcome") == "pay")
+	if err != nil {
+		m.helpers.ClientError(w, http.StatusNotFound)
+		return
+	}
+	http.Redirect(w, r, returnURL, http.StatusSeeOther)
+}
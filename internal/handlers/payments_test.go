@@ -0,0 +1,279 @@
+package handlers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dunky-star/modern-webapp-golang/internal/config"
+	"github.com/dunky-star/modern-webapp-golang/internal/data"
+	"github.com/dunky-star/modern-webapp-golang/internal/payments"
+)
+
+const webhookSecret = "whsec"
+
+// newPaymentsRepo returns handlers taking payments with the fake provider, and a room to book
+func newPaymentsRepo(t *testing.T) (*Repository, *fakeDB, *payments.Fake) {
+	t.Helper()
+	db := newFakeDB()
+	db.rooms[1] = data.Room{Id: 1, RoomName: "General's Quarters", NightlyRate: 10000}
+
+	s := config.DefaultSettings()
+	s.Payments.Provider = payments.ProviderFake
+	s.Payments.WebhookSecret = webhookSecret
+
+	m := newTestRepo(t, db, s)
+	fake := payments.NewFake(webhookSecret, m.app.BaseURL)
+	m.payments = fake
+	return m, db, fake
+}
+
+// reserve books the room for two nights a month from now and returns the session the guest
+// pays in, with the reservation and its payment
+func reserve(t *testing.T, m *Repository, db *fakeDB) (context.Context, data.Reservation, data.Payment) {
+	t.Helper()
+	start := time.Now().AddDate(0, 1, 0)
+	form := url.Values{
+		"start_date": {start.Format("2006-01-02")},
+		"end_date":   {start.AddDate(0, 0, 2).Format("2006-01-02")},
+		"room_id":    {"1"},
+		"first_name": {"Ada"},
+		"last_name":  {"Lovelace"},
+		"email":      {"ada@example.com"},
+	}
+	r := httptest.NewRequest(http.MethodPost, "/make-reservation", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	ctx := m.newSession(t)
+	w := m.serveIn(ctx, m.PostReservationHandler, r)
+	if w.Code != http.StatusSeeOther || !strings.Contains(w.Header().Get("Location"), payments.FakeCheckoutPath) {
+		t.Fatalf("reserving: %d to %q, want a redirect to the checkout page", w.Code, w.Header().Get("Location"))
+	}
+
+	res, err := db.GetReservationByID(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := db.GetReservationPayment(ctx, res.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Status != data.PaymentPending || p.Amount != 20000 {
+		t.Fatalf("payment = %+v, want 20000 pending", p)
+	}
+	if res.ConfirmedAt != nil || len(db.restrictions) != 0 {
+		t.Fatal("room was booked before the payment was captured")
+	}
+	return ctx, res, p
+}
+
+// returnFromCheckout is the guest coming back from the provider
+func returnFromCheckout(m *Repository, ctx context.Context, res data.Reservation) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/reservation/payment?code="+url.QueryEscape(res.ConfirmationCode), nil)
+	return m.serveIn(ctx, m.PaymentCompleteHandler, r)
+}
+
+// sendWebhook posts a signed event for the payment
+func sendWebhook(t *testing.T, m *Repository, event payments.EventType, p data.Payment) *httptest.ResponseRecorder {
+	t.Helper()
+	body := `{"type":"` + string(event) + `","intent_id":"` + p.IntentId + `"}`
+	mac := hmac.New(sha256.New, []byte(webhookSecret))
+	mac.Write([]byte(body))
+
+	r := httptest.NewRequest(http.MethodPost, "/payments/webhook", strings.NewReader(body))
+	r.Header.Set(payments.FakeSignatureHeader, hex.EncodeToString(mac.Sum(nil)))
+	w, _ := m.serve(t, m.PaymentWebhookHandler, r)
+	return w
+}
+
+func intentStatus(t *testing.T, fake *payments.Fake, p data.Payment) string {
+	t.Helper()
+	in, err := fake.Intent(p.IntentId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return in.Status
+}
+
+func TestPaymentCapturedBooksRoom(t *testing.T) {
+	m, db, fake := newPaymentsRepo(t)
+	ctx, res, p := reserve(t, m, db)
+
+	if _, err := fake.Complete(p.IntentId, true); err != nil {
+		t.Fatal(err)
+	}
+	// Paying alone doesn't book the room
+	if len(db.restrictions) != 0 {
+		t.Fatal("room was booked before the payment was captured")
+	}
+
+	w := returnFromCheckout(m, ctx, res)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/reservation-summary" {
+		t.Fatalf("return: %d to %q, want the reservation summary", w.Code, w.Header().Get("Location"))
+	}
+	if got := intentStatus(t, fake, p); got != "captured" {
+		t.Errorf("intent %s, want captured", got)
+	}
+	if got := db.payments[p.Id].Status; got != data.PaymentCaptured {
+		t.Errorf("payment %s, want %s", got, data.PaymentCaptured)
+	}
+	if len(db.restrictions) != 1 || db.restrictions[0].ReservationId != res.Id {
+		t.Errorf("restrictions = %+v, want one for reservation %d", db.restrictions, res.Id)
+	}
+
+	// The provider's webhook arriving afterwards changes nothing
+	if w := sendWebhook(t, m, payments.EventAuthorized, p); w.Code != http.StatusNoContent {
+		t.Errorf("webhook after capture: %d, want 204", w.Code)
+	}
+	if len(db.restrictions) != 1 {
+		t.Errorf("%d restrictions after the webhook, want 1", len(db.restrictions))
+	}
+}
+
+func TestPaymentDeclinedReleasesReservation(t *testing.T) {
+	m, db, fake := newPaymentsRepo(t)
+	ctx, res, p := reserve(t, m, db)
+
+	if _, err := fake.Complete(p.IntentId, false); err != nil {
+		t.Fatal(err)
+	}
+
+	w := returnFromCheckout(m, ctx, res)
+	if w.Header().Get("Location") != "/search-availability" {
+		t.Errorf("return: redirected to %q, want /search-availability", w.Header().Get("Location"))
+	}
+	if got := db.payments[p.Id].Status; got != data.PaymentFailed {
+		t.Errorf("payment %s, want %s", got, data.PaymentFailed)
+	}
+	if db.reservations[res.Id].CancelledAt == nil {
+		t.Error("reservation wasn't released")
+	}
+	if len(db.restrictions) != 0 {
+		t.Errorf("restrictions = %+v, want none", db.restrictions)
+	}
+}
+
+func TestPaymentRoomTakenIsRefunded(t *testing.T) {
+	m, db, fake := newPaymentsRepo(t)
+	_, res, p := reserve(t, m, db)
+
+	if _, err := fake.Complete(p.IntentId, true); err != nil {
+		t.Fatal(err)
+	}
+	// Someone else books the room while the guest pays
+	db.restrictions = append(db.restrictions, data.RoomRestriction{
+		RoomId: 1, ReservationId: 99, StartDate: res.StartDate, EndDate: res.EndDate, RestrictionId: 1,
+	})
+
+	if w := sendWebhook(t, m, payments.EventAuthorized, p); w.Code != http.StatusNoContent {
+		t.Errorf("webhook: %d, want 204", w.Code)
+	}
+	if got := intentStatus(t, fake, p); got != "refunded" {
+		t.Errorf("intent %s, want refunded", got)
+	}
+	if got := db.payments[p.Id].Status; got != data.PaymentRefunded {
+		t.Errorf("payment %s, want %s", got, data.PaymentRefunded)
+	}
+	if db.reservations[res.Id].CancelledAt == nil {
+		t.Error("reservation wasn't released")
+	}
+	if len(db.restrictions) != 1 || db.restrictions[0].ReservationId != 99 {
+		t.Errorf("restrictions = %+v, want only the other booking", db.restrictions)
+	}
+}
+
+func TestPaymentConfirmRetried(t *testing.T) {
+	m, db, fake := newPaymentsRepo(t)
+	ctx, res, p := reserve(t, m, db)
+
+	if _, err := fake.Complete(p.IntentId, true); err != nil {
+		t.Fatal(err)
+	}
+	db.confirmErr = errors.New("connection reset")
+
+	if w := returnFromCheckout(m, ctx, res); w.Code != http.StatusInternalServerError {
+		t.Errorf("return while the database fails: %d, want 500", w.Code)
+	}
+	if got := db.payments[p.Id].Status; got != data.PaymentUnconfirmed {
+		t.Fatalf("payment %s, want %s", got, data.PaymentUnconfirmed)
+	}
+
+	// The provider retries its webhook, which books the room without taking the money again
+	if w := sendWebhook(t, m, payments.EventAuthorized, p); w.Code != http.StatusNoContent {
+		t.Errorf("webhook: %d, want 204", w.Code)
+	}
+	if got := db.payments[p.Id].Status; got != data.PaymentCaptured {
+		t.Errorf("payment %s, want %s", got, data.PaymentCaptured)
+	}
+	if got := intentStatus(t, fake, p); got != "captured" {
+		t.Errorf("intent %s, want captured", got)
+	}
+	if len(db.restrictions) != 1 {
+		t.Errorf("%d restrictions, want 1", len(db.restrictions))
+	}
+}
+
+func TestPaymentStuckClaimResumed(t *testing.T) {
+	m, db, fake := newPaymentsRepo(t)
+	_, _, p := reserve(t, m, db)
+
+	// The process capturing the payment stopped after the money was taken
+	if _, err := fake.Complete(p.IntentId, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.Capture(context.Background(), p.IntentId); err != nil {
+		t.Fatal(err)
+	}
+	claimed := db.payments[p.Id]
+	claimed.Status = data.PaymentCapturing
+	claimed.UpdatedAt = time.Now().Add(-time.Minute)
+	db.payments[p.Id] = claimed
+	if w := sendWebhook(t, m, payments.EventAuthorized, p); w.Code != http.StatusNoContent {
+		t.Errorf("webhook during a recent claim: %d, want 204", w.Code)
+	}
+	if got := db.payments[p.Id].Status; got != data.PaymentCapturing {
+		t.Fatalf("payment %s during a recent claim, want %s", got, data.PaymentCapturing)
+	}
+
+	// Once the claim is old enough it's taken over and the room booked
+	claimed.UpdatedAt = time.Now().Add(-claimTimeout - time.Minute)
+	db.payments[p.Id] = claimed
+	if w := sendWebhook(t, m, payments.EventAuthorized, p); w.Code != http.StatusNoContent {
+		t.Errorf("webhook after a stuck claim: %d, want 204", w.Code)
+	}
+	if got := db.payments[p.Id].Status; got != data.PaymentCaptured {
+		t.Errorf("payment %s, want %s", got, data.PaymentCaptured)
+	}
+	if len(db.restrictions) != 1 {
+		t.Errorf("%d restrictions, want 1", len(db.restrictions))
+	}
+}
+
+func TestPaymentGuestDisconnects(t *testing.T) {
+	m, db, fake := newPaymentsRepo(t)
+	ctx, res, p := reserve(t, m, db)
+
+	if _, err := fake.Complete(p.IntentId, true); err != nil {
+		t.Fatal(err)
+	}
+	// The guest closes the page once the payment is claimed
+	gone, cancel := context.WithCancel(ctx)
+	defer cancel()
+	db.afterClaim = cancel
+	returnFromCheckout(m, gone, res)
+
+	if got := db.payments[p.Id].Status; got != data.PaymentCaptured {
+		t.Errorf("payment %s, want %s", got, data.PaymentCaptured)
+	}
+	if len(db.restrictions) != 1 {
+		t.Errorf("%d restrictions, want 1", len(db.restrictions))
+	}
+}
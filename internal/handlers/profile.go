@@ -0,0 +1,265 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dunky-star/modern-webapp-golang/internal/data"
+	"github.com/dunky-star/modern-webapp-golang/internal/forms"
+	"github.com/dunky-star/modern-webapp-golang/internal/helpers"
+	"github.com/dunky-star/modern-webapp-golang/internal/repository"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ProfileHandler shows the logged-in user's details
+func (m *Repository) ProfileHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := m.db.GetUserByID(r.Context(), m.app.Session.GetInt(r.Context(), "user_id"))
+	if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+
+	m.renderProfile(w, r, forms.New(nil), user)
+}
+
+// renderProfile shows the profile page with user's details in form
+func (m *Repository) renderProfile(w http.ResponseWriter, r *http.Request, form *forms.Form, user data.User) {
+	devices, err := m.db.CountRememberTokens(r.Context(), user.Id)
+	if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+
+	m.render.TemplateCache(w, r, "profile.page.tmpl", &data.TemplateData{
+		Form: form,
+		Data: map[string]interface{}{
+			"Title":             "Profile",
+			"User":              user,
+			"Policy":            m.passwordPolicy(),
+			"RememberedDevices": devices,
+		},
+	})
+}
+
+// PostProfileHandler updates the user's name and optionally password once they re-enter their
+// current password. Changing the password logs the user out everywhere else. A new email is only
+// used once the link sent to it is followed, so bookings under the old address can't be taken over.
+func (m *Repository) PostProfileHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := m.db.GetUserByID(r.Context(), m.app.Session.GetInt(r.Context(), "user_id"))
+	if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+
+	oldEmail := user.Email
+	user.FirstName = r.PostForm.Get("first_name")
+	user.LastName = r.PostForm.Get("last_name")
+	newEmail := strings.ToLower(strings.TrimSpace(r.PostForm.Get("email")))
+	// A change in case only is still the same mailbox
+	emailChanged := !strings.EqualFold(newEmail, oldEmail)
+	if !emailChanged {
+		user.Email = newEmail
+	}
+	newPassword := r.PostForm.Get("new_password")
+
+	form := forms.New(r.PostForm)
+	form.Required("first_name", "last_name", "email", "current_password")
+	form.IsEmail("email")
+	if newPassword != "" {
+		form.Password("new_password", m.passwordPolicy())
+		form.Matches("new_password", "confirm_password")
+	}
+
+	if form.Valid() && emailChanged {
+		if _, err := m.db.GetUserByEmail(r.Context(), newEmail); err == nil {
+			form.Errors.Add("email", "This email is already in use")
+		} else if err != nil && !errors.Is(err, repository.ErrUserNotFound) {
+			m.helpers.ServerError(w, err)
+			return
+		}
+	}
+
+	// A wrong current password counts towards the login lockout, so a stolen session
+	// can't be used to guess it
+	if form.Valid() {
+		attempt := data.LoginAttempt{
+			Email:     strings.ToLower(oldEmail),
+			IPAddress: helpers.ClientIP(r),
+			UserAgent: r.UserAgent(),
+			UserId:    user.Id,
+		}
+		outcome, unlock, err := m.loginBlocked(r.Context(), attempt)
+		if err != nil {
+			m.helpers.ServerError(w, err)
+			return
+		}
+		defer unlock()
+		if outcome != "" {
+			form.Errors.Add("current_password", "Too many failed attempts. Please try again later.")
+		} else if _, err := m.db.Authenticate(r.Context(), oldEmail, r.PostForm.Get("current_password")); errors.Is(err, repository.ErrUserInactive) {
+			// Deactivated since logging in: end this session as deactivation would have
+			attempt.Outcome = data.LoginInactive
+			m.recordLoginAttempt(r.Context(), attempt)
+			m.untrackSession(r.Context(), m.app.Session.Token(r.Context()))
+			_ = m.app.Session.Destroy(r.Context())
+			_ = m.app.Session.RenewToken(r.Context())
+			m.app.Session.Put(r.Context(), "error", "This account has been deactivated")
+			http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+			return
+		} else if errors.Is(err, repository.ErrInvalidCredentials) {
+			attempt.Outcome = data.LoginFailed
+			m.recordLoginAttempt(r.Context(), attempt)
+			unlock()
+			m.loginFailed(r, attempt)
+			form.Errors.Add("current_password", "Incorrect password")
+		} else if err != nil {
+			m.helpers.ServerError(w, err)
+			return
+		}
+	}
+
+	// The password is saved first, so nothing is changed if it's refused
+	if form.Valid() && newPassword != "" {
+		err := m.db.UpdatePassword(r.Context(), user.Id, newPassword)
+		if errors.Is(err, bcrypt.ErrPasswordTooLong) {
+			form.Errors.Add("new_password", fmt.Sprintf("Password must be at most %d bytes long", forms.MaxPasswordBytes))
+		} else if err != nil {
+			m.helpers.ServerError(w, err)
+			return
+		}
+	}
+
+	if !form.Valid() {
+		shown := user
+		shown.Email = newEmail
+		m.renderProfile(w, r, form, shown)
+		return
+	}
+
+	if err := m.db.UpdateUser(r.Context(), user); err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+
+	if newPassword != "" {
+		if err := m.destroyUserSessions(r.Context(), user.Id); err != nil {
+			m.app.ErrorLog.Printf("Failed to end sessions for user %d after password change: %v", user.Id, err)
+		}
+		m.forgetAllDevices(r.Context(), user.Id)
+		if err := m.renewSessionToken(r.Context(), user.Id); err != nil {
+			m.app.ErrorLog.Printf("Failed to renew the session token for user %d: %v", user.Id, err)
+		}
+		m.app.InfoLog.Printf("User %d changed their password", user.Id)
+	}
+
+	flash := "Your profile has been updated"
+	if emailChanged {
+		if err := m.sendEmailChange(r, user, newEmail); err != nil {
+			m.helpers.ServerError(w, err)
+			return
+		}
+		m.app.InfoLog.Printf("User %d asked to change their email", user.Id)
+		flash += ". We've emailed a link to " + newEmail + " to confirm the new address."
+	}
+
+	m.app.Session.Put(r.Context(), "flash", flash)
+	http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+}
+
+// sendEmailChange stores a token for the user's new email and queues the email with the link
+// confirming it to the new address
+func (m *Repository) sendEmailChange(r *http.Request, user data.User, newEmail string) error {
+	token, tokenHash, err := helpers.NewToken()
+	if err != nil {
+		return err
+	}
+
+	ttl := m.app.Settings.Auth.EmailChangeTTL
+	if err := m.db.InsertEmailChange(r.Context(), user.Id, newEmail, tokenHash, time.Now().Add(ttl)); err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/user/confirm-email?token=%s", m.app.BaseURL, url.QueryEscape(token))
+	htmlMessage := fmt.Sprintf(`
+	<strong>Confirm Your Email Address</strong><br />
+	Dear %s, <br /><br />
+	Someone asked to use this address for their account. If it was you, follow the link below
+	within %d hours to confirm it:<br /><br />
+	<a href="%s">%s</a><br /><br />
+	Until then your account keeps its current address. If you didn't ask for this, you can ignore this email.<br />
+	`, template.HTMLEscapeString(user.FirstName), int(ttl.Hours()), link, link)
+
+	m.sendMail(r, data.MailData{
+		To:       newEmail,
+		From:     m.app.Settings.Mail.From,
+		Subject:  "Confirm your new email address",
+		Content:  template.HTML(htmlMessage),
+		Template: "dunky.html",
+	})
+	return nil
+}
+
+// ConfirmEmailHandler moves the user to the new email from a confirmation link and tells the old
+// address about it
+func (m *Repository) ConfirmEmailHandler(w http.ResponseWriter, r *http.Request) {
+	next := "/user/login"
+	if m.helpers.IsAuthenticated(r) {
+		next = "/user/profile"
+	}
+
+	token := r.URL.Query().Get("token")
+	userID, oldEmail, err := m.db.ConfirmEmailChange(r.Context(), helpers.HashToken(token))
+	if errors.Is(err, repository.ErrInvalidToken) {
+		m.app.Session.Put(r.Context(), "error", "That confirmation link is invalid or has expired. Please change your email again.")
+		http.Redirect(w, r, next, http.StatusSeeOther)
+		return
+	} else if errors.Is(err, repository.ErrEmailInUse) {
+		m.app.Session.Put(r.Context(), "error", "That email address is already in use")
+		http.Redirect(w, r, next, http.StatusSeeOther)
+		return
+	} else if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+
+	user, err := m.db.GetUserByID(r.Context(), userID)
+	if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+	m.sendEmailChangedNotice(r, user, oldEmail)
+	m.app.InfoLog.Printf("User %d changed their email", user.Id)
+
+	m.app.Session.Put(r.Context(), "flash", "Your email address has been changed to "+user.Email)
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+// sendEmailChangedNotice tells the old address that the account's email was changed,
+// in case it wasn't the owner who changed it
+func (m *Repository) sendEmailChangedNotice(r *http.Request, user data.User, oldEmail string) {
+	htmlMessage := fmt.Sprintf(`
+	<strong>Email Address Changed</strong><br />
+	Dear %s, <br /><br />
+	The email address for your account was changed to %s.<br /><br />
+	If you didn't do this, please contact us straight away.<br />
+	`, template.HTMLEscapeString(user.FirstName), template.HTMLEscapeString(user.Email))
+
+	m.sendMail(r, data.MailData{
+		To:       oldEmail,
+		From:     m.app.Settings.Mail.From,
+		Subject:  "Your email address was changed",
+		Content:  template.HTML(htmlMessage),
+		Template: "dunky.html",
+	})
+}
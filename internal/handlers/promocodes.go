@@ -0,0 +1,276 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dunky-star/modern-webapp-golang/internal/data"
+	"github.com/dunky-star/modern-webapp-golang/internal/forms"
+	"github.com/dunky-star/modern-webapp-golang/internal/pricing"
+	"github.com/dunky-star/modern-webapp-golang/internal/repository"
+)
+
+// promoCodePattern is what a promo code may look like once upper cased
+var promoCodePattern = regexp.MustCompile(`^[A-Z0-9_-]{3,32}$`)
+
+// AdminPromoCodesHandler lists all promo codes
+func (m *Repository) AdminPromoCodesHandler(w http.ResponseWriter, r *http.Request) {
+	codes, err := m.db.AllPromoCodes(m.readContext(r))
+	if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+
+	m.render.TemplateCache(w, r, "admin-promo-codes.page.tmpl", &data.TemplateData{
+		Data: map[string]interface{}{
+			"Title":      "Promo Codes",
+			"PromoCodes": codes,
+			"Currency":   m.app.Settings.Reservations.Currency,
+		},
+	})
+}
+
+// AdminNewPromoCodeHandler shows the form for creating a promo code
+func (m *Repository) AdminNewPromoCodeHandler(w http.ResponseWriter, r *http.Request) {
+	m.renderPromoCodeForm(w, r, forms.New(nil), data.PromoCode{
+		DiscountType: data.DiscountPercent,
+		MinNights:    1,
+		Active:       true,
+	})
+}
+
+// PostAdminNewPromoCodeHandler creates a promo code
+func (m *Repository) PostAdminNewPromoCodeHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+
+	var p data.PromoCode
+	form, err := m.promoCodeFromForm(r, &p)
+	if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+	if !form.Valid() {
+		m.renderPromoCodeForm(w, r, form, p)
+		return
+	}
+
+	p.Id, err = m.db.InsertPromoCode(r.Context(), p)
+	if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+	m.app.InfoLog.Printf("User %d created promo code %d (%s)", m.app.Session.GetInt(r.Context(), "user_id"), p.Id, p.Code)
+
+	m.readOwnWrites(r.Context())
+	m.app.Session.Put(r.Context(), "flash", fmt.Sprintf("Promo code %s created", p.Code))
+	http.Redirect(w, r, "/admin/promo-codes", http.StatusSeeOther)
+}
+
+// promoCodeFromPath loads the promo code named in the path. It writes the error response and
+// returns false if there isn't one.
+func (m *Repository) promoCodeFromPath(w http.ResponseWriter, r *http.Request) (data.PromoCode, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		m.helpers.ClientError(w, http.StatusNotFound)
+		return data.PromoCode{}, false
+	}
+
+	p, err := m.db.GetPromoCodeByID(r.Context(), id)
+	if errors.Is(err, repository.ErrPromoCodeNotFound) {
+		m.helpers.ClientError(w, http.StatusNotFound)
+		return data.PromoCode{}, false
+	} else if err != nil {
+		m.helpers.ServerError(w, err)
+		return data.PromoCode{}, false
+	}
+	return p, true
+}
+
+// AdminPromoCodeHandler shows the form for editing a promo code
+func (m *Repository) AdminPromoCodeHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := m.promoCodeFromPath(w, r)
+	if !ok {
+		return
+	}
+	m.renderPromoCodeForm(w, r, forms.New(nil), p)
+}
+
+// PostAdminPromoCodeHandler saves changes to a promo code. Reservations already booked with it
+// keep the discount they were given.
+func (m *Repository) PostAdminPromoCodeHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := m.promoCodeFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+
+	form, err := m.promoCodeFromForm(r, &p)
+	if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+	if !form.Valid() {
+		m.renderPromoCodeForm(w, r, form, p)
+		return
+	}
+
+	err = m.db.UpdatePromoCode(r.Context(), p)
+	if errors.Is(err, repository.ErrPromoCodeNotFound) {
+		m.helpers.ClientError(w, http.StatusNotFound)
+		return
+	} else if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+	m.app.InfoLog.Printf("User %d updated promo code %d (%s)", m.app.Session.GetInt(r.Context(), "user_id"), p.Id, p.Code)
+
+	m.readOwnWrites(r.Context())
+	m.app.Session.Put(r.Context(), "flash", fmt.Sprintf("Promo code %s saved", p.Code))
+	http.Redirect(w, r, "/admin/promo-codes", http.StatusSeeOther)
+}
+
+// PostAdminDeletePromoCodeHandler deletes a promo code that hasn't been booked with
+func (m *Repository) PostAdminDeletePromoCodeHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := m.promoCodeFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	err := m.db.DeletePromoCode(r.Context(), p.Id)
+	if errors.Is(err, repository.ErrPromoCodeRedeemed) {
+		m.app.Session.Put(r.Context(), "error", fmt.Sprintf("%s has been used for bookings, so it can only be deactivated", p.Code))
+		http.Redirect(w, r, fmt.Sprintf("/admin/promo-codes/%d", p.Id), http.StatusSeeOther)
+		return
+	} else if err != nil && !errors.Is(err, repository.ErrPromoCodeNotFound) {
+		m.helpers.ServerError(w, err)
+		return
+	}
+	m.app.InfoLog.Printf("User %d deleted promo code %d (%s)", m.app.Session.GetInt(r.Context(), "user_id"), p.Id, p.Code)
+
+	m.readOwnWrites(r.Context())
+	m.app.Session.Put(r.Context(), "flash", fmt.Sprintf("Promo code %s deleted", p.Code))
+	http.Redirect(w, r, "/admin/promo-codes", http.StatusSeeOther)
+}
+
+// promoCodeFromForm validates the posted promo code form and copies it into p
+func (m *Repository) promoCodeFromForm(r *http.Request, p *data.PromoCode) (*forms.Form, error) {
+	form := forms.New(r.PostForm)
+	form.Required("code", "amount", "min_nights")
+
+	p.Code = pricing.NormalizeCode(form.Get("code"))
+	p.Description = strings.TrimSpace(form.Get("description"))
+	p.DiscountType = form.Get("discount_type")
+	p.Active = form.Get("active") != ""
+
+	if form.Get("code") != "" && !promoCodePattern.MatchString(p.Code) {
+		form.Errors.Add("code", "Use 3 to 32 letters, digits, dashes or underscores")
+	} else if form.Valid() {
+		other, err := m.db.GetPromoCodeByCode(r.Context(), p.Code)
+		if err == nil && other.Id != p.Id {
+			form.Errors.Add("code", "A promo code with this code already exists")
+		} else if err != nil && !errors.Is(err, repository.ErrPromoCodeNotFound) {
+			return nil, err
+		}
+	}
+
+	p.Amount = 0
+	switch p.DiscountType {
+	case data.DiscountPercent:
+		if n, err := strconv.Atoi(strings.TrimSpace(form.Get("amount"))); err == nil && n >= 1 && n <= 100 {
+			p.Amount = int64(n)
+		} else if form.Get("amount") != "" {
+			form.Errors.Add("amount", "Enter a whole percentage from 1 to 100")
+		}
+	case data.DiscountFixed:
+		if amount, err := data.ParseMoney(form.Get("amount")); err == nil && amount > 0 {
+			p.Amount = amount
+		} else if form.Get("amount") != "" {
+			form.Errors.Add("amount", "Enter an amount such as 20.00")
+		}
+	default:
+		form.Errors.Add("discount_type", "Choose a kind of discount")
+	}
+
+	p.ValidFrom = promoDate(form, "valid_from")
+	p.ValidUntil = promoDate(form, "valid_until")
+	if p.ValidFrom != nil && p.ValidUntil != nil && p.ValidUntil.Before(*p.ValidFrom) {
+		form.Errors.Add("valid_until", "The last day can't be before the first")
+	}
+
+	p.MaxUses = 0
+	if s := strings.TrimSpace(form.Get("max_uses")); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n > 0 {
+			p.MaxUses = n
+		} else {
+			form.Errors.Add("max_uses", "Enter a number of uses, or leave it blank for no limit")
+		}
+	}
+
+	if n, err := strconv.Atoi(strings.TrimSpace(form.Get("min_nights"))); err == nil && n > 0 {
+		p.MinNights = n
+	} else if form.Get("min_nights") != "" {
+		form.Errors.Add("min_nights", "Enter a number of nights, at least 1")
+	}
+
+	p.RoomIds = nil
+	for _, s := range r.PostForm["room_id"] {
+		id, err := strconv.Atoi(s)
+		if err != nil {
+			form.Errors.Add("room_id", "Choose rooms from the list")
+			break
+		}
+		p.RoomIds = append(p.RoomIds, id)
+	}
+	return form, nil
+}
+
+// promoDate parses an optional date field, adding an error to the form if it's invalid
+func promoDate(form *forms.Form, field string) *time.Time {
+	s := strings.TrimSpace(form.Get(field))
+	if s == "" {
+		return nil
+	}
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		form.Errors.Add(field, "Invalid date")
+		return nil
+	}
+	return &t
+}
+
+// renderPromoCodeForm shows the form for creating or editing the promo code
+func (m *Repository) renderPromoCodeForm(w http.ResponseWriter, r *http.Request, form *forms.Form, p data.PromoCode) {
+	rooms, err := m.db.AllRooms(r.Context())
+	if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+
+	title := "New Promo Code"
+	if p.Id != 0 {
+		title = "Edit Promo Code"
+	}
+	m.render.TemplateCache(w, r, "admin-promo-code.page.tmpl", &data.TemplateData{
+		Form: form,
+		Data: map[string]interface{}{
+			"Title":     title,
+			"PromoCode": p,
+			"Rooms":     rooms,
+			"Currency":  m.app.Settings.Reservations.Currency,
+		},
+	})
+}
@@ -0,0 +1,196 @@
+package handlers
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dunky-star/modern-webapp-golang/internal/config"
+	"github.com/dunky-star/modern-webapp-golang/internal/data"
+	"github.com/dunky-star/modern-webapp-golang/internal/helpers"
+	"github.com/dunky-star/modern-webapp-golang/internal/repository"
+)
+
+const (
+	// rememberCookie holds "selector:validator" for a remembered device
+	rememberCookie = "remember_me"
+	// rememberGracePeriod is how long the validator from before a rotation is still accepted, for
+	// requests the browser sent before it received the new cookie
+	rememberGracePeriod = 30 * time.Second
+)
+
+// setRememberCookie writes the cookie for a remembered device
+func (m *Repository) setRememberCookie(w http.ResponseWriter, selector, validator string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     rememberCookie,
+		Value:    selector + ":" + validator,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   config.IsSecureCookie(m.app.Env),
+		SameSite: http.SameSiteStrictMode,
+		MaxAge:   int(m.app.Settings.Auth.RememberMeTTL.Seconds()),
+	})
+}
+
+// clearRememberCookie removes the remembered device cookie from the browser
+func (m *Repository) clearRememberCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     rememberCookie,
+		Value:    "",
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   config.IsSecureCookie(m.app.Env),
+		SameSite: http.SameSiteStrictMode,
+		MaxAge:   -1,
+	})
+}
+
+// rememberCookieParts returns the selector and validator from the request's cookie, if it has one
+func rememberCookieParts(r *http.Request) (selector, validator string, ok bool) {
+	c, err := r.Cookie(rememberCookie)
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(c.Value, ":")
+}
+
+// rememberUser issues a "remember me" token for this device
+func (m *Repository) rememberUser(w http.ResponseWriter, r *http.Request, userID int) error {
+	selector, _, err := helpers.NewToken()
+	if err != nil {
+		return err
+	}
+	validator, validatorHash, err := helpers.NewToken()
+	if err != nil {
+		return err
+	}
+
+	err = m.db.InsertRememberToken(r.Context(), data.RememberToken{
+		UserId:        userID,
+		Selector:      selector,
+		ValidatorHash: validatorHash,
+		UserAgent:     r.UserAgent(),
+		ExpiresAt:     time.Now().Add(m.app.Settings.Auth.RememberMeTTL),
+	})
+	if err != nil {
+		return err
+	}
+
+	m.setRememberCookie(w, selector, validator)
+	m.app.Session.Put(r.Context(), "remember_selector", selector)
+	return nil
+}
+
+// forgetDevice removes this device's "remember me" token, if it has one
+func (m *Repository) forgetDevice(w http.ResponseWriter, r *http.Request) {
+	if selector, _, ok := rememberCookieParts(r); ok {
+		if err := m.db.DeleteRememberToken(r.Context(), selector); err != nil {
+			m.app.ErrorLog.Printf("Failed to delete remember me token: %v", err)
+		}
+		m.clearRememberCookie(w)
+	}
+}
+
+// forgetAllDevices removes all of the user's "remember me" tokens, e.g. after their password changes
+func (m *Repository) forgetAllDevices(ctx context.Context, userID int) {
+	if err := m.db.DeleteUserRememberTokens(ctx, userID); err != nil {
+		m.app.ErrorLog.Printf("Failed to delete remember me tokens for user %d: %v", userID, err)
+	}
+}
+
+// RememberMe logs in visitors who have no session but a valid "remember me" cookie, and rotates
+// the cookie's validator so each one can only be used once.
+// Use it inside the session middleware.
+func (m *Repository) RememberMe(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !m.helpers.IsAuthenticated(r) {
+			if selector, validator, ok := rememberCookieParts(r); ok {
+				if err := m.resumeLogin(w, r, selector, validator); err != nil {
+					m.app.ErrorLog.Printf("Failed to log in from remember me cookie: %v", err)
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// resumeLogin checks a "remember me" cookie and logs its user in
+func (m *Repository) resumeLogin(w http.ResponseWriter, r *http.Request, selector, validator string) error {
+	token, err := m.db.GetRememberToken(r.Context(), selector)
+	if errors.Is(err, repository.ErrInvalidToken) {
+		m.clearRememberCookie(w)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	validatorHash := helpers.HashToken(validator)
+	current := subtle.ConstantTimeCompare(validatorHash, token.ValidatorHash) == 1
+	previous := token.LastUsedAt != nil && time.Since(*token.LastUsedAt) < rememberGracePeriod &&
+		subtle.ConstantTimeCompare(validatorHash, token.PreviousHash) == 1
+
+	// A known selector with the wrong validator means the cookie was copied and already used
+	// elsewhere, so stop trusting any of the user's remembered devices
+	if !current && !previous {
+		m.app.WarningLog.Printf("Remember me token reused for user %d from %s; forgetting all their devices",
+			token.UserId, helpers.ClientIP(r))
+		m.forgetAllDevices(r.Context(), token.UserId)
+		m.clearRememberCookie(w)
+		return nil
+	}
+
+	user, err := m.db.GetUserByID(r.Context(), token.UserId)
+	if err != nil {
+		return err
+	}
+	if !user.Active {
+		m.forgetDevice(w, r)
+		return nil
+	}
+
+	// A request racing the one that rotated the token logs in without rotating it again. Only one
+	// of several requests sent with the same cookie at once gets to rotate it; the others lose the
+	// race at the update and are treated the same way.
+	if current {
+		newValidator, newValidatorHash, err := helpers.NewToken()
+		if err != nil {
+			return err
+		}
+		err = m.db.RotateRememberToken(r.Context(), token.Id, validatorHash, newValidatorHash, time.Now().Add(m.app.Settings.Auth.RememberMeTTL))
+		if err == nil {
+			m.setRememberCookie(w, selector, newValidator)
+		} else if !errors.Is(err, repository.ErrInvalidToken) {
+			return err
+		}
+	}
+
+	m.recordLoginAttempt(r.Context(), data.LoginAttempt{
+		Email:     strings.ToLower(user.Email),
+		IPAddress: helpers.ClientIP(r),
+		UserAgent: r.UserAgent(),
+		UserId:    user.Id,
+		Outcome:   data.LoginRemembered,
+	})
+	if err := m.completeLogin(r, user); err != nil {
+		return err
+	}
+	m.app.Session.Put(r.Context(), "remember_selector", selector)
+	return nil
+}
+
+// PostForgetDevicesHandler forgets every device the user is remembered on, including this one
+func (m *Repository) PostForgetDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	userID := m.app.Session.GetInt(r.Context(), "user_id")
+	if err := m.db.DeleteUserRememberTokens(r.Context(), userID); err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+	m.clearRememberCookie(w)
+	m.app.InfoLog.Printf("User %d forgot all remembered devices", userID)
+
+	m.app.Session.Put(r.Context(), "flash", "You'll need to log in again on all your devices next time your session ends")
+	http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+}
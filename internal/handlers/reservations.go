@@ -0,0 +1,334 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dunky-star/modern-webapp-golang/internal/data"
+	"github.com/dunky-star/modern-webapp-golang/internal/forms"
+	"github.com/dunky-star/modern-webapp-golang/internal/helpers"
+	"github.com/dunky-star/modern-webapp-golang/internal/pricing"
+	"github.com/dunky-star/modern-webapp-golang/internal/repository"
+)
+
+// cancelDeadline is the last moment a guest can cancel or change the reservation online
+func (m *Repository) cancelDeadline(res data.Reservation) time.Time {
+	y, mo, d := res.StartDate.Date()
+	arrival := time.Date(y, mo, d, 0, 0, 0, 0, time.Local)
+	return arrival.Add(-m.app.Settings.Reservations.CancellationWindow)
+}
+
+// paidFor reports whether money has been taken for the reservation. Its price can't be changed
+// online then, as the difference would have to be charged or refunded.
+func (m *Repository) paidFor(r *http.Request, res data.Reservation) (bool, error) {
+	p, err := m.db.GetReservationPayment(r.Context(), res.Id)
+	if errors.Is(err, repository.ErrPaymentNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return p.Status == data.PaymentCaptured || p.Status == data.PaymentUnconfirmed, nil
+}
+
+// renderBooking shows a looked-up reservation, with the cancel and change dates forms while
+// they're allowed
+func (m *Repository) renderBooking(w http.ResponseWriter, r *http.Request, form *forms.Form, res data.Reservation) {
+	canCancel := res.CancelledAt == nil && time.Now().Before(m.cancelDeadline(res))
+	paid, err := m.paidFor(r, res)
+	if err != nil {
+		m.app.ErrorLog.Printf("Failed to load the payment for reservation %d: %v", res.Id, err)
+		paid = true
+	}
+
+	m.render.TemplateCache(w, r, "reservation-lookup.page.tmpl", &data.TemplateData{
+		Form: form,
+		Data: map[string]interface{}{
+			"Title":       "Your Booking",
+			"reservation": res,
+			"CancelBy":    m.cancelDeadline(res),
+			"CanCancel":   canCancel,
+			"CanChange":   canCancel && !paid,
+		},
+	})
+}
+
+// ShowReservationLookupHandler shows the form for finding a booking by confirmation code and email
+func (m *Repository) ShowReservationLookupHandler(w http.ResponseWriter, r *http.Request) {
+	values := url.Values{}
+	values.Set("code", r.URL.Query().Get("code"))
+	if m.helpers.IsAuthenticated(r) {
+		if user, err := m.db.GetUserByID(r.Context(), m.app.Session.GetInt(r.Context(), "user_id")); err == nil {
+			values.Set("email", user.Email)
+		}
+	}
+
+	m.render.TemplateCache(w, r, "reservation-lookup.page.tmpl", &data.TemplateData{
+		Form: forms.New(values),
+		Data: map[string]interface{}{
+			"Title": "Find Your Booking",
+		},
+	})
+}
+
+// PostReservationLookupHandler shows the booking matching the confirmation code and email
+func (m *Repository) PostReservationLookupHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("code", "email")
+	res, ok := m.lookupReservation(w, r, form)
+	if !ok {
+		return
+	}
+
+	m.renderBooking(w, r, form, res)
+}
+
+// lookupReservation finds the reservation for the code and email in the form. If there isn't
+// one it re-renders the lookup form with an error and returns false. The message doesn't say
+// which of the two was wrong.
+func (m *Repository) lookupReservation(w http.ResponseWriter, r *http.Request, form *forms.Form) (data.Reservation, bool) {
+	var res data.Reservation
+	if form.Valid() {
+		var err error
+		res, err = m.db.GetReservationByCode(r.Context(), helpers.NormalizeConfirmationCode(form.Get("code")))
+		if err != nil && !errors.Is(err, repository.ErrReservationNotFound) {
+			m.helpers.ServerError(w, err)
+			return data.Reservation{}, false
+		}
+		if err != nil || !strings.EqualFold(res.Email, strings.TrimSpace(form.Get("email"))) {
+			form.Errors.Add("code", "We couldn't find a booking with that confirmation code and email")
+		}
+	}
+
+	if !form.Valid() {
+		m.render.TemplateCache(w, r, "reservation-lookup.page.tmpl", &data.TemplateData{
+			Form: form,
+			Data: map[string]interface{}{
+				"Title": "Find Your Booking",
+			},
+		})
+		return data.Reservation{}, false
+	}
+	return res, true
+}
+
+// PostCancelReservationHandler cancels the booking matching the confirmation code and email,
+// if it's still before the cancellation deadline, freeing its room dates and refunding its payment
+func (m *Repository) PostCancelReservationHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("code", "email")
+	res, ok := m.lookupReservation(w, r, form)
+	if !ok {
+		return
+	}
+
+	if res.CancelledAt != nil {
+		m.app.Session.Put(r.Context(), "warning", "This booking has already been cancelled")
+		http.Redirect(w, r, "/reservation/lookup?code="+url.QueryEscape(res.ConfirmationCode), http.StatusSeeOther)
+		return
+	}
+	if !time.Now().Before(m.cancelDeadline(res)) {
+		m.app.Session.Put(r.Context(), "error", "This booking can no longer be cancelled online. Please contact us.")
+		http.Redirect(w, r, "/reservation/lookup?code="+url.QueryEscape(res.ConfirmationCode), http.StatusSeeOther)
+		return
+	}
+
+	err = m.db.CancelReservation(r.Context(), res.Id)
+	if errors.Is(err, repository.ErrReservationNotFound) {
+		m.app.Session.Put(r.Context(), "warning", "This booking has already been cancelled")
+		http.Redirect(w, r, "/reservation/lookup?code="+url.QueryEscape(res.ConfirmationCode), http.StatusSeeOther)
+		return
+	} else if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+	m.metrics.ReservationsCancelled.Inc()
+	m.app.InfoLog.Printf("Guest cancelled reservation %d", res.Id)
+	m.refundReservation(r, res)
+
+	m.sendCancellationNotices(r, res)
+
+	m.app.Session.Put(r.Context(), "flash", fmt.Sprintf("Your booking %s has been cancelled", res.ConfirmationCode))
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// PostChangeReservationDatesHandler moves the booking matching the confirmation code and email
+// to new dates, if the room is free then and it's still before the deadline for changes. Paid
+// bookings can't be moved, since that would change what the guest owes.
+func (m *Repository) PostChangeReservationDatesHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("code", "email")
+	res, ok := m.lookupReservation(w, r, form)
+	if !ok {
+		return
+	}
+
+	if res.CancelledAt != nil || !time.Now().Before(m.cancelDeadline(res)) {
+		m.app.Session.Put(r.Context(), "error", "This booking can no longer be changed online. Please contact us.")
+		m.renderBooking(w, r, form, res)
+		return
+	}
+	if paid, err := m.paidFor(r, res); err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	} else if paid {
+		m.app.Session.Put(r.Context(), "error", "This booking has been paid for, so its dates can't be changed online. Please contact us.")
+		m.renderBooking(w, r, form, res)
+		return
+	}
+
+	form.Required("start_date", "end_date")
+	startDate, err := time.Parse("2006-01-02", form.Get("start_date"))
+	if err != nil {
+		form.Errors.Add("start_date", "Invalid arrival date")
+	}
+	endDate, err := time.Parse("2006-01-02", form.Get("end_date"))
+	if err != nil {
+		form.Errors.Add("end_date", "Invalid departure date")
+	}
+	if form.Valid() {
+		y, mo, d := time.Now().Date()
+		if startDate.Before(time.Date(y, mo, d, 0, 0, 0, 0, time.UTC)) {
+			form.Errors.Add("start_date", "Arrival can't be in the past")
+		} else if !endDate.After(startDate) {
+			form.Errors.Add("end_date", "Departure must be after arrival")
+		} else if startDate.Equal(res.StartDate) && endDate.Equal(res.EndDate) {
+			form.Errors.Add("start_date", "Those are already your dates")
+		}
+	}
+
+	var quote data.Quote
+	if form.Valid() {
+		quote, err = m.pricing.Quote(r.Context(), data.Reservation{
+			RoomId: res.RoomId, StartDate: startDate, EndDate: endDate, PromoCodeId: res.PromoCodeId,
+		})
+		var promoErr *pricing.PromoError
+		if errors.As(err, &promoErr) {
+			form.Errors.Add("end_date", promoErr.Reason)
+		} else if err != nil {
+			m.helpers.ServerError(w, err)
+			return
+		}
+	}
+
+	if form.Valid() {
+		available, err := m.db.SearchAvailabilityByDatesByRoomId(r.Context(), startDate, endDate, res.RoomId, res.Id)
+		if err != nil {
+			m.helpers.ServerError(w, err)
+			return
+		}
+		if available {
+			err = m.db.ChangeReservationDates(r.Context(), res.Id, startDate, endDate, quote.Due(), quote.Discount, quote.Currency)
+			if errors.Is(err, repository.ErrReservationNotFound) {
+				m.app.Session.Put(r.Context(), "warning", "This booking has been cancelled")
+				http.Redirect(w, r, "/reservation/lookup?code="+url.QueryEscape(res.ConfirmationCode), http.StatusSeeOther)
+				return
+			} else if err != nil && !errors.Is(err, repository.ErrRoomUnavailable) {
+				m.helpers.ServerError(w, err)
+				return
+			}
+			available = err == nil
+		}
+		if !available {
+			form.Errors.Add("start_date", fmt.Sprintf("The %s is already booked for some of those dates", res.Room.RoomName))
+		}
+	}
+
+	if !form.Valid() {
+		m.renderBooking(w, r, form, res)
+		return
+	}
+
+	oldStart, oldEnd := res.StartDate, res.EndDate
+	res.StartDate, res.EndDate = startDate, endDate
+	res.TotalPrice, res.Currency, res.Discount = quote.Due(), quote.Currency, quote.Discount
+	m.app.InfoLog.Printf("Guest moved reservation %d from %s-%s to %s-%s", res.Id,
+		oldStart.Format("2006-01-02"), oldEnd.Format("2006-01-02"), startDate.Format("2006-01-02"), endDate.Format("2006-01-02"))
+	m.sendDateChangeConfirmation(r, res)
+
+	// Show the booking with its new dates rather than redirecting, which would need the email again
+	m.app.Session.Put(r.Context(), "flash", "Your booking has been moved to the new dates")
+	m.renderBooking(w, r, forms.New(url.Values{"code": {form.Get("code")}, "email": {form.Get("email")}}), res)
+}
+
+// sendDateChangeConfirmation emails the guest their booking's new dates
+func (m *Repository) sendDateChangeConfirmation(r *http.Request, res data.Reservation) {
+	link := fmt.Sprintf("%s/reservation/lookup?code=%s", m.app.BaseURL, res.ConfirmationCode)
+	htmlMessage := fmt.Sprintf(`
+	<strong>Reservation Updated</strong><br />
+	Dear %s, <br /><br />
+	Your reservation %s for the %s has been changed. You're now booked for %s to %s.<br /><br />
+	New total price: <strong>%s</strong><br /><br />
+	To view, change or cancel your booking, go to <a href="%s">%s</a>.<br />
+	`, template.HTMLEscapeString(res.FirstName), res.ConfirmationCode, template.HTMLEscapeString(res.Room.RoomName),
+		res.StartDate.Format("2006-01-02"), res.EndDate.Format("2006-01-02"), res.Price(), link, link)
+
+	m.sendMail(r, data.MailData{
+		To:       res.Email,
+		From:     m.app.Settings.Mail.From,
+		Subject:  "Your reservation has been updated",
+		Content:  template.HTML(htmlMessage),
+		Template: "dunky.html",
+	})
+}
+
+// sendCancellationNotices confirms the cancellation to the guest and reports it to the owner
+func (m *Repository) sendCancellationNotices(r *http.Request, res data.Reservation) {
+	sd := res.StartDate.Format("2006-01-02")
+	ed := res.EndDate.Format("2006-01-02")
+
+	guestMessage := fmt.Sprintf(`
+	<strong>Reservation Cancelled</strong><br />
+	Dear %s, <br /><br />
+	Your reservation %s for %s to %s has been cancelled.<br /><br />
+	If you didn't do this, please contact us straight away.<br />
+	`, template.HTMLEscapeString(res.FirstName), res.ConfirmationCode, sd, ed)
+
+	m.sendMail(r, data.MailData{
+		To:       res.Email,
+		From:     m.app.Settings.Mail.From,
+		Subject:  "Your reservation has been cancelled",
+		Content:  template.HTML(guestMessage),
+		Template: "dunky.html",
+	})
+
+	notify := m.app.Settings.Reservations.NotifyEmail
+	if notify == "" {
+		notify = m.app.Settings.Mail.From
+	}
+	ownerMessage := fmt.Sprintf(`
+	<strong>Reservation Cancelled</strong><br />
+	%s %s (%s) cancelled reservation %s for the %s, %s to %s. The dates are available again.<br />
+	`, template.HTMLEscapeString(res.FirstName), template.HTMLEscapeString(res.LastName), template.HTMLEscapeString(res.Email),
+		res.ConfirmationCode, template.HTMLEscapeString(res.Room.RoomName), sd, ed)
+
+	m.sendMail(r, data.MailData{
+		To:       notify,
+		From:     m.app.Settings.Mail.From,
+		Subject:  fmt.Sprintf("Reservation %s cancelled", res.ConfirmationCode),
+		Content:  template.HTML(ownerMessage),
+		Template: "dunky.html",
+	})
+}
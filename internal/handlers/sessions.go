@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/dunky-star/modern-webapp-golang/internal/data"
+	"github.com/dunky-star/modern-webapp-golang/internal/helpers"
+)
+
+// renewSessionToken gives this request's session a new token and lists it in the user's session
+// index, so it can be found to log it out later
+func (m *Repository) renewSessionToken(ctx context.Context, userID int) error {
+	m.untrackSession(ctx, m.app.Session.Token(ctx))
+	if err := m.app.Session.RenewToken(ctx); err != nil {
+		return err
+	}
+	return m.db.InsertUserSession(ctx, userID, m.app.Session.Token(ctx), m.app.Session.Deadline(ctx))
+}
+
+// untrackSession removes a session token from the session index. A failure is only logged: the
+// entry is skipped once its session has ended.
+func (m *Repository) untrackSession(ctx context.Context, token string) {
+	if token == "" {
+		return
+	}
+	if err := m.db.DeleteUserSession(ctx, token); err != nil {
+		m.app.ErrorLog.Printf("Failed to remove session from the session index: %v", err)
+	}
+}
+
+// userSessions lists the user's logged-in sessions, most recently seen first.
+// Index entries for sessions that have ended are removed.
+func (m *Repository) userSessions(ctx context.Context, userID int) ([]data.SessionInfo, error) {
+	tokens, err := m.db.UserSessionTokens(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions []data.SessionInfo
+	for _, token := range tokens {
+		s, ok, err := m.helpers.UserSession(ctx, userID, token)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			m.untrackSession(ctx, token)
+			continue
+		}
+		sessions = append(sessions, s)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastSeen.After(sessions[j].LastSeen)
+	})
+	return sessions, nil
+}
+
+// destroyUserSession logs out one of the user's sessions, identified by its SessionInfo.ID
+func (m *Repository) destroyUserSession(ctx context.Context, userID int, id string) error {
+	tokens, err := m.db.UserSessionTokens(ctx, userID)
+	if err != nil {
+		return err
+	}
+	for _, token := range tokens {
+		if helpers.SessionID(token) != id {
+			continue
+		}
+		if err := m.helpers.DestroySession(ctx, token); err != nil {
+			return err
+		}
+		m.untrackSession(ctx, token)
+	}
+	return nil
+}
+
+// destroyUserSessions logs the user out everywhere except in the session of ctx (if it is theirs)
+func (m *Repository) destroyUserSessions(ctx context.Context, userID int) error {
+	tokens, err := m.db.UserSessionTokens(ctx, userID)
+	if err != nil {
+		return err
+	}
+	current := m.app.Session.Token(ctx)
+	for _, token := range tokens {
+		if token == current {
+			continue
+		}
+		if err := m.helpers.DestroySession(ctx, token); err != nil {
+			return err
+		}
+		m.untrackSession(ctx, token)
+	}
+	return nil
+}
+
+// SessionsHandler lists the logged-in user's active sessions
+func (m *Repository) SessionsHandler(w http.ResponseWriter, r *http.Request) {
+	sessions, err := m.userSessions(r.Context(), m.app.Session.GetInt(r.Context(), "user_id"))
+	if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+
+	m.render.TemplateCache(w, r, "sessions.page.tmpl", &data.TemplateData{
+		Data: map[string]interface{}{
+			"Title":    "Active Sessions",
+			"Sessions": sessions,
+		},
+	})
+}
+
+// PostRevokeSessionHandler logs out one of the user's other sessions, and forgets its device
+// if it was remembered so the session doesn't come straight back
+func (m *Repository) PostRevokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	userID := m.app.Session.GetInt(r.Context(), "user_id")
+	sessions, err := m.userSessions(r.Context(), userID)
+	if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+
+	id := r.PathValue("id")
+	for _, s := range sessions {
+		if s.ID != id {
+			continue
+		}
+		if s.Current {
+			m.app.Session.Put(r.Context(), "error", "Use Logout to end this session")
+			http.Redirect(w, r, "/user/sessions", http.StatusSeeOther)
+			return
+		}
+
+		if err := m.destroyUserSession(r.Context(), userID, id); err != nil {
+			m.helpers.ServerError(w, err)
+			return
+		}
+		if s.RememberSelector != "" {
+			if err := m.db.DeleteRememberToken(r.Context(), s.RememberSelector); err != nil {
+				m.app.ErrorLog.Printf("Failed to delete remember me token for revoked session: %v", err)
+			}
+		}
+		m.app.InfoLog.Printf("User %d logged out their session from %s", userID, s.IPAddress)
+
+		m.app.Session.Put(r.Context(), "flash", "Session logged out")
+		http.Redirect(w, r, "/user/sessions", http.StatusSeeOther)
+		return
+	}
+
+	m.app.Session.Put(r.Context(), "warning", "That session has already ended")
+	http.Redirect(w, r, "/user/sessions", http.StatusSeeOther)
+}
+
+// PostRevokeOtherSessionsHandler logs the user out everywhere except this session
+func (m *Repository) PostRevokeOtherSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := m.app.Session.GetInt(r.Context(), "user_id")
+	if err := m.destroyUserSessions(r.Context(), userID); err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+	keep := m.app.Session.GetString(r.Context(), "remember_selector")
+	if err := m.db.DeleteOtherRememberTokens(r.Context(), userID, keep); err != nil {
+		m.app.ErrorLog.Printf("Failed to delete remember me tokens for user %d: %v", userID, err)
+	}
+	m.app.InfoLog.Printf("User %d logged out their other sessions", userID)
+
+	m.app.Session.Put(r.Context(), "flash", "Logged out of all other sessions")
+	http.Redirect(w, r, "/user/sessions", http.StatusSeeOther)
+}
+
+// PostAdminLogoutUserHandler logs a user out everywhere, e.g. when their device is lost
+func (m *Repository) PostAdminLogoutUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := m.managedUser(w, r)
+	if !ok {
+		return
+	}
+
+	if user.Id == m.app.Session.GetInt(r.Context(), "user_id") {
+		m.app.Session.Put(r.Context(), "error", "Use Active Sessions to log out your own sessions")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+
+	if err := m.destroyUserSessions(r.Context(), user.Id); err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+	m.forgetAllDevices(r.Context(), user.Id)
+	m.app.InfoLog.Printf("User %d logged out user %d everywhere", m.app.Session.GetInt(r.Context(), "user_id"), user.Id)
+
+	m.app.Session.Put(r.Context(), "flash", fmt.Sprintf("Logged out %s %s everywhere", user.FirstName, user.LastName))
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alexedwards/scs/v2"
+	"github.com/alexedwards/scs/v2/memstore"
+)
+
+// indexOnlyStore is a session store that can't be iterated, so a test fails if sessions are
+// looked up by reading the whole store instead of through the session index
+type indexOnlyStore struct {
+	scs.Store
+}
+
+// loginSession logs the user in to a new session and saves it, returning the session's context
+func loginSession(t *testing.T, m *Repository) context.Context {
+	t.Helper()
+	_, ctx := m.serve(t, m.PostLoginHandler, login("ada@example.com", "correct horse"))
+	if m.app.Session.GetInt(ctx, "user_id") == 0 {
+		t.Fatal("login failed")
+	}
+	if _, _, err := m.app.Session.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return ctx
+}
+
+// sessionStored reports whether the session of ctx is still in the store
+func sessionStored(t *testing.T, m *Repository, ctx context.Context) bool {
+	t.Helper()
+	_, found, err := m.app.Session.Store.Find(m.app.Session.Token(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return found
+}
+
+func TestUserSessionsUseIndex(t *testing.T) {
+	m, db, user := newLoginRepo(t)
+	m.app.Session.Store = indexOnlyStore{memstore.New()}
+
+	// An anonymous visitor's session is left alone
+	visitor := m.newSession(t)
+	m.app.Session.Put(visitor, "remote_addr", "192.0.2.9")
+	if _, _, err := m.app.Session.Commit(visitor); err != nil {
+		t.Fatal(err)
+	}
+
+	laptop := loginSession(t, m)
+	phone := loginSession(t, m)
+
+	sessions, err := m.userSessions(laptop, user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("listed %d sessions, want 2", len(sessions))
+	}
+	current := 0
+	for _, s := range sessions {
+		if s.Current {
+			current++
+		}
+	}
+	if current != 1 {
+		t.Errorf("%d sessions marked current, want 1", current)
+	}
+
+	if err := m.destroyUserSessions(laptop, user.Id); err != nil {
+		t.Fatal(err)
+	}
+	if sessionStored(t, m, phone) {
+		t.Error("other session still stored after logging out everywhere else")
+	}
+	if !sessionStored(t, m, laptop) || !sessionStored(t, m, visitor) {
+		t.Error("current or visitor session was destroyed")
+	}
+	if len(db.sessions) != 1 {
+		t.Errorf("session index has %d entries, want 1", len(db.sessions))
+	}
+}
+
+func TestUserSessionsDropEndedSessions(t *testing.T) {
+	m, db, user := newLoginRepo(t)
+
+	laptop := loginSession(t, m)
+	phone := loginSession(t, m)
+	if err := m.app.Session.Store.Delete(m.app.Session.Token(phone)); err != nil {
+		t.Fatal(err)
+	}
+
+	sessions, err := m.userSessions(laptop, user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || !sessions[0].Current {
+		t.Errorf("sessions = %+v, want only the current one", sessions)
+	}
+	if len(db.sessions) != 1 {
+		t.Errorf("session index has %d entries, want the ended session removed", len(db.sessions))
+	}
+}
@@ -0,0 +1,480 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"image/png"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dunky-star/modern-webapp-golang/internal/data"
+	"github.com/dunky-star/modern-webapp-golang/internal/forms"
+	"github.com/dunky-star/modern-webapp-golang/internal/helpers"
+	"github.com/dunky-star/modern-webapp-golang/internal/repository"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+const (
+	// twoFactorTimeout is how long a user has to enter their code after the password step
+	twoFactorTimeout = 5 * time.Minute
+	// recoveryCodeCount is how many recovery codes are issued when two-factor is turned on
+	recoveryCodeCount = 10
+	// totpPeriod is how long each authenticator code lasts
+	totpPeriod = 30
+)
+
+// completeLogin logs the user in, renewing the session token since their privileges change,
+// and adds the session to the user's session index
+func (m *Repository) completeLogin(r *http.Request, user data.User) error {
+	ctx := r.Context()
+	if err := m.renewSessionToken(ctx, user.Id); err != nil {
+		return err
+	}
+	m.app.Session.Put(ctx, "user_id", user.Id)
+	m.app.Session.Put(ctx, "login_at", time.Now().Unix())
+	m.helpers.TouchSession(r, 0)
+	m.app.Session.Put(ctx, "access_level", int(user.Role()))
+	m.app.Session.Put(ctx, "totp_enabled", user.TOTPEnabled)
+	return nil
+}
+
+// startTwoFactor parks a password-verified user in the session until they enter their second factor
+func (m *Repository) startTwoFactor(ctx context.Context, user data.User, remember bool) {
+	_ = m.app.Session.RenewToken(ctx)
+	m.app.Session.Put(ctx, "2fa_user_id", user.Id)
+	m.app.Session.Put(ctx, "2fa_started", time.Now().Unix())
+	m.app.Session.Put(ctx, "2fa_remember", remember)
+}
+
+// pendingTwoFactorUser returns the id of the user waiting on the second login step, or zero if
+// there is none or it has timed out
+func (m *Repository) pendingTwoFactorUser(ctx context.Context) int {
+	started := time.Unix(m.app.Session.GetInt64(ctx, "2fa_started"), 0)
+	if time.Since(started) > twoFactorTimeout {
+		m.clearTwoFactor(ctx)
+		return 0
+	}
+	return m.app.Session.GetInt(ctx, "2fa_user_id")
+}
+
+// clearTwoFactor forgets the pending second login step
+func (m *Repository) clearTwoFactor(ctx context.Context) {
+	m.app.Session.Remove(ctx, "2fa_user_id")
+	m.app.Session.Remove(ctx, "2fa_started")
+	m.app.Session.Remove(ctx, "2fa_remember")
+}
+
+// ShowTwoFactorHandler shows the form for the second login step
+func (m *Repository) ShowTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	if m.pendingTwoFactorUser(r.Context()) == 0 {
+		m.app.Session.Put(r.Context(), "error", "Please log in")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	m.render.TemplateCache(w, r, "two-factor.page.tmpl", &data.TemplateData{
+		Form: forms.New(nil),
+		Data: map[string]interface{}{
+			"Title": "Two-Factor Authentication",
+		},
+	})
+}
+
+// PostTwoFactorHandler checks the authenticator or recovery code and finishes logging the user in.
+// Wrong codes count towards the same lockout as wrong passwords.
+func (m *Repository) PostTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	userID := m.pendingTwoFactorUser(r.Context())
+	if userID == 0 {
+		m.app.Session.Put(r.Context(), "error", "Your login timed out. Please log in again.")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+
+	user, err := m.db.GetUserByID(r.Context(), userID)
+	if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+	if !user.Active {
+		m.clearTwoFactor(r.Context())
+		m.app.Session.Put(r.Context(), "error", "This account has been deactivated")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	attempt := data.LoginAttempt{
+		Email:     strings.ToLower(user.Email),
+		IPAddress: helpers.ClientIP(r),
+		UserAgent: r.UserAgent(),
+		UserId:    user.Id,
+	}
+
+	outcome, unlock, err := m.loginBlocked(r.Context(), attempt)
+	if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+	defer unlock()
+	if outcome != "" {
+		attempt.Outcome = outcome
+		m.recordLoginAttempt(r.Context(), attempt)
+		m.clearTwoFactor(r.Context())
+		m.app.Session.Put(r.Context(), "error", "Too many failed login attempts. Please try again later.")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
+
+	ok, err := m.checkSecondFactor(r.Context(), user, r.PostForm.Get("code"))
+	if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+	if !ok {
+		attempt.Outcome = data.LoginTwoFactorFailed
+		m.recordLoginAttempt(r.Context(), attempt)
+		unlock()
+		m.loginFailed(r, attempt)
+		m.app.Session.Put(r.Context(), "error", "Invalid authentication code")
+		http.Redirect(w, r, "/user/two-factor", http.StatusSeeOther)
+		return
+	}
+
+	attempt.Outcome = data.LoginSucceeded
+	m.recordLoginAttempt(r.Context(), attempt)
+
+	remember := m.app.Session.GetBool(r.Context(), "2fa_remember")
+	m.clearTwoFactor(r.Context())
+	if err := m.completeLogin(r, user); err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+	if remember {
+		if err := m.rememberUser(w, r, user.Id); err != nil {
+			m.app.ErrorLog.Printf("Failed to remember device for user %d: %v", user.Id, err)
+		}
+	}
+	m.app.Session.Put(r.Context(), "flash", "Logged in successfully")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// checkSecondFactor accepts either a current authenticator code or an unused recovery code,
+// which is used up
+func (m *Repository) checkSecondFactor(ctx context.Context, user data.User, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return false, nil
+	}
+	if step, ok := totpStep(code, user.TOTPSecret, time.Now()); ok {
+		return m.useTOTPStep(ctx, user, step)
+	}
+
+	remaining, err := m.db.UseRecoveryCode(ctx, user.Id, helpers.HashToken(normalizeRecoveryCode(code)))
+	if errors.Is(err, repository.ErrInvalidToken) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	m.app.InfoLog.Printf("User %d logged in with a recovery code, %d left", user.Id, remaining)
+	if remaining == 0 {
+		m.app.Session.Put(ctx, "warning", "You have used your last recovery code. Turn two-factor authentication off and on again to get new ones.")
+	}
+	return true, nil
+}
+
+// totpStep returns the time step the code was generated for, allowing one step of clock skew
+// either way, or false if it isn't a current code for the secret
+func totpStep(code, secret string, now time.Time) (int64, bool) {
+	current := now.Unix() / totpPeriod
+	for _, step := range []int64{current, current - 1, current + 1} {
+		want, err := totp.GenerateCodeCustom(secret, time.Unix(step*totpPeriod, 0), totp.ValidateOpts{
+			Period:    totpPeriod,
+			Digits:    otp.DigitsSix,
+			Algorithm: otp.AlgorithmSHA1,
+		})
+		if err == nil && subtle.ConstantTimeCompare([]byte(want), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// useTOTPStep accepts a code for the time step unless one for it, or a later step, was already
+// accepted, so an observed code can't be replayed while it's still current
+func (m *Repository) useTOTPStep(ctx context.Context, user data.User, step int64) (bool, error) {
+	err := m.db.UseTOTPStep(ctx, user.Id, step)
+	if errors.Is(err, repository.ErrInvalidToken) {
+		m.app.WarningLog.Printf("Rejected a reused authenticator code for user %d", user.Id)
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// ShowTwoFactorSetupHandler shows a new secret to scan into an authenticator app, or the option to
+// turn two-factor off if it's already on
+func (m *Repository) ShowTwoFactorSetupHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := m.db.GetUserByID(r.Context(), m.app.Session.GetInt(r.Context(), "user_id"))
+	if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+
+	td := &data.TemplateData{
+		Form: forms.New(nil),
+		Data: map[string]interface{}{
+			"Title":   "Two-Factor Authentication",
+			"Enabled": user.TOTPEnabled,
+		},
+	}
+
+	if !user.TOTPEnabled {
+		key, err := m.pendingTOTPKey(r.Context(), user)
+		if err != nil {
+			m.helpers.ServerError(w, err)
+			return
+		}
+
+		qr, err := qrCodeDataURL(key)
+		if err != nil {
+			m.helpers.ServerError(w, err)
+			return
+		}
+
+		td.Data["QRCode"] = qr
+		td.Data["Secret"] = key.Secret()
+	}
+
+	m.render.TemplateCache(w, r, "two-factor-setup.page.tmpl", td)
+}
+
+// pendingTOTPKey returns the secret being set up in this session, generating one the first time so
+// that a mistyped code doesn't mean scanning a new QR code.
+// The secret is only saved to the account once the user proves they can generate codes from it.
+func (m *Repository) pendingTOTPKey(ctx context.Context, user data.User) (*otp.Key, error) {
+	if setupURL := m.app.Session.GetString(ctx, "totp_setup_url"); setupURL != "" {
+		return otp.NewKeyFromURL(setupURL)
+	}
+
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      m.app.Settings.Auth.TOTPIssuer,
+		AccountName: user.Email,
+	})
+	if err != nil {
+		return nil, err
+	}
+	m.app.Session.Put(ctx, "totp_setup_url", key.URL())
+	return key, nil
+}
+
+// PostTwoFactorSetupHandler turns two-factor on once the user enters a valid code for the new
+// secret, and shows their recovery codes once
+func (m *Repository) PostTwoFactorSetupHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+
+	setupURL := m.app.Session.GetString(r.Context(), "totp_setup_url")
+	if setupURL == "" {
+		http.Redirect(w, r, "/user/two-factor/setup", http.StatusSeeOther)
+		return
+	}
+	key, err := otp.NewKeyFromURL(setupURL)
+	if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+
+	step, ok := totpStep(strings.TrimSpace(r.PostForm.Get("code")), key.Secret(), time.Now())
+	if !ok {
+		m.app.Session.Put(r.Context(), "error", "That code didn't match. Check your device's clock and try again.")
+		http.Redirect(w, r, "/user/two-factor/setup", http.StatusSeeOther)
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+
+	userID := m.app.Session.GetInt(r.Context(), "user_id")
+	if err := m.db.EnableTOTP(r.Context(), userID, key.Secret(), step, hashes); err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+	m.app.InfoLog.Printf("User %d turned on two-factor authentication", userID)
+
+	m.app.Session.Remove(r.Context(), "totp_setup_url")
+	m.app.Session.Put(r.Context(), "totp_enabled", true)
+
+	m.render.TemplateCache(w, r, "recovery-codes.page.tmpl", &data.TemplateData{
+		Data: map[string]interface{}{
+			"Title": "Recovery Codes",
+			"Codes": codes,
+		},
+	})
+}
+
+// PostTwoFactorDisableHandler turns two-factor off after checking a current code.
+// Staff can't turn it off while managers require it.
+func (m *Repository) PostTwoFactorDisableHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+
+	if m.helpers.UserRole(r).AtLeast(data.RoleStaff) {
+		required, err := m.db.RequireStaffTwoFactor(r.Context())
+		if err != nil {
+			m.helpers.ServerError(w, err)
+			return
+		}
+		if required {
+			m.app.Session.Put(r.Context(), "error", "Two-factor authentication is required for staff accounts")
+			http.Redirect(w, r, "/user/two-factor/setup", http.StatusSeeOther)
+			return
+		}
+	}
+
+	user, err := m.db.GetUserByID(r.Context(), m.app.Session.GetInt(r.Context(), "user_id"))
+	if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+
+	valid := false
+	if step, ok := totpStep(strings.TrimSpace(r.PostForm.Get("code")), user.TOTPSecret, time.Now()); ok && user.TOTPEnabled {
+		valid, err = m.useTOTPStep(r.Context(), user, step)
+		if err != nil {
+			m.helpers.ServerError(w, err)
+			return
+		}
+	}
+	if !valid {
+		m.app.Session.Put(r.Context(), "error", "Invalid authentication code")
+		http.Redirect(w, r, "/user/two-factor/setup", http.StatusSeeOther)
+		return
+	}
+
+	if err := m.db.DisableTOTP(r.Context(), user.Id); err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+	m.app.InfoLog.Printf("User %d turned off two-factor authentication", user.Id)
+
+	m.app.Session.Put(r.Context(), "totp_enabled", false)
+	m.app.Session.Put(r.Context(), "flash", "Two-factor authentication is off")
+	http.Redirect(w, r, "/user/two-factor/setup", http.StatusSeeOther)
+}
+
+// RequireTwoFactor sends staff without two-factor to the setup page while managers require it.
+// Use it inside authMiddleware.
+func (m *Repository) RequireTwoFactor(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !m.app.Session.GetBool(r.Context(), "totp_enabled") {
+			required, err := m.db.RequireStaffTwoFactor(r.Context())
+			if err != nil {
+				m.helpers.ServerError(w, err)
+				return
+			}
+			if required {
+				m.app.Session.Put(r.Context(), "warning", "Please set up two-factor authentication to use the admin pages")
+				http.Redirect(w, r, "/user/two-factor/setup", http.StatusSeeOther)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AdminSecurityHandler shows the account security policy
+func (m *Repository) AdminSecurityHandler(w http.ResponseWriter, r *http.Request) {
+	required, err := m.db.RequireStaffTwoFactor(r.Context())
+	if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+
+	m.render.TemplateCache(w, r, "admin-security.page.tmpl", &data.TemplateData{
+		Data: map[string]interface{}{
+			"Title":                 "Security",
+			"RequireStaffTwoFactor": required,
+		},
+	})
+}
+
+// PostAdminSecurityHandler updates the account security policy
+func (m *Repository) PostAdminSecurityHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+
+	required := r.PostForm.Get("require_staff_2fa") == "on"
+	if err := m.db.SetRequireStaffTwoFactor(r.Context(), required); err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+	m.app.InfoLog.Printf("User %d set staff two-factor requirement to %t", m.app.Session.GetInt(r.Context(), "user_id"), required)
+
+	m.app.Session.Put(r.Context(), "flash", "Security settings saved")
+	http.Redirect(w, r, "/admin/security", http.StatusSeeOther)
+}
+
+// qrCodeDataURL renders the key as a PNG QR code that can be used directly as an img src
+func qrCodeDataURL(key *otp.Key) (template.URL, error) {
+	img, err := key.Image(200, 200)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return "", err
+	}
+	return template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())), nil
+}
+
+// recoveryCodeAlphabet has 32 characters and leaves out i, l, o and 1, which are easy to misread
+const recoveryCodeAlphabet = "abcdefghjkmnpqrstuvwxyz023456789"
+
+// newRecoveryCodes returns n codes formatted as xxxxx-xxxxx for the user, and their hashes for storage
+func newRecoveryCodes(n int) ([]string, [][]byte, error) {
+	codes := make([]string, n)
+	hashes := make([][]byte, n)
+	for i := range codes {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, fmt.Errorf("failed to generate recovery code: %w", err)
+		}
+		for j := range b {
+			b[j] = recoveryCodeAlphabet[b[j]&31]
+		}
+		codes[i] = string(b[:5]) + "-" + string(b[5:])
+		hashes[i] = helpers.HashToken(string(b))
+	}
+	return codes, hashes, nil
+}
+
+// normalizeRecoveryCode strips the formatting users may or may not type
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
@@ -0,0 +1,330 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dunky-star/modern-webapp-golang/internal/data"
+	"github.com/dunky-star/modern-webapp-golang/internal/forms"
+	"github.com/dunky-star/modern-webapp-golang/internal/helpers"
+	"github.com/dunky-star/modern-webapp-golang/internal/repository"
+)
+
+// canManageUser reports whether a user with the actor role may edit or deactivate target.
+// Owners manage everyone; anyone else only manages users below their own role.
+func canManageUser(actor data.Role, target data.User) bool {
+	return actor.AtLeast(data.RoleOwner) || target.Role() < actor
+}
+
+// assignableRoles returns the roles a user with the actor role may give to others
+func assignableRoles(actor data.Role) []data.Role {
+	var roles []data.Role
+	for _, role := range data.Roles() {
+		if actor.AtLeast(data.RoleOwner) || role < actor {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+// roleAssignable reports whether role is one of roles
+func roleAssignable(roles []data.Role, role data.Role) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// AdminUsersHandler lists all users
+func (m *Repository) AdminUsersHandler(w http.ResponseWriter, r *http.Request) {
+	users, err := m.db.AllUsers(m.readContext(r))
+	if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+
+	m.render.TemplateCache(w, r, "admin-users.page.tmpl", &data.TemplateData{
+		Data: map[string]interface{}{
+			"Title":  "Users",
+			"Users":  users,
+			"Self":   m.app.Session.GetInt(r.Context(), "user_id"),
+			"CanAdd": len(assignableRoles(m.helpers.UserRole(r))) > 0,
+		},
+	})
+}
+
+// AdminNewUserHandler shows the form for inviting a user
+func (m *Repository) AdminNewUserHandler(w http.ResponseWriter, r *http.Request) {
+	m.render.TemplateCache(w, r, "admin-user.page.tmpl", &data.TemplateData{
+		Form: forms.New(nil),
+		Data: map[string]interface{}{
+			"Title": "Invite User",
+			"User":  data.User{AccessLevel: int(data.RoleStaff)},
+			"Roles": assignableRoles(m.helpers.UserRole(r)),
+		},
+	})
+}
+
+// PostAdminNewUserHandler creates the user and emails them a link to set their password
+func (m *Repository) PostAdminNewUserHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+
+	roles := assignableRoles(m.helpers.UserRole(r))
+	user := data.User{
+		FirstName: r.PostForm.Get("first_name"),
+		LastName:  r.PostForm.Get("last_name"),
+		Email:     strings.ToLower(strings.TrimSpace(r.PostForm.Get("email"))),
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("first_name", "last_name", "email")
+	form.IsEmail("email")
+	role, err := data.ParseRole(r.PostForm.Get("role"))
+	if err != nil || !roleAssignable(roles, role) {
+		form.Errors.Add("role", "You can't give that role")
+	}
+	user.AccessLevel = int(role)
+
+	if form.Valid() {
+		if _, err := m.db.GetUserByEmail(r.Context(), user.Email); err == nil {
+			form.Errors.Add("email", "A user with this email already exists")
+		} else if !errors.Is(err, repository.ErrUserNotFound) {
+			m.helpers.ServerError(w, err)
+			return
+		}
+	}
+
+	if !form.Valid() {
+		m.render.TemplateCache(w, r, "admin-user.page.tmpl", &data.TemplateData{
+			Form: form,
+			Data: map[string]interface{}{
+				"Title": "Invite User",
+				"User":  user,
+				"Roles": roles,
+			},
+		})
+		return
+	}
+
+	// The user can't log in until they follow the emailed link and choose their own password
+	password, _, err := helpers.NewToken()
+	if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+	user.Id, err = m.db.InsertUser(r.Context(), user, password)
+	if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+
+	if err := m.sendInvite(r, user); err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+	m.app.InfoLog.Printf("User %d invited %s as %s", m.app.Session.GetInt(r.Context(), "user_id"), user.Email, role)
+
+	m.readOwnWrites(r.Context())
+	m.app.Session.Put(r.Context(), "flash", fmt.Sprintf("Invitation sent to %s", user.Email))
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// sendInvite stores a token for the new user to set their password with and queues the invitation email
+func (m *Repository) sendInvite(r *http.Request, user data.User) error {
+	token, tokenHash, err := helpers.NewToken()
+	if err != nil {
+		return err
+	}
+
+	ttl := m.app.Settings.Auth.InviteTTL
+	if err := m.db.InsertPasswordReset(r.Context(), user.Id, tokenHash, time.Now().Add(ttl)); err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/user/reset-password?token=%s", m.app.BaseURL, url.QueryEscape(token))
+	htmlMessage := fmt.Sprintf(`
+	<strong>You're Invited</strong><br />
+	Dear %s, <br /><br />
+	An account has been created for you. Follow the link below within %d hours to choose your
+	password:<br /><br />
+	<a href="%s">%s</a><br /><br />
+	You can then log in with this email address.<br />
+	`, template.HTMLEscapeString(user.FirstName), int(ttl.Hours()), link, link)
+
+	m.sendMail(r, data.MailData{
+		To:       user.Email,
+		From:     m.app.Settings.Mail.From,
+		Subject:  "Your account has been created",
+		Content:  template.HTML(htmlMessage),
+		Template: "dunky.html",
+	})
+	return nil
+}
+
+// managedUser loads the user named in the path and checks the current user may manage them.
+// It writes the error response and returns false if not.
+func (m *Repository) managedUser(w http.ResponseWriter, r *http.Request) (data.User, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		m.helpers.ClientError(w, http.StatusNotFound)
+		return data.User{}, false
+	}
+
+	user, err := m.db.GetUserByID(r.Context(), id)
+	if errors.Is(err, repository.ErrUserNotFound) {
+		m.helpers.ClientError(w, http.StatusNotFound)
+		return data.User{}, false
+	} else if err != nil {
+		m.helpers.ServerError(w, err)
+		return data.User{}, false
+	}
+
+	self := user.Id == m.app.Session.GetInt(r.Context(), "user_id")
+	if !self && !canManageUser(m.helpers.UserRole(r), user) {
+		m.app.WarningLog.Printf("Denied %s %s: user %d can't manage user %d",
+			r.Method, r.URL.Path, m.app.Session.GetInt(r.Context(), "user_id"), user.Id)
+		m.helpers.ClientError(w, http.StatusForbidden)
+		return data.User{}, false
+	}
+	return user, true
+}
+
+// AdminUserHandler shows the form for editing a user
+func (m *Repository) AdminUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := m.managedUser(w, r)
+	if !ok {
+		return
+	}
+
+	m.render.TemplateCache(w, r, "admin-user.page.tmpl", &data.TemplateData{
+		Form: forms.New(nil),
+		Data: map[string]interface{}{
+			"Title": "Edit User",
+			"User":  user,
+			"Roles": assignableRoles(m.helpers.UserRole(r)),
+			"Self":  user.Id == m.app.Session.GetInt(r.Context(), "user_id"),
+		},
+	})
+}
+
+// PostAdminUserHandler updates a user's name and role. Users can't change their own role.
+func (m *Repository) PostAdminUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := m.managedUser(w, r)
+	if !ok {
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+
+	self := user.Id == m.app.Session.GetInt(r.Context(), "user_id")
+	roles := assignableRoles(m.helpers.UserRole(r))
+	oldRole := user.Role()
+	user.FirstName = r.PostForm.Get("first_name")
+	user.LastName = r.PostForm.Get("last_name")
+
+	form := forms.New(r.PostForm)
+	form.Required("first_name", "last_name")
+	if !self {
+		role, err := data.ParseRole(r.PostForm.Get("role"))
+		if err != nil || !roleAssignable(roles, role) {
+			form.Errors.Add("role", "You can't give that role")
+		}
+		user.AccessLevel = int(role)
+	} else if r.PostForm.Has("role") && r.PostForm.Get("role") != oldRole.String() {
+		if oldRole == data.RoleOwner {
+			form.Errors.Add("role", "You can't remove your own owner role")
+		} else {
+			form.Errors.Add("role", "You can't change your own role")
+		}
+	}
+
+	if !form.Valid() {
+		m.render.TemplateCache(w, r, "admin-user.page.tmpl", &data.TemplateData{
+			Form: form,
+			Data: map[string]interface{}{
+				"Title": "Edit User",
+				"User":  user,
+				"Roles": roles,
+				"Self":  self,
+			},
+		})
+		return
+	}
+
+	if err := m.db.UpdateUser(r.Context(), user); err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+
+	// Roles are read at login, so log the user out for a new role to take effect
+	if user.Role() != oldRole {
+		m.app.InfoLog.Printf("User %d changed the role of user %d from %s to %s",
+			m.app.Session.GetInt(r.Context(), "user_id"), user.Id, oldRole, user.Role())
+		if err := m.destroyUserSessions(r.Context(), user.Id); err != nil {
+			m.app.ErrorLog.Printf("Failed to end sessions for user %d after role change: %v", user.Id, err)
+		}
+	}
+
+	m.readOwnWrites(r.Context())
+	m.app.Session.Put(r.Context(), "flash", "User saved")
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// PostAdminDeactivateUserHandler stops a user from logging in and ends their sessions
+func (m *Repository) PostAdminDeactivateUserHandler(w http.ResponseWriter, r *http.Request) {
+	m.setUserActive(w, r, false)
+}
+
+// PostAdminActivateUserHandler lets a deactivated user log in again
+func (m *Repository) PostAdminActivateUserHandler(w http.ResponseWriter, r *http.Request) {
+	m.setUserActive(w, r, true)
+}
+
+// setUserActive deactivates or reactivates the user named in the path
+func (m *Repository) setUserActive(w http.ResponseWriter, r *http.Request, active bool) {
+	user, ok := m.managedUser(w, r)
+	if !ok {
+		return
+	}
+
+	if user.Id == m.app.Session.GetInt(r.Context(), "user_id") {
+		m.app.Session.Put(r.Context(), "error", "You can't deactivate your own account")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return
+	}
+
+	if err := m.db.SetUserActive(r.Context(), user.Id, active); err != nil {
+		m.helpers.ServerError(w, err)
+		return
+	}
+
+	action := "reactivated"
+	if !active {
+		action = "deactivated"
+		if err := m.destroyUserSessions(r.Context(), user.Id); err != nil {
+			m.app.ErrorLog.Printf("Failed to end sessions for deactivated user %d: %v", user.Id, err)
+		}
+		m.forgetAllDevices(r.Context(), user.Id)
+	}
+	m.app.InfoLog.Printf("User %d %s user %d", m.app.Session.GetInt(r.Context(), "user_id"), action, user.Id)
+
+	m.readOwnWrites(r.Context())
+	m.app.Session.Put(r.Context(), "flash", fmt.Sprintf("%s %s %s", user.FirstName, user.LastName, action))
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
@@ -1,44 +1,199 @@
 package helpers
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"runtime/debug"
+	"strings"
+	"time"
+	"unicode"
 
+	"github.com/alexedwards/scs/v2"
 	"github.com/dunky-star/modern-webapp-golang/internal/config"
+	"github.com/dunky-star/modern-webapp-golang/internal/data"
 )
 
-var app *config.AppConfig
+// Helpers provides error responses and auth checks that need the application config
+type Helpers struct {
+	app *config.AppConfig
+}
 
 // GetServerURL returns a formatted server URL string with hostname
-func GetServerURL(port int) string {
+func GetServerURL(port int, secure bool) string {
+	scheme := "http"
+	if secure {
+		scheme = "https"
+	}
 	addr := fmt.Sprintf(":%d", port)
 	hostname, err := os.Hostname()
 	if err != nil {
-		return fmt.Sprintf("http://0.0.0.0%s", addr)
+		return fmt.Sprintf("%s://0.0.0.0%s", scheme, addr)
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, hostname, addr)
+}
+
+// ClientIP returns the address of the client that sent the request
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
 	}
-	return fmt.Sprintf("http://%s%s", hostname, addr)
+	return host
 }
 
-func NewHelpers(a *config.AppConfig) {
-	app = a
+// New creates helpers for the given app config
+func New(a *config.AppConfig) *Helpers {
+	return &Helpers{app: a}
 }
 
 // ClientError writes a client error response (4xx status codes)
-func ClientError(w http.ResponseWriter, status int) {
-	app.InfoLog.Printf("Client error with status of %d", status)
+func (h *Helpers) ClientError(w http.ResponseWriter, status int) {
+	h.app.InfoLog.Printf("Client error with status of %d", status)
 	http.Error(w, http.StatusText(status), status)
 }
 
 // ServerError writes a server error response (500) and logs the error with stack trace
-func ServerError(w http.ResponseWriter, err error) {
+func (h *Helpers) ServerError(w http.ResponseWriter, err error) {
 	trace := fmt.Sprintf("%s\n%s", err.Error(), debug.Stack())
-	app.ErrorLog.Printf("ERROR\t %s", trace)
+	h.app.ErrorLog.Printf("ERROR\t %s", trace)
 	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 }
 
 // IsAuthenticated checks if the user is authenticated
-func IsAuthenticated(r *http.Request) bool {
-	return app.Session.Exists(r.Context(), "user_id")
+func (h *Helpers) IsAuthenticated(r *http.Request) bool {
+	return h.app.Session.Exists(r.Context(), "user_id")
+}
+
+// UserRole returns the logged-in user's role, or zero if nobody is logged in
+func (h *Helpers) UserRole(r *http.Request) data.Role {
+	if !h.IsAuthenticated(r) {
+		return 0
+	}
+	return data.RoleFromAccessLevel(h.app.Session.GetInt(r.Context(), "access_level"))
+}
+
+// confirmationAlphabet is Crockford's base32: no I, L, O or U, so codes are easy to read out
+const confirmationAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// NewConfirmationCode returns a random 10 character reservation confirmation code (50 bits)
+func NewConfirmationCode() (string, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate confirmation code: %w", err)
+	}
+	for i := range b {
+		b[i] = confirmationAlphabet[b[i]%32]
+	}
+	return string(b), nil
+}
+
+// NormalizeConfirmationCode undoes the usual mistakes when a code is typed in: lower case,
+// spaces and dashes, and letters that look like digits
+func NormalizeConfirmationCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		switch r = unicode.ToUpper(r); r {
+		case ' ', '-':
+			return -1
+		case 'O':
+			return '0'
+		case 'I', 'L':
+			return '1'
+		}
+		return r
+	}, code)
+}
+
+// NewToken returns a random URL-safe token to hand to the user and the hash to store in its place
+func NewToken() (string, []byte, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, fmt.Errorf("failed to generate token: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	return token, HashToken(token), nil
+}
+
+// HashToken returns the hash a token is stored under, so a database leak doesn't leak usable tokens
+func HashToken(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
+
+// SessionID identifies a session in pages and forms without revealing its token
+func SessionID(token string) string {
+	return hex.EncodeToString(HashToken(token)[:16])
+}
+
+// TouchSession records when and from where the logged-in user was last seen in this session.
+// It only writes once per interval so most requests don't have to save the session.
+func (h *Helpers) TouchSession(r *http.Request, interval time.Duration) {
+	ctx := r.Context()
+	lastSeen := time.Unix(h.app.Session.GetInt64(ctx, "last_seen"), 0)
+	ip := ClientIP(r)
+	if time.Since(lastSeen) < interval && h.app.Session.GetString(ctx, "ip_address") == ip {
+		return
+	}
+	h.app.Session.Put(ctx, "last_seen", time.Now().Unix())
+	h.app.Session.Put(ctx, "ip_address", ip)
+	h.app.Session.Put(ctx, "user_agent", r.UserAgent())
+}
+
+// UserSession describes the session stored under token, read straight from the session store.
+// ok is false if the session has ended or isn't the user's.
+func (h *Helpers) UserSession(ctx context.Context, userID int, token string) (info data.SessionInfo, ok bool, err error) {
+	current := h.app.Session.Token(ctx)
+	var get func(key string) interface{}
+	if token == current {
+		// This request's session may have changes that aren't saved yet
+		get = func(key string) interface{} { return h.app.Session.Get(ctx, key) }
+	} else {
+		b, found, err := h.findSession(ctx, token)
+		if err != nil || !found {
+			return data.SessionInfo{}, false, err
+		}
+		_, values, err := h.app.Session.Codec.Decode(b)
+		if err != nil {
+			return data.SessionInfo{}, false, err
+		}
+		get = func(key string) interface{} { return values[key] }
+	}
+
+	if id, _ := get("user_id").(int); id != userID {
+		return data.SessionInfo{}, false, nil
+	}
+	loginAt, _ := get("login_at").(int64)
+	lastSeen, _ := get("last_seen").(int64)
+	info = data.SessionInfo{
+		ID:       SessionID(token),
+		LoginAt:  time.Unix(loginAt, 0),
+		LastSeen: time.Unix(lastSeen, 0),
+		Current:  token == current,
+	}
+	info.UserAgent, _ = get("user_agent").(string)
+	info.IPAddress, _ = get("ip_address").(string)
+	info.RememberSelector, _ = get("remember_selector").(string)
+	return info, true, nil
+}
+
+// DestroySession deletes the session stored under token, logging out whoever holds it
+func (h *Helpers) DestroySession(ctx context.Context, token string) error {
+	if s, ok := h.app.Session.Store.(scs.CtxStore); ok {
+		return s.DeleteCtx(ctx, token)
+	}
+	return h.app.Session.Store.Delete(token)
+}
+
+// findSession returns the encoded session stored under token, if it hasn't expired
+func (h *Helpers) findSession(ctx context.Context, token string) ([]byte, bool, error) {
+	if s, ok := h.app.Session.Store.(scs.CtxStore); ok {
+		return s.FindCtx(ctx, token)
+	}
+	return h.app.Session.Store.Find(token)
 }
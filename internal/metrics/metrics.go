@@ -0,0 +1,209 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "webapp"
+
+// Metrics holds one application's metrics in its own registry, so several applications
+// in one process (e.g. in tests) don't collide
+type Metrics struct {
+	registry *prometheus.Registry
+	pools    *poolCollector
+
+	// HTTPRequests counts HTTP requests by route pattern, method and status
+	HTTPRequests *prometheus.CounterVec
+	// HTTPDuration observes request latency by route pattern, method and status
+	HTTPDuration *prometheus.HistogramVec
+	// MailSent counts emails successfully handed to the SMTP server
+	MailSent prometheus.Counter
+	// MailFailed counts emails that could not be sent
+	MailFailed prometheus.Counter
+	// ReservationsCreated counts reservations stored in the database
+	ReservationsCreated prometheus.Counter
+	// ReservationsCancelled counts reservations cancelled by guests
+	ReservationsCancelled prometheus.Counter
+	// Payments counts booking payments by outcome (captured, declined, expired, refunded)
+	Payments *prometheus.CounterVec
+	// LoginAttempts counts login attempts by outcome (success, failure, locked, ip_blocked)
+	LoginAttempts *prometheus.CounterVec
+	// CSRFFailures counts requests rejected by CSRF validation
+	CSRFFailures prometheus.Counter
+}
+
+// New creates a set of application metrics registered with a new registry
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		pools:    &poolCollector{},
+		HTTPRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "Total HTTP requests by route pattern, method and status code.",
+		}, []string{"route", "method", "status"}),
+		HTTPDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "HTTP request latency by route pattern, method and status code.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method", "status"}),
+		MailSent: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "mail_sent_total",
+			Help:      "Total emails sent successfully.",
+		}),
+		MailFailed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "mail_failed_total",
+			Help:      "Total emails that failed to send.",
+		}),
+		ReservationsCreated: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "reservations_created_total",
+			Help:      "Total reservations created.",
+		}),
+		ReservationsCancelled: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "reservations_cancelled_total",
+			Help:      "Total reservations cancelled by guests.",
+		}),
+		Payments: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "payments_total",
+			Help:      "Total booking payments by outcome.",
+		}, []string{"outcome"}),
+		LoginAttempts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "login_attempts_total",
+			Help:      "Total login attempts by outcome.",
+		}, []string{"outcome"}),
+		CSRFFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "csrf_validation_failures_total",
+			Help:      "Total requests that failed CSRF validation.",
+		}),
+	}
+
+	m.registry.MustRegister(
+		m.HTTPRequests,
+		m.HTTPDuration,
+		m.MailSent,
+		m.MailFailed,
+		m.ReservationsCreated,
+		m.ReservationsCancelled,
+		m.Payments,
+		m.LoginAttempts,
+		m.CSRFFailures,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.pools,
+	)
+	return m
+}
+
+// RegisterPool exposes connection pool statistics for the given pool getter, labelled with name
+// (e.g. "primary" or "replica"). A getter is used so the collector always reads the current pool.
+// Registering a name again replaces the earlier getter.
+func (m *Metrics) RegisterPool(name string, pool func() *pgxpool.Pool) {
+	m.pools.mu.Lock()
+	defer m.pools.mu.Unlock()
+	for i := range m.pools.pools {
+		if m.pools.pools[i].name == name {
+			m.pools.pools[i].pool = pool
+			return
+		}
+	}
+	m.pools.pools = append(m.pools.pools, namedPool{name: name, pool: pool})
+}
+
+// methods are the request methods given their own label value. Any other method, which a client
+// can make up freely, is counted as "other" so it can't add new series.
+var methods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodOptions: true,
+	http.MethodConnect: true,
+	http.MethodTrace:   true,
+}
+
+// ObserveRequest records one completed HTTP request
+func (m *Metrics) ObserveRequest(route, method string, status int, duration time.Duration) {
+	if route == "" {
+		route = "unmatched"
+	}
+	if !methods[method] {
+		method = "other"
+	}
+	code := strconv.Itoa(status)
+	m.HTTPRequests.WithLabelValues(route, method, code).Inc()
+	m.HTTPDuration.WithLabelValues(route, method, code).Observe(duration.Seconds())
+}
+
+// Handler returns the HTTP handler serving the metrics in Prometheus text format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+var (
+	poolAcquiredDesc = prometheus.NewDesc(namespace+"_db_pool_acquired_conns", "Connections currently acquired from the pool.", []string{"pool"}, nil)
+	poolIdleDesc     = prometheus.NewDesc(namespace+"_db_pool_idle_conns", "Idle connections in the pool.", []string{"pool"}, nil)
+	poolTotalDesc    = prometheus.NewDesc(namespace+"_db_pool_total_conns", "Total connections in the pool.", []string{"pool"}, nil)
+	poolMaxDesc      = prometheus.NewDesc(namespace+"_db_pool_max_conns", "Maximum size of the pool.", []string{"pool"}, nil)
+	poolAcquireDesc  = prometheus.NewDesc(namespace+"_db_pool_acquire_total", "Cumulative successful acquires from the pool.", []string{"pool"}, nil)
+	poolWaitDesc     = prometheus.NewDesc(namespace+"_db_pool_acquire_wait_seconds_total", "Cumulative time spent waiting to acquire a connection.", []string{"pool"}, nil)
+	poolEmptyDesc    = prometheus.NewDesc(namespace+"_db_pool_empty_acquire_total", "Cumulative acquires that had to wait for a connection.", []string{"pool"}, nil)
+)
+
+type namedPool struct {
+	name string
+	pool func() *pgxpool.Pool
+}
+
+// poolCollector reads pgxpool statistics at scrape time for every pool passed to RegisterPool
+type poolCollector struct {
+	mu    sync.Mutex
+	pools []namedPool
+}
+
+func (c *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- poolAcquiredDesc
+	ch <- poolIdleDesc
+	ch <- poolTotalDesc
+	ch <- poolMaxDesc
+	ch <- poolAcquireDesc
+	ch <- poolWaitDesc
+	ch <- poolEmptyDesc
+}
+
+func (c *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, np := range c.pools {
+		if p := np.pool(); p != nil {
+			collectPool(ch, np.name, p.Stat())
+		}
+	}
+}
+
+func collectPool(ch chan<- prometheus.Metric, name string, s *pgxpool.Stat) {
+	ch <- prometheus.MustNewConstMetric(poolAcquiredDesc, prometheus.GaugeValue, float64(s.AcquiredConns()), name)
+	ch <- prometheus.MustNewConstMetric(poolIdleDesc, prometheus.GaugeValue, float64(s.IdleConns()), name)
+	ch <- prometheus.MustNewConstMetric(poolTotalDesc, prometheus.GaugeValue, float64(s.TotalConns()), name)
+	ch <- prometheus.MustNewConstMetric(poolMaxDesc, prometheus.GaugeValue, float64(s.MaxConns()), name)
+	ch <- prometheus.MustNewConstMetric(poolAcquireDesc, prometheus.CounterValue, float64(s.AcquireCount()), name)
+	ch <- prometheus.MustNewConstMetric(poolWaitDesc, prometheus.CounterValue, s.AcquireDuration().Seconds(), name)
+	ch <- prometheus.MustNewConstMetric(poolEmptyDesc, prometheus.CounterValue, float64(s.EmptyAcquireCount()), name)
+}
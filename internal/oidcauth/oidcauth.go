@@ -0,0 +1,125 @@
+package oidcauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/dunky-star/modern-webapp-golang/internal/config"
+	"golang.org/x/oauth2"
+)
+
+// CallbackPath is where the identity provider sends users back to after they sign in
+const CallbackPath = "/user/oidc/callback"
+
+// ErrNonceMismatch means the ID token wasn't issued for this login attempt
+var ErrNonceMismatch = errors.New("oidc: id token nonce does not match")
+
+// Claims are the parts of the ID token used to find or create the user
+type Claims struct {
+	Issuer        string `json:"iss"`
+	Subject       string `json:"sub"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	GivenName     string `json:"given_name"`
+	FamilyName    string `json:"family_name"`
+}
+
+// Key identifies the user across email changes at the identity provider
+func (c Claims) Key() string {
+	return c.Issuer + "|" + c.Subject
+}
+
+// Client signs users in with an OpenID Connect provider using the authorization code flow with PKCE
+type Client struct {
+	settings    config.OIDCSettings
+	redirectURL string
+
+	mu       sync.Mutex
+	oauth    *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// New creates a client for the configured provider. The provider's discovery document is
+// fetched on first use, so the app still starts when the provider is down.
+func New(s config.OIDCSettings, baseURL string) *Client {
+	redirectURL := s.RedirectURL
+	if redirectURL == "" {
+		redirectURL = strings.TrimSuffix(baseURL, "/") + CallbackPath
+	}
+	return &Client{settings: s, redirectURL: redirectURL}
+}
+
+// ProviderName is the name shown on the login button
+func (c *Client) ProviderName() string {
+	return c.settings.ProviderName
+}
+
+// provider returns the OAuth2 config and ID token verifier, discovering the provider if needed
+func (c *Client) provider(ctx context.Context) (*oauth2.Config, *oidc.IDTokenVerifier, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.oauth != nil {
+		return c.oauth, c.verifier, nil
+	}
+
+	p, err := oidc.NewProvider(ctx, c.settings.Issuer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("oidc: discover %s: %w", c.settings.Issuer, err)
+	}
+
+	c.oauth = &oauth2.Config{
+		ClientID:     c.settings.ClientID,
+		ClientSecret: c.settings.ClientSecret,
+		RedirectURL:  c.redirectURL,
+		Endpoint:     p.Endpoint(),
+		Scopes:       []string{oidc.ScopeOpenID, "email", "profile"},
+	}
+	c.verifier = p.Verifier(&oidc.Config{ClientID: c.settings.ClientID})
+	return c.oauth, c.verifier, nil
+}
+
+// AuthCodeURL returns the provider's sign-in URL for this login attempt
+func (c *Client) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	cfg, _, err := c.provider(ctx)
+	if err != nil {
+		return "", err
+	}
+	return cfg.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier)), nil
+}
+
+// Exchange swaps the authorization code for tokens and returns the verified ID token's claims
+func (c *Client) Exchange(ctx context.Context, code, verifier, nonce string) (Claims, error) {
+	cfg, idVerifier, err := c.provider(ctx)
+	if err != nil {
+		return Claims{}, err
+	}
+
+	token, err := cfg.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return Claims{}, fmt.Errorf("oidc: exchange code: %w", err)
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return Claims{}, errors.New("oidc: token response has no id_token")
+	}
+
+	idToken, err := idVerifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return Claims{}, fmt.Errorf("oidc: verify id token: %w", err)
+	}
+	if idToken.Nonce != nonce {
+		return Claims{}, ErrNonceMismatch
+	}
+
+	var claims Claims
+	if err := idToken.Claims(&claims); err != nil {
+		return Claims{}, fmt.Errorf("oidc: read claims: %w", err)
+	}
+	return claims, nil
+}
@@ -0,0 +1,126 @@
+package oidcauth_test
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/dunky-star/modern-webapp-golang/internal/config"
+	"github.com/dunky-star/modern-webapp-golang/internal/oidcauth"
+	"github.com/dunky-star/modern-webapp-golang/internal/oidcauth/oidctest"
+)
+
+func newClient(t *testing.T) (*oidcauth.Client, *oidctest.Issuer) {
+	t.Helper()
+	issuer := oidctest.NewIssuer("bookings", "s3cret")
+	t.Cleanup(issuer.Close)
+
+	c := oidcauth.New(config.OIDCSettings{
+		Issuer:       issuer.URL,
+		ClientID:     "bookings",
+		ClientSecret: "s3cret",
+		ProviderName: "Test",
+	}, "http://localhost:3000/")
+	return c, issuer
+}
+
+func TestAuthCodeURL(t *testing.T) {
+	c, issuer := newClient(t)
+
+	raw, err := c.AuthCodeURL(context.Background(), "state-1", "nonce-1", "verifier-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+
+	if !strings.HasPrefix(raw, issuer.URL+"/authorize?") {
+		t.Errorf("URL = %s, want the issuer's authorization endpoint", raw)
+	}
+	if got := q.Get("redirect_uri"); got != "http://localhost:3000"+oidcauth.CallbackPath {
+		t.Errorf("redirect_uri = %q", got)
+	}
+	if q.Get("state") != "state-1" || q.Get("nonce") != "nonce-1" {
+		t.Errorf("state, nonce = %q, %q", q.Get("state"), q.Get("nonce"))
+	}
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		t.Errorf("missing PKCE challenge: %v", q)
+	}
+}
+
+func TestExchange(t *testing.T) {
+	c, issuer := newClient(t)
+
+	code := issuer.Authorize(oidctest.Identity{
+		Subject:       "user-1",
+		Email:         "Ann@Example.com",
+		EmailVerified: true,
+		GivenName:     "Ann",
+		FamilyName:    "Smith",
+		Nonce:         "nonce-1",
+	})
+	claims, err := c.Exchange(context.Background(), code, "verifier-1", "nonce-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := oidcauth.Claims{
+		Issuer:        issuer.URL,
+		Subject:       "user-1",
+		Email:         "Ann@Example.com",
+		EmailVerified: true,
+		GivenName:     "Ann",
+		FamilyName:    "Smith",
+	}
+	if claims != want {
+		t.Errorf("claims = %+v, want %+v", claims, want)
+	}
+	if claims.Key() != issuer.URL+"|user-1" {
+		t.Errorf("Key() = %q", claims.Key())
+	}
+
+	// Codes can only be exchanged once
+	if _, err := c.Exchange(context.Background(), code, "verifier-1", "nonce-1"); err == nil {
+		t.Error("reusing a code succeeded")
+	}
+}
+
+func TestExchangeNonceMismatch(t *testing.T) {
+	c, issuer := newClient(t)
+
+	code := issuer.Authorize(oidctest.Identity{Subject: "user-1", Email: "ann@example.com", EmailVerified: true, Nonce: "other"})
+	_, err := c.Exchange(context.Background(), code, "verifier-1", "nonce-1")
+	if !errors.Is(err, oidcauth.ErrNonceMismatch) {
+		t.Errorf("err = %v, want ErrNonceMismatch", err)
+	}
+}
+
+func TestExchangeUnverifiedEmail(t *testing.T) {
+	c, issuer := newClient(t)
+
+	// The token is valid; it's up to the caller to refuse the unverified email
+	code := issuer.Authorize(oidctest.Identity{Subject: "user-1", Email: "ann@example.com", Nonce: "nonce-1"})
+	claims, err := c.Exchange(context.Background(), code, "verifier-1", "nonce-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.EmailVerified {
+		t.Error("EmailVerified = true, want false")
+	}
+}
+
+func TestExchangeWrongClientSecret(t *testing.T) {
+	issuer := oidctest.NewIssuer("bookings", "s3cret")
+	defer issuer.Close()
+	c := oidcauth.New(config.OIDCSettings{Issuer: issuer.URL, ClientID: "bookings", ClientSecret: "wrong"}, "http://localhost:3000")
+
+	code := issuer.Authorize(oidctest.Identity{Subject: "user-1", Email: "ann@example.com", EmailVerified: true, Nonce: "nonce-1"})
+	if _, err := c.Exchange(context.Background(), code, "verifier-1", "nonce-1"); err == nil {
+		t.Error("exchange with the wrong client secret succeeded")
+	}
+}
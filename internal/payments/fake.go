@@ -0,0 +1,198 @@
+package payments
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	// FakeCheckoutPath is where the fake provider's checkout page is served, followed by the intent id
+	FakeCheckoutPath = "/payments/fake/"
+	// FakeSignatureHeader carries the hex HMAC-SHA256 of a fake webhook's body, keyed with the webhook secret
+	FakeSignatureHeader = "X-Fake-Signature"
+)
+
+// States of a fake payment
+const (
+	fakePending    = string(StatePending)
+	fakeAuthorized = string(StateAuthorized)
+	fakeDeclined   = string(StateDeclined)
+	fakeCaptured   = string(StateCaptured)
+	fakeRefunded   = string(StateRefunded)
+)
+
+// maxWebhookBody limits the size of webhook requests read by VerifyWebhook
+const maxWebhookBody = 64 << 10
+
+// FakeIntent is a payment held by the fake provider
+type FakeIntent struct {
+	IntentRequest
+	ID       string
+	Status   string
+	Refunded int64
+}
+
+// Fake is a Provider that keeps payments in memory. Guests "pay" on a local checkout page by
+// choosing whether the payment succeeds. Payments are lost on restart.
+type Fake struct {
+	secret  []byte
+	baseURL string
+
+	mu      sync.Mutex
+	intents map[string]*FakeIntent
+}
+
+// NewFake creates a fake provider whose checkout page is under baseURL. Webhooks are refused while
+// secret is empty.
+func NewFake(secret, baseURL string) *Fake {
+	return &Fake{
+		secret:  []byte(secret),
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		intents: make(map[string]*FakeIntent),
+	}
+}
+
+// Name identifies the provider in stored payments
+func (f *Fake) Name() string {
+	return ProviderFake
+}
+
+// CreateIntent starts a payment for the guest to authorize on the fake checkout page
+func (f *Fake) CreateIntent(ctx context.Context, req IntentRequest) (Intent, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return Intent{}, err
+	}
+	id := "fake_" + hex.EncodeToString(b)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.intents[id] = &FakeIntent{IntentRequest: req, ID: id, Status: fakePending}
+	return Intent{ID: id, CheckoutURL: f.baseURL + FakeCheckoutPath + id}, nil
+}
+
+// Capture takes an authorized payment. Capturing it again does nothing.
+func (f *Fake) Capture(ctx context.Context, intentID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	in, ok := f.intents[intentID]
+	if !ok {
+		return ErrUnknownIntent
+	}
+	switch in.Status {
+	case fakeAuthorized:
+		in.Status = fakeCaptured
+		return nil
+	case fakeCaptured:
+		return nil
+	case fakeDeclined:
+		return ErrDeclined
+	case fakePending:
+		return ErrNotAuthorized
+	default:
+		return fmt.Errorf("payments: can't capture a %s payment", in.Status)
+	}
+}
+
+// State returns where the payment stands
+func (f *Fake) State(ctx context.Context, intentID string) (State, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	in, ok := f.intents[intentID]
+	if !ok {
+		return "", ErrUnknownIntent
+	}
+	return State(in.Status), nil
+}
+
+// Refund gives back amount of a captured payment
+func (f *Fake) Refund(ctx context.Context, intentID string, amount int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	in, ok := f.intents[intentID]
+	if !ok {
+		return ErrUnknownIntent
+	}
+	if in.Status != fakeCaptured {
+		return fmt.Errorf("payments: can't refund a %s payment", in.Status)
+	}
+	if amount <= 0 || in.Refunded+amount > in.Amount {
+		return fmt.Errorf("payments: can't refund %d of %d with %d already refunded", amount, in.Amount, in.Refunded)
+	}
+	in.Refunded += amount
+	if in.Refunded == in.Amount {
+		in.Status = fakeRefunded
+	}
+	return nil
+}
+
+// VerifyWebhook checks the request's body is signed with the webhook secret and decodes its event
+func (f *Fake) VerifyWebhook(r *http.Request) (Event, error) {
+	if len(f.secret) == 0 {
+		return Event{}, ErrInvalidSignature
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookBody))
+	if err != nil {
+		return Event{}, err
+	}
+	got, err := hex.DecodeString(r.Header.Get(FakeSignatureHeader))
+	if err != nil || !hmac.Equal(got, f.sign(body)) {
+		return Event{}, ErrInvalidSignature
+	}
+
+	var e Event
+	if err := json.Unmarshal(body, &e); err != nil {
+		return Event{}, fmt.Errorf("payments: invalid webhook body: %w", err)
+	}
+	return e, nil
+}
+
+// sign is the HMAC-SHA256 of a webhook body
+func (f *Fake) sign(body []byte) []byte {
+	mac := hmac.New(sha256.New, f.secret)
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// Intent returns a copy of the payment, for the checkout page
+func (f *Fake) Intent(intentID string) (FakeIntent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	in, ok := f.intents[intentID]
+	if !ok {
+		return FakeIntent{}, ErrUnknownIntent
+	}
+	return *in, nil
+}
+
+// Complete records the guest's choice on the checkout page: an authorized payment if paid is
+// true, otherwise a declined one. It returns where to send the guest next.
+func (f *Fake) Complete(intentID string, paid bool) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	in, ok := f.intents[intentID]
+	if !ok {
+		return "", ErrUnknownIntent
+	}
+	if in.Status == fakePending {
+		in.Status = fakeDeclined
+		if paid {
+			in.Status = fakeAuthorized
+		}
+	}
+	return in.ReturnURL, nil
+}
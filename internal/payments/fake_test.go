@@ -0,0 +1,175 @@
+package payments
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newIntent(t *testing.T, f *Fake, amount int64) string {
+	t.Helper()
+	intent, err := f.CreateIntent(context.Background(), IntentRequest{
+		Amount: amount, Currency: "USD", Reference: "ABC123", ReturnURL: "http://localhost/return",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "http://localhost/payments/fake/" + intent.ID; intent.CheckoutURL != want {
+		t.Errorf("checkout URL = %q, want %q", intent.CheckoutURL, want)
+	}
+	return intent.ID
+}
+
+func status(t *testing.T, f *Fake, id string) string {
+	t.Helper()
+	in, err := f.Intent(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return in.Status
+}
+
+func TestFakeCapture(t *testing.T) {
+	ctx := context.Background()
+	f := NewFake("secret", "http://localhost/")
+
+	id := newIntent(t, f, 10000)
+	if err := f.Capture(ctx, id); !errors.Is(err, ErrNotAuthorized) {
+		t.Errorf("capture before paying: err = %v, want ErrNotAuthorized", err)
+	}
+
+	returnURL, err := f.Complete(id, true)
+	if err != nil || returnURL != "http://localhost/return" {
+		t.Fatalf("Complete = %q, %v", returnURL, err)
+	}
+	if got := status(t, f, id); got != fakeAuthorized {
+		t.Errorf("status after paying = %q, want %q", got, fakeAuthorized)
+	}
+	// The guest's choice can't be changed afterwards
+	if _, err := f.Complete(id, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Capture(ctx, id); err != nil {
+		t.Fatalf("capture: %v", err)
+	}
+	if err := f.Capture(ctx, id); err != nil {
+		t.Errorf("capturing again: %v, want no error", err)
+	}
+	if got := status(t, f, id); got != fakeCaptured {
+		t.Errorf("status after capture = %q, want %q", got, fakeCaptured)
+	}
+
+	declined := newIntent(t, f, 10000)
+	if _, err := f.Complete(declined, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Capture(ctx, declined); !errors.Is(err, ErrDeclined) {
+		t.Errorf("capture declined payment: err = %v, want ErrDeclined", err)
+	}
+
+	if err := f.Capture(ctx, "fake_unknown"); !errors.Is(err, ErrUnknownIntent) {
+		t.Errorf("capture unknown intent: err = %v, want ErrUnknownIntent", err)
+	}
+}
+
+func TestFakeRefund(t *testing.T) {
+	ctx := context.Background()
+	f := NewFake("secret", "http://localhost")
+
+	id := newIntent(t, f, 10000)
+	if err := f.Refund(ctx, id, 100); err == nil {
+		t.Error("refunding a payment that wasn't captured succeeded")
+	}
+	if _, err := f.Complete(id, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Capture(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		amount     int64
+		wantErr    bool
+		wantStatus string
+	}{
+		{"nothing", 0, true, fakeCaptured},
+		{"part", 4000, false, fakeCaptured},
+		{"more than is left", 6001, true, fakeCaptured},
+		{"the rest", 6000, false, fakeRefunded},
+		{"after a full refund", 1, true, fakeRefunded},
+	}
+	for _, tt := range tests {
+		err := f.Refund(ctx, id, tt.amount)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("refund %s: err = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		if got := status(t, f, id); got != tt.wantStatus {
+			t.Errorf("status after refunding %s = %q, want %q", tt.name, got, tt.wantStatus)
+		}
+	}
+
+	in, _ := f.Intent(id)
+	if in.Refunded != 10000 {
+		t.Errorf("refunded %d, want 10000", in.Refunded)
+	}
+}
+
+func webhook(body, signature string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/payments/webhook", strings.NewReader(body))
+	if signature != "" {
+		r.Header.Set(FakeSignatureHeader, signature)
+	}
+	return r
+}
+
+func sign(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestFakeVerifyWebhook(t *testing.T) {
+	body := `{"type":"payment.authorized","intent_id":"fake_123"}`
+
+	tests := []struct {
+		name      string
+		secret    string
+		signature string
+		wantErr   error
+	}{
+		{"good signature", "secret", sign("secret", body), nil},
+		{"signed with another secret", "secret", sign("other", body), ErrInvalidSignature},
+		{"not hex", "secret", "not-a-signature", ErrInvalidSignature},
+		{"no signature", "secret", "", ErrInvalidSignature},
+		{"no secret configured", "", sign("", body), ErrInvalidSignature},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := NewFake(tt.secret, "http://localhost")
+			e, err := f.VerifyWebhook(webhook(body, tt.signature))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && (e.Type != EventAuthorized || e.IntentID != "fake_123") {
+				t.Errorf("event = %+v", e)
+			}
+		})
+	}
+
+	t.Run("tampered body", func(t *testing.T) {
+		f := NewFake("secret", "http://localhost")
+		tampered := strings.Replace(body, "fake_123", "fake_456", 1)
+		if _, err := f.VerifyWebhook(webhook(tampered, sign("secret", body))); !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("err = %v, want ErrInvalidSignature", err)
+		}
+	})
+}
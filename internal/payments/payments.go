@@ -0,0 +1,95 @@
+package payments
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/dunky-star/modern-webapp-golang/internal/config"
+)
+
+// Supported providers
+const (
+	ProviderNone = "none" // Bookings are confirmed without payment
+	ProviderFake = "fake" // In-memory provider with a local checkout page, for development and tests
+)
+
+var (
+	// ErrNotAuthorized is returned by Capture while the guest hasn't paid yet
+	ErrNotAuthorized = errors.New("payments: payment has not been authorized")
+	// ErrDeclined is returned by Capture when the guest's payment was refused
+	ErrDeclined = errors.New("payments: payment was declined")
+	// ErrUnknownIntent is returned for an intent the provider doesn't know
+	ErrUnknownIntent = errors.New("payments: unknown payment intent")
+	// ErrInvalidSignature is returned by VerifyWebhook for requests the provider didn't send
+	ErrInvalidSignature = errors.New("payments: invalid webhook signature")
+)
+
+// IntentRequest describes a payment to ask the guest for
+type IntentRequest struct {
+	Amount      int64  // In the currency's minor unit
+	Currency    string // ISO 4217 code
+	Reference   string // Shown to the guest and on statements, e.g. the confirmation code
+	Description string
+	ReturnURL   string // Where the guest is sent back to once they've paid or given up
+}
+
+// Intent is a payment the guest has been asked to make
+type Intent struct {
+	ID          string // The provider's id for the payment
+	CheckoutURL string // Where the guest pays
+}
+
+// State is where a payment stands at the provider
+type State string
+
+const (
+	StatePending    State = "pending"    // The guest hasn't paid yet
+	StateAuthorized State = "authorized" // Paid and waiting to be captured
+	StateDeclined   State = "declined"
+	StateCaptured   State = "captured"
+	StateRefunded   State = "refunded" // Fully refunded
+)
+
+// EventType is the kind of webhook event
+type EventType string
+
+const (
+	EventAuthorized EventType = "payment.authorized" // The guest has paid and the payment can be captured
+	EventFailed     EventType = "payment.failed"     // The payment was declined or abandoned
+)
+
+// Event is a verified notification from the provider about a payment
+type Event struct {
+	Type     EventType `json:"type"`
+	IntentID string    `json:"intent_id"`
+}
+
+// Provider takes payments for bookings. The guest authorizes a payment at the intent's checkout
+// page and it's captured when they come back, or when a webhook says it was authorized. The room
+// is booked once it's captured; if someone else got it first, the payment is refunded.
+type Provider interface {
+	// Name identifies the provider in stored payments
+	Name() string
+	// CreateIntent starts a payment for the guest to authorize
+	CreateIntent(ctx context.Context, req IntentRequest) (Intent, error)
+	// Capture takes an authorized payment. Returns ErrNotAuthorized or ErrDeclined if there's nothing to take.
+	Capture(ctx context.Context, intentID string) error
+	// State returns where the payment stands, e.g. to finish a capture that was cut off
+	State(ctx context.Context, intentID string) (State, error)
+	// Refund gives back amount of a captured payment
+	Refund(ctx context.Context, intentID string, amount int64) error
+	// VerifyWebhook checks a webhook request came from the provider and returns its event
+	VerifyWebhook(r *http.Request) (Event, error)
+}
+
+// New creates the configured provider, or nil for ProviderNone. The settings have been validated,
+// so the provider is known.
+func New(s config.PaymentSettings, baseURL string) Provider {
+	switch s.Provider {
+	case ProviderFake:
+		return NewFake(s.WebhookSecret, baseURL)
+	default:
+		return nil
+	}
+}
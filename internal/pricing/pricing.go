@@ -0,0 +1,177 @@
+package pricing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dunky-star/modern-webapp-golang/internal/data"
+	"github.com/dunky-star/modern-webapp-golang/internal/repository"
+)
+
+// standardRate names nights charged at the room's own nightly rate
+const standardRate = "Standard rate"
+
+// PromoError explains to the guest why a promo code can't be used
+type PromoError struct {
+	Reason string
+}
+
+func (e *PromoError) Error() string {
+	return e.Reason
+}
+
+// errPromoInvalid is given for unknown and deactivated codes alike
+var errPromoInvalid = &PromoError{Reason: "That promo code isn't valid"}
+
+// Service prices stays from the rooms' rates and rate overrides
+type Service struct {
+	db       repository.DatabaseConn
+	currency string
+}
+
+// New creates a pricing service for rates stored in currency
+func New(db repository.DatabaseConn, currency string) *Service {
+	return &Service{db: db, currency: currency}
+}
+
+// Quote prices the reservation's stay in its room, less the discount of the promo code it was
+// booked with. The code only has to suit the stay's length again, as the rest was checked when
+// it was redeemed; a *PromoError is returned if it doesn't.
+func (s *Service) Quote(ctx context.Context, res data.Reservation) (data.Quote, error) {
+	room, err := s.db.GetRoomByID(ctx, res.RoomId)
+	if err != nil {
+		return data.Quote{}, err
+	}
+	q, err := s.QuoteRoom(ctx, room, res.StartDate, res.EndDate)
+	if err != nil || res.PromoCodeId == 0 {
+		return q, err
+	}
+
+	p, err := s.db.GetPromoCodeByID(ctx, res.PromoCodeId)
+	if err != nil {
+		return data.Quote{}, err
+	}
+	if len(q.Nights) < p.MinNights {
+		return data.Quote{}, minNightsError(p)
+	}
+	q.PromoCode, q.Discount = p.Code, p.Discount(q.Total)
+	return q, nil
+}
+
+// ApplyPromo takes the discount of the promo code off the quote for a stay in the room, and
+// returns the code for the reservation to be booked with. A *PromoError is returned if the code
+// can't be used.
+func (s *Service) ApplyPromo(ctx context.Context, q *data.Quote, code string, roomID int) (data.PromoCode, error) {
+	p, err := s.db.GetPromoCodeByCode(ctx, NormalizeCode(code))
+	if errors.Is(err, repository.ErrPromoCodeNotFound) {
+		return data.PromoCode{}, errPromoInvalid
+	} else if err != nil {
+		return data.PromoCode{}, err
+	}
+
+	if err := CheckPromo(p, roomID, len(q.Nights), time.Now()); err != nil {
+		return data.PromoCode{}, err
+	}
+	q.PromoCode, q.Discount = p.Code, p.Discount(q.Total)
+	return p, nil
+}
+
+// CheckPromo returns a *PromoError if the promo code can't be used on the day for a stay of
+// nights in the room
+func CheckPromo(p data.PromoCode, roomID, nights int, day time.Time) error {
+	y, m, d := day.Date()
+	today := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	switch {
+	case !p.Active:
+		return errPromoInvalid
+	case p.ValidFrom != nil && today.Before(*p.ValidFrom):
+		return &PromoError{Reason: "That promo code can't be used until " + p.ValidFrom.Format("02 Jan 2006")}
+	case p.ValidUntil != nil && today.After(*p.ValidUntil):
+		return &PromoError{Reason: "That promo code has expired"}
+	case p.MaxUses > 0 && p.Uses >= p.MaxUses:
+		return &PromoError{Reason: "That promo code has been used up"}
+	case !p.AppliesToRoom(roomID):
+		return &PromoError{Reason: "That promo code can't be used for this room"}
+	case nights < p.MinNights:
+		return minNightsError(p)
+	}
+	return nil
+}
+
+// minNightsError explains that the stay is too short for the promo code
+func minNightsError(p data.PromoCode) error {
+	return &PromoError{Reason: fmt.Sprintf("That promo code needs a stay of at least %d nights", p.MinNights)}
+}
+
+// NormalizeCode puts a promo code as typed by a guest or admin in its stored, upper case form
+func NormalizeCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// QuoteRoom prices a stay from start to end in an already loaded room
+func (s *Service) QuoteRoom(ctx context.Context, room data.Room, start, end time.Time) (data.Quote, error) {
+	overrides, err := s.db.RoomRateOverrides(ctx, room.Id, start, end)
+	if err != nil {
+		return data.Quote{}, err
+	}
+	return Calculate(room, overrides, start, end, s.currency), nil
+}
+
+// Calculate prices each night from start up to (not including) end. A night uses the most
+// specific override that covers it: dated weekend rates, then dated rates, then undated weekend
+// rates, and otherwise the room's own rate. Among equally specific overrides the most recently
+// added wins.
+func Calculate(room data.Room, overrides []data.RateOverride, start, end time.Time, currency string) data.Quote {
+	q := data.Quote{Currency: currency}
+	for night := start; night.Before(end); night = night.AddDate(0, 0, 1) {
+		price := data.NightPrice{Date: night, RateName: standardRate, Rate: room.NightlyRate}
+		best := -1
+		for _, o := range overrides {
+			if !applies(o, night) {
+				continue
+			}
+			if rank := specificity(o); rank >= best {
+				best = rank
+				price.RateName, price.Rate = o.Name, o.NightlyRate
+			}
+		}
+		q.Nights = append(q.Nights, price)
+		q.Total += price.Rate
+	}
+	return q
+}
+
+// applies reports whether the override covers the night starting on date
+func applies(o data.RateOverride, date time.Time) bool {
+	if o.WeekendsOnly && !isWeekendNight(date) {
+		return false
+	}
+	if o.StartDate != nil && date.Before(*o.StartDate) {
+		return false
+	}
+	if o.EndDate != nil && date.After(*o.EndDate) {
+		return false
+	}
+	return true
+}
+
+// specificity ranks overrides so a dated one beats an undated one, and a weekend one beats an
+// every-night one with the same dating
+func specificity(o data.RateOverride) int {
+	rank := 0
+	if o.StartDate != nil || o.EndDate != nil {
+		rank += 2
+	}
+	if o.WeekendsOnly {
+		rank++
+	}
+	return rank
+}
+
+// isWeekendNight reports whether the night starting on date is a Friday or Saturday night
+func isWeekendNight(date time.Time) bool {
+	return date.Weekday() == time.Friday || date.Weekday() == time.Saturday
+}
@@ -0,0 +1,79 @@
+package pricing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dunky-star/modern-webapp-golang/internal/data"
+)
+
+func date(s string) time.Time {
+	t, err := time.Parse(time.DateOnly, s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func datePtr(s string) *time.Time {
+	t := date(s)
+	return &t
+}
+
+func TestCalculate(t *testing.T) {
+	room := data.Room{Id: 1, NightlyRate: 10000}
+	weekend := data.RateOverride{Name: "Weekend", WeekendsOnly: true, NightlyRate: 12000}
+	summer := data.RateOverride{Name: "Summer", StartDate: datePtr("2026-07-01"), EndDate: datePtr("2026-08-31"), NightlyRate: 15000}
+	summerWeekend := data.RateOverride{Name: "Summer weekend", StartDate: datePtr("2026-07-01"), EndDate: datePtr("2026-08-31"),
+		WeekendsOnly: true, NightlyRate: 18000}
+	all := []data.RateOverride{summerWeekend, summer, weekend}
+
+	// 2026-06-25 and 2026-07-02 are Thursdays
+	tests := []struct {
+		name      string
+		overrides []data.RateOverride
+		start     string
+		end       string
+		want      []string // Rate name for each night
+		wantTotal int64
+	}{
+		{"no overrides", nil, "2026-06-22", "2026-06-24", []string{standardRate, standardRate}, 20000},
+		{"weekend nights are Friday and Saturday", all, "2026-06-25", "2026-06-29",
+			[]string{standardRate, "Weekend", "Weekend", standardRate}, 44000},
+		{"dated beats undated weekend, dated weekend beats dated", all, "2026-07-02", "2026-07-05",
+			[]string{"Summer", "Summer weekend", "Summer weekend"}, 51000},
+		{"season dates are inclusive", []data.RateOverride{{Name: "Fair", StartDate: datePtr("2026-07-01"),
+			EndDate: datePtr("2026-07-02"), NightlyRate: 20000}}, "2026-06-30", "2026-07-04",
+			[]string{standardRate, "Fair", "Fair", standardRate}, 60000},
+		{"open-ended season", []data.RateOverride{{Name: "New prices", StartDate: datePtr("2026-07-01"), NightlyRate: 11000}},
+			"2026-06-30", "2026-07-02", []string{standardRate, "New prices"}, 21000},
+		{"most recently added wins a tie", []data.RateOverride{summer, {Name: "Festival", StartDate: datePtr("2026-07-01"),
+			EndDate: datePtr("2026-07-31"), NightlyRate: 25000}}, "2026-07-06", "2026-07-07", []string{"Festival"}, 25000},
+		{"empty stay", all, "2026-07-02", "2026-07-02", nil, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := Calculate(room, tt.overrides, date(tt.start), date(tt.end), "USD")
+
+			var got []string
+			for _, n := range q.Nights {
+				got = append(got, n.RateName)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("nights = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("night %d rate = %q, want %q", i, got[i], tt.want[i])
+				}
+			}
+			if q.Total != tt.wantTotal {
+				t.Errorf("total = %d, want %d", q.Total, tt.wantTotal)
+			}
+			if q.Currency != "USD" {
+				t.Errorf("currency = %q, want USD", q.Currency)
+			}
+		})
+	}
+}
@@ -12,23 +12,29 @@ import (
 	"github.com/alexedwards/scs/v2"
 	"github.com/dunky-star/modern-webapp-golang/internal/config"
 	"github.com/dunky-star/modern-webapp-golang/internal/data"
-	"github.com/dunky-star/modern-webapp-golang/internal/helpers"
+	"github.com/dunky-star/modern-webapp-golang/internal/tracing"
 	"github.com/dunky-star/modern-webapp-golang/pkg/csrf"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-var app *config.AppConfig
 var pathToTemplates = "./web"
 
 // SessionManagerKey is the context key for the session manager (exported for middleware use)
 type SessionManagerKey struct{}
 
-// NewTemplates sets the config for the template package
-func NewRender(a *config.AppConfig) {
-	app = a
+// Renderer renders page templates with the application's template cache
+type Renderer struct {
+	app     *config.AppConfig
+	tracing *tracing.Provider
+}
+
+// New creates a renderer for the given app config, tracing each render with tp
+func New(a *config.AppConfig, tp *tracing.Provider) *Renderer {
+	return &Renderer{app: a, tracing: tp}
 }
 
 // AddDefaultData adds data for all templates
-func AddDefaultData(td *data.TemplateData, r *http.Request) *data.TemplateData {
+func (re *Renderer) AddDefaultData(td *data.TemplateData, r *http.Request) *data.TemplateData {
 	// Extract session manager from context (injected by middleware)
 	if session := getSessionManagerFromContext(r.Context()); session != nil {
 		td.Flash = session.PopString(r.Context(), "flash")
@@ -40,19 +46,22 @@ func AddDefaultData(td *data.TemplateData, r *http.Request) *data.TemplateData {
 	if token := getCSRFTokenFromContext(r.Context()); token != "" {
 		td.SetCSRFToken(token)
 	}
-	// Check if the user is authenticated
-	td.IsAuthenticated = helpers.IsAuthenticated(r) || app.Session.Exists(r.Context(), "user_id")
+	// Check if the user is authenticated and what they may do
+	td.IsAuthenticated = re.app.Session.Exists(r.Context(), "user_id")
+	if td.IsAuthenticated {
+		td.Role = data.RoleFromAccessLevel(re.app.Session.GetInt(r.Context(), "access_level"))
+	}
 
 	return td
 }
 
 // TemplateCache renders a template
-func TemplateCache(w http.ResponseWriter, r *http.Request, tmpl string, td *data.TemplateData) error {
+func (re *Renderer) TemplateCache(w http.ResponseWriter, r *http.Request, tmpl string, td *data.TemplateData) error {
 	var tc map[string]*template.Template
 
-	if app != nil && app.TemplateCache != nil {
+	if re.app.TemplateCache != nil {
 		// Always use the pre-built template cache from app config
-		tc = app.TemplateCache
+		tc = re.app.TemplateCache
 	} else {
 		// Fallback: create cache on-the-fly if not initialized (shouldn't happen in normal operation)
 		tc, _ = CreateTemplateCache()
@@ -63,11 +72,13 @@ func TemplateCache(w http.ResponseWriter, r *http.Request, tmpl string, td *data
 		return errors.New("could not get template from cache")
 	}
 
+	_, span := re.tracing.Start(r.Context(), "render "+tmpl, attribute.String("template.name", tmpl))
+
 	buf := new(bytes.Buffer)
 
-	td = AddDefaultData(td, r)
+	td = re.AddDefaultData(td, r)
 
-	_ = t.Execute(buf, td)
+	tracing.End(span, t.Execute(buf, td))
 
 	_, err := buf.WriteTo(w)
 	if err != nil {
@@ -1,19 +1,43 @@
 package dbrepo
 
 import (
+	"context"
+	"sync"
+
 	"github.com/dunky-star/modern-webapp-golang/internal/config"
 	"github.com/dunky-star/modern-webapp-golang/internal/repository"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 type DBConnection struct {
-	App *config.AppConfig
-	DB  *pgxpool.Pool
+	App    *config.AppConfig
+	DB     *pgxpool.Pool
+	ReadDB *pgxpool.Pool // Read-only queries (availability search, pricing, admin lists); may be a replica
+
+	dummyPasswordHash func() []byte
+}
+
+// NewDBConnection creates the repository. readConn may be nil, in which case reads use conn.
+func NewDBConnection(conn *pgxpool.Pool, readConn *pgxpool.Pool, app *config.AppConfig) repository.DatabaseConn {
+	if readConn == nil {
+		readConn = conn
+	}
+	d := &DBConnection{
+		App:    app,
+		DB:     conn,
+		ReadDB: readConn,
+	}
+	d.dummyPasswordHash = sync.OnceValue(func() []byte {
+		hash, _ := d.hashPassword("not-a-real-password")
+		return hash
+	})
+	return d
 }
 
-func NewDBConnection(conn *pgxpool.Pool, app *config.AppConfig) repository.DatabaseConn {
-	return &DBConnection{
-		App: app,
-		DB:  conn,
+// reader returns the pool for a read-only query: ReadDB, unless ctx asks for primary reads
+func (d *DBConnection) reader(ctx context.Context) *pgxpool.Pool {
+	if repository.PrimaryReads(ctx) {
+		return d.DB
 	}
+	return d.ReadDB
 }
@@ -6,25 +6,69 @@ import (
 	"time"
 
 	"github.com/dunky-star/modern-webapp-golang/internal/data"
+	"github.com/dunky-star/modern-webapp-golang/internal/repository"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"golang.org/x/crypto/bcrypt"
 )
 
-func (d *DBConnection) AllUsers() bool {
-	return true
+// AllUsers returns every user, ordered by name
+func (d *DBConnection) AllUsers(ctx context.Context) ([]data.User, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `SELECT id, first_name, last_name, email, access_level, totp_enabled, active, created_at, updated_at
+			  FROM users
+			  ORDER BY last_name, first_name, id`
+	rows, err := d.reader(ctx).Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []data.User
+	for rows.Next() {
+		var u data.User
+		err := rows.Scan(
+			&u.Id,
+			&u.FirstName,
+			&u.LastName,
+			&u.Email,
+			&u.AccessLevel,
+			&u.TOTPEnabled,
+			&u.Active,
+			&u.CreatedAt,
+			&u.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+
+	return users, rows.Err()
 }
 
-// InsertReservation inserts a reservation into the database
-func (d *DBConnection) InsertReservation(res data.Reservation) (int, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// InsertReservation inserts a reservation waiting to be confirmed into the database, redeeming its
+// promo code if it has one in the same transaction. Returns repository.ErrPromoCodeUsedUp or
+// repository.ErrPromoCodeNotFound if the code can no longer be used.
+func (d *DBConnection) InsertReservation(ctx context.Context, res data.Reservation) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 
 	defer cancel()
 
+	tx, err := d.DB.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
 	var newId int
 
 	stmt := `INSERT INTO reservations (first_name, last_name, email, phone, start_date,
-	         end_date, room_id, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) returning id`
+	         end_date, room_id, created_at, updated_at, confirmation_code, total_price, currency, hold_until)
+	         VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, NULLIF($10, ''), $11, NULLIF($12, ''), $13) returning id`
 
-	err := d.DB.QueryRow(ctx, stmt,
+	err = tx.QueryRow(ctx, stmt,
 		res.FirstName,
 		res.LastName,
 		res.Email,
@@ -34,6 +78,10 @@ func (d *DBConnection) InsertReservation(res data.Reservation) (int, error) {
 		res.RoomId,
 		time.Now(),
 		time.Now(),
+		res.ConfirmationCode,
+		res.TotalPrice,
+		res.Currency,
+		res.HoldUntil,
 	).Scan(&newId)
 
 	if err != nil {
@@ -42,45 +90,270 @@ func (d *DBConnection) InsertReservation(res data.Reservation) (int, error) {
 		return 0, err
 	}
 
-	return newId, nil
+	if res.PromoCodeId != 0 {
+		if err := redeemPromoCode(ctx, tx, res.PromoCodeId, newId, res.Discount); err != nil {
+			return 0, err
+		}
+	}
+
+	return newId, tx.Commit(ctx)
+}
+
+// redeemPromoCode records the reservation's use of a promo code, checking the code is still
+// active and under its usage limit
+func redeemPromoCode(ctx context.Context, tx pgx.Tx, promoCodeID, reservationID int, discount int64) error {
+	// Locking the code makes concurrent bookings with it take turns, so the count below
+	// includes every earlier redemption
+	var active bool
+	var maxUses *int
+	err := tx.QueryRow(ctx, `SELECT active, max_uses FROM promo_codes WHERE id = $1 FOR UPDATE`, promoCodeID).Scan(&active, &maxUses)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && !active) {
+		return repository.ErrPromoCodeNotFound
+	} else if err != nil {
+		return err
+	}
+
+	if maxUses != nil {
+		var uses int
+		if err := tx.QueryRow(ctx, `SELECT `+promoCodeUses+` FROM promo_codes p WHERE p.id = $1`, promoCodeID).Scan(&uses); err != nil {
+			return err
+		}
+		if uses >= *maxUses {
+			return repository.ErrPromoCodeUsedUp
+		}
+	}
+
+	_, err = tx.Exec(ctx, `INSERT INTO promo_redemptions (promo_code_id, reservation_id, discount) VALUES ($1, $2, $3)`,
+		promoCodeID, reservationID, discount)
+	return err
 }
 
-// InsertRoomRestriction inserts a room restriction into the database
-func (d *DBConnection) InsertRoomRestriction(r data.RoomRestriction) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// GuestReservations returns every confirmed reservation made with the email, latest stay first
+func (d *DBConnection) GuestReservations(ctx context.Context, email string) ([]data.Reservation, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
-	stmt := `INSERT INTO room_restrictions (start_date, end_date, room_id, reservation_id,
-		     created_at, updated_at, restriction_id) VALUES ($1, $2, $3, $4, $5, $6, $7)`
-	_, err := d.DB.Exec(ctx, stmt,
-		r.StartDate,
-		r.EndDate,
-		r.RoomId,
-		r.ReservationId,
-		time.Now(),
-		time.Now(),
-		r.RestrictionId,
-	)
+	// Read from the primary so a booking made a moment ago is listed
+	query := reservationQuery + `
+			  WHERE LOWER(r.email) = LOWER($1) AND r.confirmed_at IS NOT NULL
+			  ORDER BY r.start_date DESC, r.id DESC`
+	rows, err := d.DB.Query(ctx, query, email)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var reservations []data.Reservation
+	for rows.Next() {
+		res, err := scanReservation(rows)
+		if err != nil {
+			return nil, err
+		}
+		reservations = append(reservations, res)
+	}
+	return reservations, rows.Err()
+}
+
+// reservationQuery selects the columns scanReservation reads, with the room name and any promo code
+const reservationQuery = `SELECT r.id, r.first_name, r.last_name, r.email, COALESCE(r.phone, ''), r.start_date, r.end_date,
+			  r.room_id, r.created_at, r.updated_at, COALESCE(r.confirmation_code, ''), r.cancelled_at,
+			  COALESCE(r.total_price, 0), COALESCE(r.currency, ''), rm.room_name,
+			  COALESCE(pr.promo_code_id, 0), COALESCE(pc.code, ''), COALESCE(pr.discount, 0), r.confirmed_at, r.hold_until
+			  FROM reservations r
+			  JOIN rooms rm ON rm.id = r.room_id
+			  LEFT JOIN promo_redemptions pr ON pr.reservation_id = r.id
+			  LEFT JOIN promo_codes pc ON pc.id = pr.promo_code_id`
+
+// scanReservation reads a row selected with reservationQuery
+func scanReservation(row pgx.Row) (data.Reservation, error) {
+	var res data.Reservation
+	err := row.Scan(
+		&res.Id,
+		&res.FirstName,
+		&res.LastName,
+		&res.Email,
+		&res.Phone,
+		&res.StartDate,
+		&res.EndDate,
+		&res.RoomId,
+		&res.CreatedAt,
+		&res.UpdatedAt,
+		&res.ConfirmationCode,
+		&res.CancelledAt,
+		&res.TotalPrice,
+		&res.Currency,
+		&res.Room.RoomName,
+		&res.PromoCodeId,
+		&res.PromoCode,
+		&res.Discount,
+		&res.ConfirmedAt,
+		&res.HoldUntil)
+	res.Room.Id = res.RoomId
+	return res, err
+}
+
+// GetReservationByCode returns the confirmed reservation with the confirmation code, cancelled or not
+func (d *DBConnection) GetReservationByCode(ctx context.Context, code string) (data.Reservation, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	res, err := scanReservation(d.DB.QueryRow(ctx, reservationQuery+` WHERE r.confirmation_code = $1 AND r.confirmed_at IS NOT NULL`, code))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return data.Reservation{}, repository.ErrReservationNotFound
+	}
+	return res, err
+}
+
+// GetReservationByID returns the reservation with the id, whether it's confirmed, waiting for payment or cancelled
+func (d *DBConnection) GetReservationByID(ctx context.Context, id int) (data.Reservation, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
 
+	res, err := scanReservation(d.DB.QueryRow(ctx, reservationQuery+` WHERE r.id = $1`, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return data.Reservation{}, repository.ErrReservationNotFound
+	}
+	return res, err
+}
+
+// CancelReservation marks the reservation cancelled and frees its room dates in one transaction.
+// Returns repository.ErrReservationNotFound if it doesn't exist or was already cancelled.
+func (d *DBConnection) CancelReservation(ctx context.Context, id int) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := d.DB.Begin(ctx)
 	if err != nil {
-		d.App.ErrorLog.Println(err)
-		d.App.ErrorLog.Println("Error inserting room restriction into database")
 		return err
 	}
+	defer tx.Rollback(ctx)
 
-	return nil
+	tag, err := tx.Exec(ctx, `UPDATE reservations SET cancelled_at = NOW(), updated_at = NOW()
+		WHERE id = $1 AND cancelled_at IS NULL`, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return repository.ErrReservationNotFound
+	}
+
+	if _, err := tx.Exec(ctx, `DELETE FROM room_restrictions WHERE reservation_id = $1`, id); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// ChangeReservationDates moves a reservation and its room restriction to new dates, with the
+// new total price in currency and promo code discount, in one transaction, checking again that nobody else
+// has the room then. Returns repository.ErrRoomUnavailable if they do, or
+// repository.ErrReservationNotFound if the reservation doesn't exist or is cancelled.
+func (d *DBConnection) ChangeReservationDates(ctx context.Context, id int, start, end time.Time, totalPrice, discount int64, currency string) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := d.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// Locking the room makes concurrent date changes for it wait for each other
+	var roomID int
+	err = tx.QueryRow(ctx, `SELECT rm.id FROM reservations r JOIN rooms rm ON rm.id = r.room_id
+		WHERE r.id = $1 AND r.cancelled_at IS NULL FOR UPDATE OF rm`, id).Scan(&roomID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return repository.ErrReservationNotFound
+	} else if err != nil {
+		return err
+	}
+
+	var clashes int
+	err = tx.QueryRow(ctx, `SELECT COUNT(id) FROM room_restrictions WHERE room_id = $1 AND $2 < end_date AND $3 > start_date
+		AND reservation_id IS DISTINCT FROM $4`, roomID, start, end, id).Scan(&clashes)
+	if err != nil {
+		return err
+	}
+	if clashes > 0 {
+		return repository.ErrRoomUnavailable
+	}
+
+	// Reservations made before prices were stored get the currency along with their first price
+	if _, err := tx.Exec(ctx, `UPDATE reservations SET start_date = $1, end_date = $2, total_price = $3, currency = $4, updated_at = NOW()
+		WHERE id = $5`, start, end, totalPrice, currency, id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `UPDATE room_restrictions SET start_date = $1, end_date = $2, updated_at = NOW() WHERE reservation_id = $3`,
+		start, end, id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `UPDATE promo_redemptions SET discount = $1 WHERE reservation_id = $2`, discount, id); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// ConfirmReservation books the room for a reservation waiting to be confirmed, once it's paid
+// for with the payment (0 if there was nothing to pay), checking in one transaction that nobody
+// else has the room for its dates. Returns repository.ErrRoomUnavailable if they do, or
+// repository.ErrReservationNotFound if the reservation doesn't exist, is cancelled or is already confirmed.
+func (d *DBConnection) ConfirmReservation(ctx context.Context, id, paymentID int) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := d.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// Locking the room makes concurrent bookings and date changes for it wait for each other
+	var roomID int
+	var start, end time.Time
+	err = tx.QueryRow(ctx, `SELECT rm.id, r.start_date, r.end_date FROM reservations r JOIN rooms rm ON rm.id = r.room_id
+		WHERE r.id = $1 AND r.cancelled_at IS NULL AND r.confirmed_at IS NULL FOR UPDATE OF r, rm`, id).Scan(&roomID, &start, &end)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return repository.ErrReservationNotFound
+	} else if err != nil {
+		return err
+	}
+
+	var clashes int
+	err = tx.QueryRow(ctx, `SELECT COUNT(id) FROM room_restrictions WHERE room_id = $1 AND $2 < end_date AND $3 > start_date`,
+		roomID, start, end).Scan(&clashes)
+	if err != nil {
+		return err
+	}
+	if clashes > 0 {
+		return repository.ErrRoomUnavailable
+	}
+
+	if _, err := tx.Exec(ctx, `INSERT INTO room_restrictions (start_date, end_date, room_id, reservation_id,
+		created_at, updated_at, restriction_id) VALUES ($1, $2, $3, $4, NOW(), NOW(), 1)`, start, end, roomID, id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `UPDATE reservations SET confirmed_at = NOW(), updated_at = NOW() WHERE id = $1`, id); err != nil {
+		return err
+	}
+	if paymentID != 0 {
+		if _, err := tx.Exec(ctx, `UPDATE payments SET status = $1, updated_at = NOW() WHERE id = $2`, data.PaymentCaptured, paymentID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
 }
 
-// SearchAvailabilityByDates searches for availability by dates and room id and returns true if available
-func (d *DBConnection) SearchAvailabilityByDatesByRoomId(start, end time.Time, roomId int) (bool, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// SearchAvailabilityByDates searches for availability by dates and room id and returns true if available.
+// The restrictions of excludeReservationId are ignored, so a reservation can be moved over its own dates; pass 0 to check them all.
+func (d *DBConnection) SearchAvailabilityByDatesByRoomId(ctx context.Context, start, end time.Time, roomId, excludeReservationId int) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
-	query := `SELECT COUNT(id) FROM room_restrictions WHERE room_id = $1 AND $2 < end_date AND $3 > start_date`
+	query := `SELECT COUNT(id) FROM room_restrictions WHERE room_id = $1 AND $2 < end_date AND $3 > start_date
+		AND reservation_id IS DISTINCT FROM $4`
 
 	var numRows int
 
-	row := d.DB.QueryRow(ctx, query, roomId, start, end)
+	row := d.reader(ctx).QueryRow(ctx, query, roomId, start, end, excludeReservationId)
 
 	err := row.Scan(&numRows)
 	if err != nil {
@@ -93,12 +366,12 @@ func (d *DBConnection) SearchAvailabilityByDatesByRoomId(start, end time.Time, r
 	return false, nil
 }
 
-func (d *DBConnection) SearchAvailabilityForAllRooms(start, end time.Time) ([]data.Room, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (d *DBConnection) SearchAvailabilityForAllRooms(ctx context.Context, start, end time.Time) ([]data.Room, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	query := `
-		SELECT r.id, r.room_name 
+		SELECT r.id, r.room_name, r.nightly_rate
 		FROM rooms r
 		WHERE r.id NOT IN (SELECT room_id FROM room_restrictions rr WHERE $1 < rr.end_date AND $2 > rr.start_date)
 		ORDER BY r.room_name
@@ -106,7 +379,7 @@ func (d *DBConnection) SearchAvailabilityForAllRooms(start, end time.Time) ([]da
 
 	var rooms []data.Room
 
-	rows, err := d.DB.Query(ctx, query, start, end)
+	rows, err := d.reader(ctx).Query(ctx, query, start, end)
 	if err != nil {
 		return nil, err
 	}
@@ -114,7 +387,7 @@ func (d *DBConnection) SearchAvailabilityForAllRooms(start, end time.Time) ([]da
 
 	for rows.Next() {
 		var room data.Room
-		err := rows.Scan(&room.Id, &room.RoomName)
+		err := rows.Scan(&room.Id, &room.RoomName, &room.NightlyRate)
 		if err != nil {
 			return nil, err
 		}
@@ -125,18 +398,19 @@ func (d *DBConnection) SearchAvailabilityForAllRooms(start, end time.Time) ([]da
 }
 
 // GetRoomByID gets a room by id
-func (d *DBConnection) GetRoomByID(id int) (data.Room, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func (d *DBConnection) GetRoomByID(ctx context.Context, id int) (data.Room, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	var room data.Room
 
-	query := `SELECT id, room_name, created_at, updated_at FROM rooms WHERE id = $1`
+	query := `SELECT id, room_name, nightly_rate, created_at, updated_at FROM rooms WHERE id = $1`
 
 	row := d.DB.QueryRow(ctx, query, id)
 	err := row.Scan(
 		&room.Id,
 		&room.RoomName,
+		&room.NightlyRate,
 		&room.CreatedAt,
 		&room.UpdatedAt,
 	)
@@ -148,16 +422,240 @@ func (d *DBConnection) GetRoomByID(id int) (data.Room, error) {
 	return room, nil
 }
 
-// Get the user by email from the database.
-func (d *DBConnection) GetUserByEmail(email string) (data.User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// AllRooms returns every room, ordered by name
+func (d *DBConnection) AllRooms(ctx context.Context) ([]data.Room, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := d.DB.Query(ctx, `SELECT id, room_name, nightly_rate FROM rooms ORDER BY room_name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rooms []data.Room
+	for rows.Next() {
+		var room data.Room
+		if err := rows.Scan(&room.Id, &room.RoomName, &room.NightlyRate); err != nil {
+			return nil, err
+		}
+		rooms = append(rooms, room)
+	}
+	return rooms, rows.Err()
+}
+
+// RoomRateOverrides returns the room's rate overrides that apply to any night from start up to end
+func (d *DBConnection) RoomRateOverrides(ctx context.Context, roomID int, start, end time.Time) ([]data.RateOverride, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	query := `SELECT id, room_id, name, start_date, end_date, weekends_only, nightly_rate
+			  FROM room_rates
+			  WHERE room_id = $1 AND (start_date IS NULL OR start_date < $3) AND (end_date IS NULL OR end_date >= $2)
+			  ORDER BY id`
+	rows, err := d.reader(ctx).Query(ctx, query, roomID, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var overrides []data.RateOverride
+	for rows.Next() {
+		var o data.RateOverride
+		err := rows.Scan(
+			&o.Id,
+			&o.RoomId,
+			&o.Name,
+			&o.StartDate,
+			&o.EndDate,
+			&o.WeekendsOnly,
+			&o.NightlyRate)
+		if err != nil {
+			return nil, err
+		}
+		overrides = append(overrides, o)
+	}
+	return overrides, rows.Err()
+}
+
+// promoCodeUses counts the redemptions of promo code p. Cancelling a booking gives its use back, as
+// does not paying for it in time.
+const promoCodeUses = `(SELECT COUNT(*) FROM promo_redemptions pr JOIN reservations r ON r.id = pr.reservation_id
+			  WHERE pr.promo_code_id = p.id AND r.cancelled_at IS NULL AND (r.confirmed_at IS NOT NULL OR r.hold_until > NOW()))`
+
+// promoCodeQuery selects the columns scanPromoCode reads
+const promoCodeQuery = `SELECT p.id, p.code, p.description, p.discount_type, p.amount, p.valid_from, p.valid_until,
+			  COALESCE(p.max_uses, 0), p.min_nights, p.active,
+			  ARRAY(SELECT room_id FROM promo_code_rooms WHERE promo_code_id = p.id ORDER BY room_id),
+			  ` + promoCodeUses + `, p.created_at, p.updated_at
+			  FROM promo_codes p`
+
+// scanPromoCode reads a row selected with promoCodeQuery
+func scanPromoCode(row pgx.Row) (data.PromoCode, error) {
+	var p data.PromoCode
+	err := row.Scan(
+		&p.Id,
+		&p.Code,
+		&p.Description,
+		&p.DiscountType,
+		&p.Amount,
+		&p.ValidFrom,
+		&p.ValidUntil,
+		&p.MaxUses,
+		&p.MinNights,
+		&p.Active,
+		&p.RoomIds,
+		&p.Uses,
+		&p.CreatedAt,
+		&p.UpdatedAt)
+	return p, err
+}
+
+// AllPromoCodes returns every promo code, newest first
+func (d *DBConnection) AllPromoCodes(ctx context.Context) ([]data.PromoCode, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := d.reader(ctx).Query(ctx, promoCodeQuery+` ORDER BY p.created_at DESC, p.id DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var codes []data.PromoCode
+	for rows.Next() {
+		p, err := scanPromoCode(rows)
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, p)
+	}
+	return codes, rows.Err()
+}
+
+// GetPromoCodeByID returns the promo code with the id
+func (d *DBConnection) GetPromoCodeByID(ctx context.Context, id int) (data.PromoCode, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	p, err := scanPromoCode(d.DB.QueryRow(ctx, promoCodeQuery+` WHERE p.id = $1`, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return data.PromoCode{}, repository.ErrPromoCodeNotFound
+	}
+	return p, err
+}
+
+// GetPromoCodeByCode returns the promo code with the (upper case) code, active or not
+func (d *DBConnection) GetPromoCodeByCode(ctx context.Context, code string) (data.PromoCode, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	p, err := scanPromoCode(d.DB.QueryRow(ctx, promoCodeQuery+` WHERE p.code = $1`, code))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return data.PromoCode{}, repository.ErrPromoCodeNotFound
+	}
+	return p, err
+}
+
+// InsertPromoCode creates a promo code with its rooms
+func (d *DBConnection) InsertPromoCode(ctx context.Context, p data.PromoCode) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := d.DB.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	var id int
+	err = tx.QueryRow(ctx, `INSERT INTO promo_codes (code, description, discount_type, amount, valid_from, valid_until,
+		max_uses, min_nights, active) VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, 0), $8, $9) RETURNING id`,
+		p.Code, p.Description, p.DiscountType, p.Amount, p.ValidFrom, p.ValidUntil, p.MaxUses, p.MinNights, p.Active,
+	).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := setPromoCodeRooms(ctx, tx, id, p.RoomIds); err != nil {
+		return 0, err
+	}
+	return id, tx.Commit(ctx)
+}
+
+// UpdatePromoCode saves a promo code and replaces its rooms
+func (d *DBConnection) UpdatePromoCode(ctx context.Context, p data.PromoCode) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := d.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, `UPDATE promo_codes SET code = $1, description = $2, discount_type = $3, amount = $4,
+		valid_from = $5, valid_until = $6, max_uses = NULLIF($7, 0), min_nights = $8, active = $9, updated_at = NOW()
+		WHERE id = $10`,
+		p.Code, p.Description, p.DiscountType, p.Amount, p.ValidFrom, p.ValidUntil, p.MaxUses, p.MinNights, p.Active, p.Id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return repository.ErrPromoCodeNotFound
+	}
+
+	if _, err := tx.Exec(ctx, `DELETE FROM promo_code_rooms WHERE promo_code_id = $1`, p.Id); err != nil {
+		return err
+	}
+	if err := setPromoCodeRooms(ctx, tx, p.Id, p.RoomIds); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// setPromoCodeRooms limits a promo code with no rooms to roomIDs
+func setPromoCodeRooms(ctx context.Context, tx pgx.Tx, promoCodeID int, roomIDs []int) error {
+	for _, roomID := range roomIDs {
+		if _, err := tx.Exec(ctx, `INSERT INTO promo_code_rooms (promo_code_id, room_id) VALUES ($1, $2)`, promoCodeID, roomID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeletePromoCode deletes a promo code nobody has booked with. Returns
+// repository.ErrPromoCodeRedeemed if someone has, as their reservations keep a record of it.
+func (d *DBConnection) DeletePromoCode(ctx context.Context, id int) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tag, err := d.DB.Exec(ctx, `DELETE FROM promo_codes p WHERE p.id = $1
+		AND NOT EXISTS (SELECT 1 FROM promo_redemptions WHERE promo_code_id = p.id)`, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() > 0 {
+		return nil
+	}
+
+	if _, err := d.GetPromoCodeByID(ctx, id); err != nil {
+		return err
+	}
+	return repository.ErrPromoCodeRedeemed
+}
+
+// Get the user by email from the database, whatever its case.
+func (d *DBConnection) GetUserByEmail(ctx context.Context, email string) (data.User, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	var u data.User
 
-	query := `SELECT id, first_name, last_name, email, password, access_level, created_at, updated_at
+	query := `SELECT id, first_name, last_name, email, password, access_level,
+			  totp_enabled, COALESCE(totp_secret, ''), active, created_at, updated_at
 			  FROM users
-			  WHERE email = $1 LIMIT 1`
+			  WHERE LOWER(email) = LOWER($1) LIMIT 1`
 	row := d.DB.QueryRow(ctx, query, email)
 	err := row.Scan(
 		&u.Id,
@@ -166,28 +664,65 @@ func (d *DBConnection) GetUserByEmail(email string) (data.User, error) {
 		&u.Email,
 		&u.Password,
 		&u.AccessLevel,
+		&u.TOTPEnabled,
+		&u.TOTPSecret,
+		&u.Active,
 		&u.CreatedAt,
 		&u.UpdatedAt)
-	if err != nil {
+	if errors.Is(err, pgx.ErrNoRows) {
+		return u, repository.ErrUserNotFound
+	} else if err != nil {
 		return u, err
 	}
 
 	return u, nil
 }
 
-// Udate the user in the database.
-func (d *DBConnection) UpdateUser(u data.User) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// InsertUser creates a user with the given password and returns their id
+func (d *DBConnection) InsertUser(ctx context.Context, u data.User, password string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	hashedPassword, err := d.hashPassword(password)
+	if err != nil {
+		return 0, err
+	}
+
+	var newId int
+	stmt := `INSERT INTO users (first_name, last_name, email, password, access_level, created_at, updated_at)
+			 VALUES ($1, $2, $3, $4, $5, $6, $7) returning id`
+	err = d.DB.QueryRow(ctx, stmt,
+		u.FirstName,
+		u.LastName,
+		u.Email,
+		string(hashedPassword),
+		u.AccessLevel,
+		time.Now(),
+		time.Now(),
+	).Scan(&newId)
+	if err != nil {
+		d.App.ErrorLog.Println(err)
+		d.App.ErrorLog.Println("Error inserting user into database")
+		return 0, err
+	}
+
+	return newId, nil
+}
+
+// UpdateUser updates the user's name, email and access level
+func (d *DBConnection) UpdateUser(ctx context.Context, u data.User) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	query := `UPDATE users SET first_name = $1, last_name = $2, email = $3, access_level = $4, updated_at = $5
-		WHERE email = $6`
+		WHERE id = $6`
 	_, err := d.DB.Exec(ctx, query,
 		u.FirstName,
 		u.LastName,
 		u.Email,
 		u.AccessLevel,
 		time.Now(),
+		u.Id,
 	)
 	if err != nil {
 		d.App.ErrorLog.Println(err)
@@ -197,24 +732,695 @@ func (d *DBConnection) UpdateUser(u data.User) error {
 	return nil
 }
 
-// Authenticate the user with the database.
-func (d *DBConnection) Authenticate(email, testPassword string) (int, string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// hashPassword hashes the password with the configured bcrypt cost
+func (d *DBConnection) hashPassword(password string) ([]byte, error) {
+	return bcrypt.GenerateFromPassword([]byte(password), d.App.Settings.Auth.BcryptCost)
+}
+
+// Authenticate checks the password against the stored hash and returns the user on success.
+// An unknown email and a wrong password both return repository.ErrInvalidCredentials after a bcrypt comparison.
+// Hashes made with a lower cost than configured are upgraded. The returned user has no password set.
+func (d *DBConnection) Authenticate(ctx context.Context, email, testPassword string) (data.User, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
-	var id int
+	var u data.User
 	var hashedPassword string
 
-	query := `SELECT id, password FROM users WHERE email = $1 LIMIT 1`
+	query := `SELECT id, first_name, last_name, email, password, access_level, totp_enabled, active
+			  FROM users WHERE LOWER(email) = LOWER($1) LIMIT 1`
 	row := d.DB.QueryRow(ctx, query, email)
-	err := row.Scan(&id, &hashedPassword)
-	if err != nil {
-		return 0, "", err
+	err := row.Scan(&u.Id, &u.FirstName, &u.LastName, &u.Email, &hashedPassword, &u.AccessLevel, &u.TOTPEnabled, &u.Active)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// Compare against a dummy hash so a lookup miss takes as long as a wrong password
+		// and response times don't reveal which accounts exist
+		_ = bcrypt.CompareHashAndPassword(d.dummyPasswordHash(), []byte(testPassword))
+		return data.User{}, repository.ErrInvalidCredentials
+	} else if err != nil {
+		return data.User{}, err
 	}
 
 	err = bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(testPassword))
 	if err == bcrypt.ErrMismatchedHashAndPassword {
-		return 0, "", errors.New("incorrect password")
+		return data.User{}, repository.ErrInvalidCredentials
+	} else if err != nil {
+		return data.User{}, err
+	}
+	// Checked after the password so a deactivated account is only revealed to someone who knows it
+	if !u.Active {
+		return data.User{}, repository.ErrUserInactive
+	}
+
+	if cost, err := bcrypt.Cost([]byte(hashedPassword)); err == nil && cost < d.App.Settings.Auth.BcryptCost {
+		if err := d.UpdatePassword(ctx, u.Id, testPassword); err != nil {
+			d.App.ErrorLog.Printf("Failed to upgrade password hash for user %d: %v", u.Id, err)
+		}
 	}
-	return id, hashedPassword, nil
+	return u, nil
+}
+
+// InsertPasswordReset stores the hash of a new password reset token.
+// Any earlier unused tokens for the user are invalidated so only the latest emailed link works.
+func (d *DBConnection) InsertPasswordReset(ctx context.Context, userID int, tokenHash []byte, expiresAt time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := d.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `UPDATE password_resets SET used_at = NOW() WHERE user_id = $1 AND used_at IS NULL`, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `INSERT INTO password_resets (user_id, token_hash, expires_at) VALUES ($1, $2, $3)`,
+		userID, tokenHash, expiresAt)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// GetPasswordResetUserID returns the user a reset token belongs to without using it up
+func (d *DBConnection) GetPasswordResetUserID(ctx context.Context, tokenHash []byte) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var userID int
+	query := `SELECT user_id FROM password_resets
+			  WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW()`
+	err := d.DB.QueryRow(ctx, query, tokenHash).Scan(&userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, repository.ErrInvalidToken
+	}
+	return userID, err
+}
+
+// ResetPassword uses up a reset token and sets the user's new password in one transaction.
+// Returns the user's id, or repository.ErrInvalidToken if the token can't be used.
+func (d *DBConnection) ResetPassword(ctx context.Context, tokenHash []byte, newPassword string) (int, error) {
+	hashedPassword, err := d.hashPassword(newPassword)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := d.DB.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	// Marking the token used in the same statement that checks it keeps it single-use under concurrency
+	var userID int
+	query := `UPDATE password_resets SET used_at = NOW()
+			  WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW()
+			  RETURNING user_id`
+	err = tx.QueryRow(ctx, query, tokenHash).Scan(&userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, repository.ErrInvalidToken
+	} else if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE users SET password = $1, updated_at = NOW() WHERE id = $2`, string(hashedPassword), userID)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+	return userID, nil
+}
+
+// InsertEmailChange stores the hash of a token confirming the user's new email address.
+// Any earlier unconfirmed changes for the user are invalidated so only the latest link works.
+func (d *DBConnection) InsertEmailChange(ctx context.Context, userID int, newEmail string, tokenHash []byte, expiresAt time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := d.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `UPDATE email_changes SET used_at = NOW() WHERE user_id = $1 AND used_at IS NULL`, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `INSERT INTO email_changes (user_id, new_email, token_hash, expires_at) VALUES ($1, $2, $3, $4)`,
+		userID, newEmail, tokenHash, expiresAt)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// ConfirmEmailChange uses up a confirmation token and moves the user to the new email in one
+// transaction. Returns the user's id and previous email, repository.ErrInvalidToken if the token
+// can't be used, or repository.ErrEmailInUse if another user took the address in the meantime.
+func (d *DBConnection) ConfirmEmailChange(ctx context.Context, tokenHash []byte) (int, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := d.DB.Begin(ctx)
+	if err != nil {
+		return 0, "", err
+	}
+	defer tx.Rollback(ctx)
+
+	var userID int
+	var newEmail string
+	query := `UPDATE email_changes SET used_at = NOW()
+			  WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW()
+			  RETURNING user_id, new_email`
+	err = tx.QueryRow(ctx, query, tokenHash).Scan(&userID, &newEmail)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, "", repository.ErrInvalidToken
+	} else if err != nil {
+		return 0, "", err
+	}
+
+	var oldEmail string
+	err = tx.QueryRow(ctx, `SELECT email FROM users WHERE id = $1 FOR UPDATE`, userID).Scan(&oldEmail)
+	if err != nil {
+		return 0, "", err
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE users SET email = $1, updated_at = NOW() WHERE id = $2`, newEmail, userID)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		return 0, "", repository.ErrEmailInUse
+	} else if err != nil {
+		return 0, "", err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, "", err
+	}
+	return userID, oldEmail, nil
+}
+
+// failureOutcomes are the login outcomes that count towards a lockout
+var failureOutcomes = []string{data.LoginFailed, data.LoginTwoFactorFailed}
+
+// InsertLoginAttempt writes a login attempt to the audit log
+func (d *DBConnection) InsertLoginAttempt(ctx context.Context, a data.LoginAttempt) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	stmt := `INSERT INTO login_attempts (email, ip_address, user_agent, user_id, outcome)
+			 VALUES ($1, $2, $3, NULLIF($4, 0), $5)`
+	_, err := d.DB.Exec(ctx, stmt, a.Email, a.IPAddress, a.UserAgent, a.UserId, a.Outcome)
+	return err
+}
+
+// CountLoginFailures returns the failed logins for an email since the given time, ignoring
+// failures before its latest successful login, and the time of the most recent failure.
+func (d *DBConnection) CountLoginFailures(ctx context.Context, email string, since time.Time) (int, time.Time, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var count int
+	var last *time.Time
+	query := `SELECT COUNT(*), MAX(created_at) FROM login_attempts
+			  WHERE email = $1 AND outcome = ANY($2) AND created_at > $3
+			  AND created_at > COALESCE(
+				  (SELECT MAX(created_at) FROM login_attempts WHERE email = $1 AND outcome = $4),
+				  '-infinity')`
+	err := d.DB.QueryRow(ctx, query, email, failureOutcomes, since, data.LoginSucceeded).Scan(&count, &last)
+	if err != nil || last == nil {
+		return count, time.Time{}, err
+	}
+	return count, *last, nil
+}
+
+// CountIPLoginFailures returns the failed logins from an address since the given time
+func (d *DBConnection) CountIPLoginFailures(ctx context.Context, ip string, since time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var count int
+	query := `SELECT COUNT(*) FROM login_attempts WHERE ip_address = $1 AND outcome = ANY($2) AND created_at > $3`
+	err := d.DB.QueryRow(ctx, query, ip, failureOutcomes, since).Scan(&count)
+	return count, err
+}
+
+// GetUserByID returns the user with the given id
+func (d *DBConnection) GetUserByID(ctx context.Context, id int) (data.User, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var u data.User
+
+	query := `SELECT id, first_name, last_name, email, password, access_level,
+			  totp_enabled, COALESCE(totp_secret, ''), active, created_at, updated_at
+			  FROM users
+			  WHERE id = $1`
+	row := d.DB.QueryRow(ctx, query, id)
+	err := row.Scan(
+		&u.Id,
+		&u.FirstName,
+		&u.LastName,
+		&u.Email,
+		&u.Password,
+		&u.AccessLevel,
+		&u.TOTPEnabled,
+		&u.TOTPSecret,
+		&u.Active,
+		&u.CreatedAt,
+		&u.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return u, repository.ErrUserNotFound
+	} else if err != nil {
+		return u, err
+	}
+
+	return u, nil
+}
+
+// EnableTOTP turns on two-factor authentication for the user and replaces their recovery codes.
+// step is the time step of the code that confirmed the secret, so it can't be used again to log in.
+func (d *DBConnection) EnableTOTP(ctx context.Context, userID int, secret string, step int64, recoveryCodeHashes [][]byte) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := d.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `UPDATE users SET totp_secret = $1, totp_enabled = TRUE, totp_last_step = $2, updated_at = NOW()
+		WHERE id = $3`, secret, step, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+	for _, h := range recoveryCodeHashes {
+		_, err = tx.Exec(ctx, `INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)`, userID, h)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+// DisableTOTP turns off two-factor authentication for the user and removes their recovery codes
+func (d *DBConnection) DisableTOTP(ctx context.Context, userID int) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := d.DB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `UPDATE users SET totp_secret = NULL, totp_enabled = FALSE, totp_last_step = NULL, updated_at = NOW()
+		WHERE id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// UseTOTPStep records that the user's TOTP code for the time step has been used. Returns
+// repository.ErrInvalidToken if a code for that step, or a later one, was already accepted.
+func (d *DBConnection) UseTOTPStep(ctx context.Context, userID int, step int64) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tag, err := d.DB.Exec(ctx, `UPDATE users SET totp_last_step = $1
+		WHERE id = $2 AND (totp_last_step IS NULL OR totp_last_step < $1)`, step, userID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return repository.ErrInvalidToken
+	}
+	return nil
+}
+
+// UseRecoveryCode marks one of the user's unused recovery codes as used and returns how many are left.
+// Returns repository.ErrInvalidToken if the code doesn't match an unused code.
+func (d *DBConnection) UseRecoveryCode(ctx context.Context, userID int, codeHash []byte) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tag, err := d.DB.Exec(ctx, `UPDATE recovery_codes SET used_at = NOW()
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL`, userID, codeHash)
+	if err != nil {
+		return 0, err
+	}
+	if tag.RowsAffected() == 0 {
+		return 0, repository.ErrInvalidToken
+	}
+
+	var remaining int
+	err = d.DB.QueryRow(ctx, `SELECT COUNT(*) FROM recovery_codes WHERE user_id = $1 AND used_at IS NULL`, userID).Scan(&remaining)
+	return remaining, err
+}
+
+// settingRequireStaffTwoFactor is the app_settings key for the staff two-factor policy
+const settingRequireStaffTwoFactor = "require_staff_2fa"
+
+// RequireStaffTwoFactor reports whether staff and above must use two-factor authentication
+func (d *DBConnection) RequireStaffTwoFactor(ctx context.Context) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var value string
+	err := d.DB.QueryRow(ctx, `SELECT value FROM app_settings WHERE key = $1`, settingRequireStaffTwoFactor).Scan(&value)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return value == "true", nil
+}
+
+// SetRequireStaffTwoFactor sets whether staff and above must use two-factor authentication
+func (d *DBConnection) SetRequireStaffTwoFactor(ctx context.Context, required bool) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	value := "false"
+	if required {
+		value = "true"
+	}
+	_, err := d.DB.Exec(ctx, `INSERT INTO app_settings (key, value) VALUES ($1, $2)
+		ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value, updated_at = NOW()`, settingRequireStaffTwoFactor, value)
+	return err
+}
+
+// SetUserActive deactivates or reactivates the user
+func (d *DBConnection) SetUserActive(ctx context.Context, id int, active bool) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := d.DB.Exec(ctx, `UPDATE users SET active = $1, updated_at = NOW() WHERE id = $2`, active, id)
+	return err
+}
+
+// UpdatePassword sets a new password for the user
+func (d *DBConnection) UpdatePassword(ctx context.Context, userID int, newPassword string) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	hashedPassword, err := d.hashPassword(newPassword)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.DB.Exec(ctx, `UPDATE users SET password = $1, updated_at = NOW() WHERE id = $2`, string(hashedPassword), userID)
+	return err
+}
+
+// InsertRememberToken stores a new "remember me" token, clearing out the user's expired ones
+func (d *DBConnection) InsertRememberToken(ctx context.Context, t data.RememberToken) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := d.DB.Exec(ctx, `DELETE FROM remember_tokens WHERE user_id = $1 AND expires_at <= NOW()`, t.UserId)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.DB.Exec(ctx, `INSERT INTO remember_tokens (user_id, selector, validator_hash, user_agent, expires_at)
+		VALUES ($1, $2, $3, $4, $5)`, t.UserId, t.Selector, t.ValidatorHash, t.UserAgent, t.ExpiresAt)
+	return err
+}
+
+// GetRememberToken returns the unexpired "remember me" token with the given selector.
+// Returns repository.ErrInvalidToken if there is none.
+func (d *DBConnection) GetRememberToken(ctx context.Context, selector string) (data.RememberToken, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var t data.RememberToken
+	query := `SELECT id, user_id, selector, validator_hash, previous_validator_hash, user_agent,
+			  expires_at, last_used_at, created_at
+			  FROM remember_tokens
+			  WHERE selector = $1 AND expires_at > NOW()`
+	err := d.DB.QueryRow(ctx, query, selector).Scan(
+		&t.Id,
+		&t.UserId,
+		&t.Selector,
+		&t.ValidatorHash,
+		&t.PreviousHash,
+		&t.UserAgent,
+		&t.ExpiresAt,
+		&t.LastUsedAt,
+		&t.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return t, repository.ErrInvalidToken
+	}
+	return t, err
+}
+
+// RotateRememberToken replaces the token's validator after it has been used and extends its expiry,
+// if its validator is still oldHash. Returns repository.ErrInvalidToken if another request
+// rotated it first.
+func (d *DBConnection) RotateRememberToken(ctx context.Context, id int, oldHash, validatorHash []byte, expiresAt time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tag, err := d.DB.Exec(ctx, `UPDATE remember_tokens
+		SET previous_validator_hash = validator_hash, validator_hash = $1, expires_at = $2, last_used_at = NOW()
+		WHERE id = $3 AND validator_hash = $4`, validatorHash, expiresAt, id, oldHash)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return repository.ErrInvalidToken
+	}
+	return nil
+}
+
+// DeleteRememberToken removes one "remember me" token
+func (d *DBConnection) DeleteRememberToken(ctx context.Context, selector string) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := d.DB.Exec(ctx, `DELETE FROM remember_tokens WHERE selector = $1`, selector)
+	return err
+}
+
+// DeleteUserRememberTokens forgets every device the user asked to be remembered on
+func (d *DBConnection) DeleteUserRememberTokens(ctx context.Context, userID int) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := d.DB.Exec(ctx, `DELETE FROM remember_tokens WHERE user_id = $1`, userID)
+	return err
+}
+
+// DeleteOtherRememberTokens forgets every device the user is remembered on except the one with keepSelector
+func (d *DBConnection) DeleteOtherRememberTokens(ctx context.Context, userID int, keepSelector string) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := d.DB.Exec(ctx, `DELETE FROM remember_tokens WHERE user_id = $1 AND selector <> $2`, userID, keepSelector)
+	return err
+}
+
+// CountRememberTokens returns how many devices the user is currently remembered on
+func (d *DBConnection) CountRememberTokens(ctx context.Context, userID int) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var count int
+	err := d.DB.QueryRow(ctx, `SELECT COUNT(*) FROM remember_tokens WHERE user_id = $1 AND expires_at > NOW()`, userID).Scan(&count)
+	return count, err
+}
+
+// InsertUserSession adds a logged-in session token to the user's session index,
+// clearing out the user's entries for sessions that have expired
+func (d *DBConnection) InsertUserSession(ctx context.Context, userID int, token string, expiresAt time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := d.DB.Exec(ctx, `DELETE FROM user_sessions WHERE user_id = $1 AND expires_at <= NOW()`, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.DB.Exec(ctx, `INSERT INTO user_sessions (token, user_id, expires_at) VALUES ($1, $2, $3)
+		ON CONFLICT (token) DO UPDATE SET user_id = EXCLUDED.user_id, expires_at = EXCLUDED.expires_at`,
+		token, userID, expiresAt)
+	return err
+}
+
+// UserSessionTokens returns the tokens of the user's unexpired sessions from the session index
+func (d *DBConnection) UserSessionTokens(ctx context.Context, userID int) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := d.DB.Query(ctx, `SELECT token FROM user_sessions WHERE user_id = $1 AND expires_at > NOW()`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []string
+	for rows.Next() {
+		var token string
+		if err := rows.Scan(&token); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+// DeleteUserSession removes a session token from the session index
+func (d *DBConnection) DeleteUserSession(ctx context.Context, token string) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := d.DB.Exec(ctx, `DELETE FROM user_sessions WHERE token = $1`, token)
+	return err
+}
+
+// GetUserByOIDCSubject returns the user linked to the identity provider subject
+func (d *DBConnection) GetUserByOIDCSubject(ctx context.Context, subject string) (data.User, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var id int
+	err := d.DB.QueryRow(ctx, `SELECT id FROM users WHERE oidc_subject = $1`, subject).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return data.User{}, repository.ErrUserNotFound
+	} else if err != nil {
+		return data.User{}, err
+	}
+	return d.GetUserByID(ctx, id)
+}
+
+// LinkOIDCSubject records the identity provider subject the user signs in with. It returns
+// repository.ErrSubjectLinked if the user is already linked to a different subject.
+func (d *DBConnection) LinkOIDCSubject(ctx context.Context, userID int, subject string) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tag, err := d.DB.Exec(ctx, `UPDATE users SET oidc_subject = $1, updated_at = NOW()
+		WHERE id = $2 AND (oidc_subject IS NULL OR oidc_subject = $1)`, subject, userID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return repository.ErrSubjectLinked
+	}
+	return nil
+}
+
+// paymentQuery selects the columns scanPayment reads
+const paymentQuery = `SELECT id, reservation_id, provider, intent_id, amount, currency, status, created_at, updated_at
+			  FROM payments`
+
+// scanPayment reads a row selected with paymentQuery
+func scanPayment(row pgx.Row) (data.Payment, error) {
+	var p data.Payment
+	err := row.Scan(
+		&p.Id,
+		&p.ReservationId,
+		&p.Provider,
+		&p.IntentId,
+		&p.Amount,
+		&p.Currency,
+		&p.Status,
+		&p.CreatedAt,
+		&p.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return data.Payment{}, repository.ErrPaymentNotFound
+	}
+	return p, err
+}
+
+// InsertPayment stores a payment started with the payment provider
+func (d *DBConnection) InsertPayment(ctx context.Context, p data.Payment) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var id int
+	err := d.DB.QueryRow(ctx, `INSERT INTO payments (reservation_id, provider, intent_id, amount, currency, status)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+		p.ReservationId, p.Provider, p.IntentId, p.Amount, p.Currency, p.Status).Scan(&id)
+	return id, err
+}
+
+// GetPaymentByIntent returns the payment with the provider's intent id
+func (d *DBConnection) GetPaymentByIntent(ctx context.Context, provider, intentID string) (data.Payment, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	return scanPayment(d.DB.QueryRow(ctx, paymentQuery+` WHERE provider = $1 AND intent_id = $2`, provider, intentID))
+}
+
+// GetReservationPayment returns the reservation's latest payment
+func (d *DBConnection) GetReservationPayment(ctx context.Context, reservationID int) (data.Payment, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	return scanPayment(d.DB.QueryRow(ctx, paymentQuery+` WHERE reservation_id = $1 ORDER BY id DESC LIMIT 1`, reservationID))
+}
+
+// ClaimPayment moves a pending or captured but unconfirmed payment to capturing, so only one
+// caller works on it, and returns the payment as it was. A payment that has been capturing for
+// longer than staleAfter is claimed again, as whoever claimed it must have stopped. claimed
+// reports whether the caller has the claim.
+func (d *DBConnection) ClaimPayment(ctx context.Context, id int, staleAfter time.Duration) (data.Payment, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := d.DB.Begin(ctx)
+	if err != nil {
+		return data.Payment{}, false, err
+	}
+	defer tx.Rollback(ctx)
+
+	p, err := scanPayment(tx.QueryRow(ctx, paymentQuery+` WHERE id = $1 FOR UPDATE`, id))
+	if err != nil {
+		return data.Payment{}, false, err
+	}
+
+	tag, err := tx.Exec(ctx, `UPDATE payments SET status = $1, updated_at = NOW()
+		WHERE id = $2 AND (status = ANY($3) OR (status = $1 AND updated_at < NOW() - make_interval(secs => $4)))`,
+		data.PaymentCapturing, id, []string{data.PaymentPending, data.PaymentUnconfirmed}, staleAfter.Seconds())
+	if err != nil {
+		return data.Payment{}, false, err
+	}
+	claimed := tag.RowsAffected() == 1
+	return p, claimed, tx.Commit(ctx)
+}
+
+// SetPaymentStatus records a payment's new status
+func (d *DBConnection) SetPaymentStatus(ctx context.Context, id int, status string) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := d.DB.Exec(ctx, `UPDATE payments SET status = $1, updated_at = NOW() WHERE id = $2`, status, id)
+	return err
 }
@@ -1,19 +1,120 @@
 package repository
 
 import (
+	"context"
+	"errors"
 	"time"
 
 	"github.com/dunky-star/modern-webapp-golang/internal/data"
 )
 
+// ErrInvalidToken is returned when a token is unknown, expired or already used
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+// ErrInvalidCredentials is returned by Authenticate for an unknown email or a wrong password alike
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// ErrUserNotFound is returned when looking up a user that doesn't exist
+var ErrUserNotFound = errors.New("user not found")
+
+// ErrEmailInUse is returned by ConfirmEmailChange when another user has the new email by now
+var ErrEmailInUse = errors.New("email is already in use")
+
+// ErrUserInactive is returned by Authenticate when the password is right but the account is deactivated
+var ErrUserInactive = errors.New("user is deactivated")
+
+// ErrReservationNotFound is returned when a reservation doesn't exist or is already cancelled
+var ErrReservationNotFound = errors.New("reservation not found")
+
+// ErrRoomUnavailable is returned when the room is already booked for some of the dates
+var ErrRoomUnavailable = errors.New("room is not available for those dates")
+
+// ErrSubjectLinked is returned by LinkOIDCSubject when the user already signs on as someone else
+var ErrSubjectLinked = errors.New("user is linked to a different single sign-on subject")
+
+// ErrPromoCodeNotFound is returned when a promo code doesn't exist, or when booking with one that's been deactivated
+var ErrPromoCodeNotFound = errors.New("promo code not found")
+
+// ErrPromoCodeUsedUp is returned when booking with a promo code that has reached its usage limit
+var ErrPromoCodeUsedUp = errors.New("promo code has been used up")
+
+// ErrPromoCodeRedeemed is returned when deleting a promo code that reservations were booked with
+var ErrPromoCodeRedeemed = errors.New("promo code has been redeemed")
+
+// ErrPaymentNotFound is returned when looking up a payment that doesn't exist
+var ErrPaymentNotFound = errors.New("payment not found")
+
+// primaryReadsKey is the context key set by WithPrimaryReads
+type primaryReadsKey struct{}
+
+// WithPrimaryReads returns a context whose queries read from the primary even where they would
+// otherwise use a replica, for showing a change that a replica may not have caught up with yet
+func WithPrimaryReads(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryReadsKey{}, true)
+}
+
+// PrimaryReads reports whether ctx comes from WithPrimaryReads
+func PrimaryReads(ctx context.Context) bool {
+	v, _ := ctx.Value(primaryReadsKey{}).(bool)
+	return v
+}
+
 type DatabaseConn interface {
-	AllUsers() bool
-	InsertReservation(res data.Reservation) (int, error)
-	InsertRoomRestriction(r data.RoomRestriction) error
-	SearchAvailabilityByDatesByRoomId(start, end time.Time, roomId int) (bool, error)
-	SearchAvailabilityForAllRooms(start, end time.Time) ([]data.Room, error)
-	GetRoomByID(id int) (data.Room, error)
-	GetUserByEmail(email string) (data.User, error)
-	UpdateUser(u data.User) error
-	Authenticate(email, testPassword string) (int, string, error)
+	AllUsers(ctx context.Context) ([]data.User, error)
+	InsertReservation(ctx context.Context, res data.Reservation) (int, error)
+	GuestReservations(ctx context.Context, email string) ([]data.Reservation, error)
+	GetReservationByCode(ctx context.Context, code string) (data.Reservation, error)
+	GetReservationByID(ctx context.Context, id int) (data.Reservation, error)
+	ConfirmReservation(ctx context.Context, id, paymentID int) error
+	CancelReservation(ctx context.Context, id int) error
+	ChangeReservationDates(ctx context.Context, id int, start, end time.Time, totalPrice, discount int64, currency string) error
+	SearchAvailabilityByDatesByRoomId(ctx context.Context, start, end time.Time, roomId, excludeReservationId int) (bool, error)
+	SearchAvailabilityForAllRooms(ctx context.Context, start, end time.Time) ([]data.Room, error)
+	GetRoomByID(ctx context.Context, id int) (data.Room, error)
+	AllRooms(ctx context.Context) ([]data.Room, error)
+	RoomRateOverrides(ctx context.Context, roomID int, start, end time.Time) ([]data.RateOverride, error)
+	InsertPayment(ctx context.Context, p data.Payment) (int, error)
+	GetPaymentByIntent(ctx context.Context, provider, intentID string) (data.Payment, error)
+	GetReservationPayment(ctx context.Context, reservationID int) (data.Payment, error)
+	ClaimPayment(ctx context.Context, id int, staleAfter time.Duration) (p data.Payment, claimed bool, err error)
+	SetPaymentStatus(ctx context.Context, id int, status string) error
+	AllPromoCodes(ctx context.Context) ([]data.PromoCode, error)
+	GetPromoCodeByID(ctx context.Context, id int) (data.PromoCode, error)
+	GetPromoCodeByCode(ctx context.Context, code string) (data.PromoCode, error)
+	InsertPromoCode(ctx context.Context, p data.PromoCode) (int, error)
+	UpdatePromoCode(ctx context.Context, p data.PromoCode) error
+	DeletePromoCode(ctx context.Context, id int) error
+	GetUserByEmail(ctx context.Context, email string) (data.User, error)
+	InsertUser(ctx context.Context, u data.User, password string) (int, error)
+	UpdateUser(ctx context.Context, u data.User) error
+	SetUserActive(ctx context.Context, id int, active bool) error
+	UpdatePassword(ctx context.Context, userID int, newPassword string) error
+	InsertRememberToken(ctx context.Context, t data.RememberToken) error
+	GetRememberToken(ctx context.Context, selector string) (data.RememberToken, error)
+	RotateRememberToken(ctx context.Context, id int, oldHash, validatorHash []byte, expiresAt time.Time) error
+	DeleteRememberToken(ctx context.Context, selector string) error
+	DeleteUserRememberTokens(ctx context.Context, userID int) error
+	DeleteOtherRememberTokens(ctx context.Context, userID int, keepSelector string) error
+	CountRememberTokens(ctx context.Context, userID int) (int, error)
+	InsertUserSession(ctx context.Context, userID int, token string, expiresAt time.Time) error
+	UserSessionTokens(ctx context.Context, userID int) ([]string, error)
+	DeleteUserSession(ctx context.Context, token string) error
+	Authenticate(ctx context.Context, email, testPassword string) (data.User, error)
+	InsertPasswordReset(ctx context.Context, userID int, tokenHash []byte, expiresAt time.Time) error
+	GetPasswordResetUserID(ctx context.Context, tokenHash []byte) (int, error)
+	ResetPassword(ctx context.Context, tokenHash []byte, newPassword string) (int, error)
+	InsertEmailChange(ctx context.Context, userID int, newEmail string, tokenHash []byte, expiresAt time.Time) error
+	ConfirmEmailChange(ctx context.Context, tokenHash []byte) (userID int, oldEmail string, err error)
+	InsertLoginAttempt(ctx context.Context, a data.LoginAttempt) error
+	CountLoginFailures(ctx context.Context, email string, since time.Time) (int, time.Time, error)
+	CountIPLoginFailures(ctx context.Context, ip string, since time.Time) (int, error)
+	GetUserByID(ctx context.Context, id int) (data.User, error)
+	GetUserByOIDCSubject(ctx context.Context, subject string) (data.User, error)
+	LinkOIDCSubject(ctx context.Context, userID int, subject string) error
+	EnableTOTP(ctx context.Context, userID int, secret string, step int64, recoveryCodeHashes [][]byte) error
+	DisableTOTP(ctx context.Context, userID int) error
+	UseTOTPStep(ctx context.Context, userID int, step int64) error
+	UseRecoveryCode(ctx context.Context, userID int, codeHash []byte) (int, error)
+	RequireStaffTwoFactor(ctx context.Context) (bool, error)
+	SetRequireStaffTwoFactor(ctx context.Context, required bool) error
 }
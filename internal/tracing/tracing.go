@@ -0,0 +1,138 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.41.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const (
+	ServiceName     = "modern-webapp-golang"
+	instrumentation = "github.com/dunky-star/modern-webapp-golang"
+	DefaultFile     = "output/traces/traces.json"
+)
+
+// Supported exporters
+const (
+	ExporterNone   = "none"   // Tracing disabled (spans are no-ops)
+	ExporterStdout = "stdout" // Pretty-printed spans on stdout, for local debugging
+	ExporterFile   = "file"   // JSON spans appended to a file, for offline analysis
+	ExporterOTLP   = "otlp"   // OTLP over HTTP; endpoint from OTEL_EXPORTER_OTLP_ENDPOINT (default localhost:4318)
+)
+
+// Propagator reads and writes the W3C trace context and baggage headers
+var Propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// Provider holds one application's tracer and the exporter behind it. Nothing is installed
+// globally, so several applications in one process trace independently.
+type Provider struct {
+	tracer trace.Tracer
+	sdk    *sdktrace.TracerProvider // nil when tracing is disabled
+	output io.Closer                // Trace file opened by the file exporter
+}
+
+// Disabled returns a provider whose spans are all no-ops
+func Disabled() *Provider {
+	return &Provider{tracer: noop.NewTracerProvider().Tracer(instrumentation)}
+}
+
+// New creates a tracer provider for the given exporter.
+// With ExporterNone it returns Disabled().
+func New(ctx context.Context, exporter, file, version string) (*Provider, error) {
+	var exp sdktrace.SpanExporter
+	var output io.Closer
+	var err error
+
+	switch exporter {
+	case "", ExporterNone:
+		return Disabled(), nil
+	case ExporterStdout:
+		exp, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	case ExporterFile:
+		if file == "" {
+			file = DefaultFile
+		}
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create trace directory: %w", err)
+		}
+		f, ferr := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if ferr != nil {
+			return nil, fmt.Errorf("failed to open trace file: %w", ferr)
+		}
+		output = f
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(f))
+	case ExporterOTLP:
+		exp, err = otlptracehttp.New(ctx)
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q (want none, stdout, file or otlp)", exporter)
+	}
+	if err != nil {
+		if output != nil {
+			output.Close()
+		}
+		return nil, fmt.Errorf("unable to create %s trace exporter: %w", exporter, err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(ServiceName),
+		semconv.ServiceVersion(version),
+	))
+	if err != nil {
+		exp.Shutdown(ctx)
+		if output != nil {
+			output.Close()
+		}
+		return nil, fmt.Errorf("unable to build trace resource: %w", err)
+	}
+
+	sdk := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(res),
+	)
+	return &Provider{tracer: sdk.Tracer(instrumentation), sdk: sdk, output: output}, nil
+}
+
+// Shutdown flushes any buffered spans and stops the exporter
+func (p *Provider) Shutdown(ctx context.Context) error {
+	if p.sdk == nil {
+		return nil
+	}
+	err := p.sdk.Shutdown(ctx)
+	if p.output != nil {
+		p.output.Close()
+	}
+	return err
+}
+
+// Tracer returns the application tracer
+func (p *Provider) Tracer() trace.Tracer {
+	return p.tracer
+}
+
+// Start starts a span as a child of any span in ctx
+func (p *Provider) Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return p.tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End records err on the span (if any) and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
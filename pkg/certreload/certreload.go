@@ -0,0 +1,117 @@
+package certreload
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// CheckInterval is how often the certificate files are checked for changes
+const CheckInterval = 10 * time.Second
+
+// Reloader serves a TLS certificate loaded from disk and reloads it when the
+// certificate or key file changes, so renewed certificates are picked up without a restart
+type Reloader struct {
+	mu        sync.RWMutex
+	certFile  string
+	keyFile   string
+	cert      *tls.Certificate
+	certMod   time.Time
+	keyMod    time.Time
+	lastCheck time.Time
+	ErrorLog  *log.Logger // Optional: reload failures are logged here (the previous certificate stays in use)
+}
+
+// New loads the certificate and key pair and returns a Reloader for it
+func New(certFile, keyFile string) (*Reloader, error) {
+	r := &Reloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (r *Reloader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.maybeReload()
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// maybeReload reloads the key pair if CheckInterval has passed and either file's modification time changed
+func (r *Reloader) maybeReload() {
+	r.mu.RLock()
+	due := time.Since(r.lastCheck) >= CheckInterval
+	r.mu.RUnlock()
+	if !due {
+		return
+	}
+
+	certMod, keyMod, err := r.modTimes()
+
+	r.mu.Lock()
+	r.lastCheck = time.Now()
+	changed := err == nil && (!certMod.Equal(r.certMod) || !keyMod.Equal(r.keyMod))
+	r.mu.Unlock()
+
+	if err != nil {
+		r.logf("Unable to stat TLS certificate files: %v", err)
+		return
+	}
+	if !changed {
+		return
+	}
+
+	if err := r.load(); err != nil {
+		r.logf("Failed to reload TLS certificate, keeping previous one: %v", err)
+	}
+}
+
+// load reads the key pair from disk and swaps it in
+func (r *Reloader) load() error {
+	certMod, keyMod, err := r.modTimes()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("unable to load TLS key pair: %w", err)
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.certMod = certMod
+	r.keyMod = keyMod
+	r.lastCheck = time.Now()
+	r.mu.Unlock()
+
+	return nil
+}
+
+// modTimes returns the modification times of the certificate and key files
+func (r *Reloader) modTimes() (time.Time, time.Time, error) {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("unable to stat certificate: %w", err)
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("unable to stat key: %w", err)
+	}
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
+
+func (r *Reloader) logf(format string, v ...interface{}) {
+	if r.ErrorLog != nil {
+		r.ErrorLog.Printf(format, v...)
+	}
+}
@@ -19,7 +19,6 @@ const (
 	CookieName  = "__csrf_token"
 	HeaderName  = "X-CSRF-Token"
 	FormField   = "csrf_token"
-	MaxAge      = 12 * time.Hour // Token valid for 12 hours
 )
 
 // GenerateToken generates a cryptographically secure random token
@@ -31,8 +30,8 @@ func GenerateToken() (string, error) {
 	return base64.URLEncoding.EncodeToString(b), nil
 }
 
-// SetCookie sets the CSRF token as an HTTP-only cookie
-func SetCookie(w http.ResponseWriter, token string, env string) {
+// SetCookie sets the CSRF token as an HTTP-only cookie that expires after maxAge
+func SetCookie(w http.ResponseWriter, token string, env string, maxAge time.Duration) {
 	cookie := &http.Cookie{
 		Name:     CookieName,
 		Value:    token,
@@ -40,7 +39,7 @@ func SetCookie(w http.ResponseWriter, token string, env string) {
 		HttpOnly: true,
 		Secure:   config.IsSecureCookie(env),
 		SameSite: http.SameSiteStrictMode,
-		MaxAge:   int(MaxAge.Seconds()),
+		MaxAge:   int(maxAge.Seconds()),
 	}
 	http.SetCookie(w, cookie)
 }
@@ -111,7 +110,7 @@ func IsSafeMethod(method string) bool {
 
 // GenerateAndSetToken generates a new CSRF token and sets it as a cookie
 // Returns the token for use in templates
-func GenerateAndSetToken(w http.ResponseWriter, r *http.Request, env string) (string, error) {
+func GenerateAndSetToken(w http.ResponseWriter, r *http.Request, env string, maxAge time.Duration) (string, error) {
 	// Check if token already exists and is valid
 	if existingToken, err := GetCookie(r); err == nil && existingToken != "" {
 		return existingToken, nil
@@ -124,7 +123,7 @@ func GenerateAndSetToken(w http.ResponseWriter, r *http.Request, env string) (st
 	}
 
 	// Set cookie
-	SetCookie(w, token, env)
+	SetCookie(w, token, env, maxAge)
 
 	return token, nil
 }
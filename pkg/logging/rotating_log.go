@@ -9,6 +9,7 @@ import (
 	"time"
 )
 
+// Defaults used for zero-valued Options fields
 const (
 	MaxLogSize  = 5 * 1024 * 1024     // 5MB
 	MaxLogAge   = 14 * 24 * time.Hour // 2 weeks
@@ -16,6 +17,15 @@ const (
 	LogFileName = "access.log"
 )
 
+// Options configures where logs are written and when they rotate
+type Options struct {
+	Dir     string        // Log directory (default LogDir)
+	File    string        // Log file name inside Dir (default LogFileName)
+	MaxSize int64         // Rotate when the file reaches this many bytes (default MaxLogSize)
+	MaxAge  time.Duration // Rotate when the file is older than this (default MaxLogAge)
+	Console bool          // Also write every line to stdout
+}
+
 // RotatingLogWriter handles log file rotation based on size and age
 type RotatingLogWriter struct {
 	mu          sync.Mutex
@@ -23,17 +33,32 @@ type RotatingLogWriter struct {
 	currentSize int64
 	createdAt   time.Time
 	logPath     string
+	maxSize     int64
+	maxAge      time.Duration
 	baseWriter  io.Writer // For console output in dev mode
 }
 
 // NewRotatingLogWriter creates a new rotating log writer
-func NewRotatingLogWriter(alsoWriteToConsole bool) (*RotatingLogWriter, error) {
+func NewRotatingLogWriter(opts Options) (*RotatingLogWriter, error) {
+	if opts.Dir == "" {
+		opts.Dir = LogDir
+	}
+	if opts.File == "" {
+		opts.File = LogFileName
+	}
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = MaxLogSize
+	}
+	if opts.MaxAge <= 0 {
+		opts.MaxAge = MaxLogAge
+	}
+
 	// Create log directory if it doesn't exist
-	if err := os.MkdirAll(LogDir, 0755); err != nil {
+	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create log directory: %w", err)
 	}
 
-	logPath := filepath.Join(LogDir, LogFileName)
+	logPath := filepath.Join(opts.Dir, opts.File)
 
 	// Open or create the log file
 	file, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
@@ -61,14 +86,16 @@ func NewRotatingLogWriter(alsoWriteToConsole bool) (*RotatingLogWriter, error) {
 		currentSize: info.Size(),
 		createdAt:   fileAge,
 		logPath:     logPath,
+		maxSize:     opts.MaxSize,
+		maxAge:      opts.MaxAge,
 	}
 
-	if alsoWriteToConsole {
+	if opts.Console {
 		writer.baseWriter = os.Stdout
 	}
 
 	// If existing file is already older than max age, rotate immediately
-	if time.Since(fileAge) >= MaxLogAge && info.Size() > 0 {
+	if time.Since(fileAge) >= writer.maxAge && info.Size() > 0 {
 		if err := writer.rotate(); err != nil {
 			return nil, fmt.Errorf("failed to rotate old log file: %w", err)
 		}
@@ -82,6 +109,10 @@ func (r *RotatingLogWriter) Write(p []byte) (n int, err error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	if r.currentFile == nil {
+		return 0, os.ErrClosed
+	}
+
 	// Check if rotation is needed
 	if r.shouldRotate() {
 		if err := r.rotate(); err != nil {
@@ -108,12 +139,12 @@ func (r *RotatingLogWriter) Write(p []byte) (n int, err error) {
 // shouldRotate checks if log rotation is needed
 func (r *RotatingLogWriter) shouldRotate() bool {
 	// Rotate if file size exceeds max size
-	if r.currentSize >= MaxLogSize {
+	if r.currentSize >= r.maxSize {
 		return true
 	}
 
 	// Rotate if file age exceeds max age
-	if time.Since(r.createdAt) >= MaxLogAge {
+	if time.Since(r.createdAt) >= r.maxAge {
 		return true
 	}
 
@@ -156,13 +187,19 @@ func (r *RotatingLogWriter) rotate() error {
 	return nil
 }
 
-// Close closes the log file
+// Close flushes the log file to disk and closes it
 func (r *RotatingLogWriter) Close() error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	if r.currentFile != nil {
-		return r.currentFile.Close()
+	if r.currentFile == nil {
+		return nil
 	}
-	return nil
+	if err := r.currentFile.Sync(); err != nil {
+		r.currentFile.Close()
+		return fmt.Errorf("failed to flush log file: %w", err)
+	}
+	err := r.currentFile.Close()
+	r.currentFile = nil
+	return err
 }